@@ -104,6 +104,42 @@ type IslandInstance struct {
 	Rotation                                 float64 `json:"rotation"`
 }
 
+// DiscoZone is a discovery zone placed on a server
+type DiscoZone struct {
+	Name              string  `json:"name"`
+	SizeX             float64 `json:"sizeX"`
+	SizeY             float64 `json:"sizeY"`
+	SizeZ             float64 `json:"sizeZ"`
+	ID                int     `json:"id"`
+	Xp                float64 `json:"xp"`
+	BIsManuallyPlaced bool    `json:"bIsManuallyPlaced"`
+	ManualVolumeName  string  `json:"ManualVolumeName,omitempty"`
+	ExplorerNoteIndex int     `json:"explorerNoteIndex"`
+	AllowSea          bool    `json:"allowSea"`
+	WorldX            float64 `json:"worldX"`
+	WorldY            float64 `json:"worldY"`
+	Rotation          float64 `json:"rotation"`
+}
+
+// ShipPathNode is a spline point of a ship path
+type ShipPathNode struct {
+	ControlPointsDistance float64 `json:"controlPointsDistance"`
+	WorldX                float64 `json:"worldX"`
+	WorldY                float64 `json:"worldY"`
+	Rotation              float64 `json:"rotation"`
+}
+
+// ShipPath is a route followed by NPC ships across the cluster
+type ShipPath struct {
+	Nodes                     []ShipPathNode `json:"Nodes"`
+	PathID                    int            `json:"PathId"`
+	IsLooping                 bool           `json:"isLooping"`
+	PathName                  string         `json:"PathName"`
+	AutoSpawnShipClass        string         `json:"AutoSpawnShipClass"`
+	AutoSpawnEveryUTCInterval float64        `json:"AutoSpawnEveryUTCInterval"`
+	AutoSpawn                 bool           `json:"autoSpawn"`
+}
+
 // ServerGridConfig holds the per-server game information for an Atlas cluster
 type ServerGridConfig struct {
 	GridX                                                  int               `json:"gridX"`
@@ -157,23 +193,9 @@ type ServerGridConfig struct {
 	ExtraSublevels      []string         `json:"extraSublevels"`
 	TotalExtraSublevels []string         `json:"totalExtraSublevels"`
 	IslandInstances     []IslandInstance `json:"islandInstances"`
-	DiscoZones          []struct {
-		Name              string  `json:"name"`
-		SizeX             float64 `json:"sizeX"`
-		SizeY             float64 `json:"sizeY"`
-		SizeZ             float64 `json:"sizeZ"`
-		ID                int     `json:"id"`
-		Xp                float64 `json:"xp"`
-		BIsManuallyPlaced bool    `json:"bIsManuallyPlaced"`
-		ManualVolumeName  string  `json:"ManualVolumeName,omitempty"`
-		ExplorerNoteIndex int     `json:"explorerNoteIndex"`
-		AllowSea          bool    `json:"allowSea"`
-		WorldX            float64 `json:"worldX"`
-		WorldY            float64 `json:"worldY"`
-		Rotation          float64 `json:"rotation"`
-	} `json:"discoZones"`
-	SpawnRegions       []interface{} `json:"spawnRegions"`
-	ServerTemplateName string        `json:"serverTemplateName"`
+	DiscoZones          []DiscoZone      `json:"discoZones"`
+	SpawnRegions        []interface{}    `json:"spawnRegions"`
+	ServerTemplateName  string           `json:"serverTemplateName"`
 }
 
 // GridConfig holds the game configuration for an Atlas cluster
@@ -211,26 +233,13 @@ type GridConfig struct {
 		NPCSpawnLimits                 string  `json:"NPCSpawnLimits"`
 		MaxDesiredNumEnemiesMultiplier float64 `json:"MaxDesiredNumEnemiesMultiplier"`
 	} `json:"spawnerOverrideTemplates"`
-	IDGenerator          int `json:"idGenerator"`
-	RegionsIDGenerator   int `json:"regionsIdGenerator"`
-	ShipPathsIDGenerator int `json:"shipPathsIdGenerator"`
-	ShipPaths            []struct {
-		Nodes []struct {
-			ControlPointsDistance float64 `json:"controlPointsDistance"`
-			WorldX                float64 `json:"worldX"`
-			WorldY                float64 `json:"worldY"`
-			Rotation              float64 `json:"rotation"`
-		} `json:"Nodes"`
-		PathID                    int     `json:"PathId"`
-		IsLooping                 bool    `json:"isLooping"`
-		PathName                  string  `json:"PathName"`
-		AutoSpawnShipClass        string  `json:"AutoSpawnShipClass"`
-		AutoSpawnEveryUTCInterval float64 `json:"AutoSpawnEveryUTCInterval"`
-		AutoSpawn                 bool    `json:"autoSpawn"`
-	} `json:"shipPaths"`
-	LastImageOverride string                  `json:"lastImageOverride"`
-	ServerTemplates   []interface{}           `json:"serverTemplates"`
-	Islands           map[int]*IslandInstance `json:"-"`
+	IDGenerator          int                     `json:"idGenerator"`
+	RegionsIDGenerator   int                     `json:"regionsIdGenerator"`
+	ShipPathsIDGenerator int                     `json:"shipPathsIdGenerator"`
+	ShipPaths            []ShipPath              `json:"shipPaths"`
+	LastImageOverride    string                  `json:"lastImageOverride"`
+	ServerTemplates      []interface{}           `json:"serverTemplates"`
+	Islands              map[int]*IslandInstance `json:"-"`
 }
 
 // LoadGridConfig loads and returns a GridConfig from the specified file
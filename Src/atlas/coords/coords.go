@@ -0,0 +1,186 @@
+// Package coords converts between the coordinate systems of an Atlas cluster:
+//
+//   - server: a packed server ID plus a location relative to that server's
+//     cell, each axis in [0, 1]
+//   - world: absolute Unreal units from the top left of the cluster
+//   - map: world units divided by the longest side of the cluster, so the
+//     longest axis spans [0, 1] and the aspect ratio is preserved
+//   - GPS: the in-game display, a cell name such as "D5" and a longitude and
+//     latitude spanning [-100, 100] (scaled by CoordsScaling)
+package coords
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"AtlasMapViewer/atlas"
+)
+
+// Grid describes the layout of a cluster.
+type Grid struct {
+	CellSize float64 // world units per server cell
+	CellsX   int
+	CellsY   int
+	Scaling  float64 // GPS scaling, 1 when not configured
+}
+
+// New returns the grid described by a ServerGrid.json config.
+func New(cfg *atlas.GridConfig) Grid {
+	scaling := cfg.CoordsScaling
+	if scaling == 0 {
+		scaling = 1
+	}
+	return Grid{
+		CellSize: cfg.GridSize,
+		CellsX:   cfg.TotalGridsX,
+		CellsY:   cfg.TotalGridsY,
+		Scaling:  scaling,
+	}
+}
+
+// Pack packs server cell coordinates into a server ID. X is held in the high
+// 16 bits and Y in the low 16 bits.
+func Pack(x, y uint16) uint32 {
+	return uint32(x)<<16 | uint32(y)
+}
+
+// Unpack splits a packed server ID into its cell coordinates.
+func Unpack(packed uint32) (x, y uint16) {
+	return uint16(packed >> 16), uint16(packed)
+}
+
+// ParsePacked parses a decimal packed server ID as used by redis and game
+// commands.
+func ParsePacked(s string) (x, y uint16, err error) {
+	var id uint64
+	id, err = strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return
+	}
+	x, y = Unpack(uint32(id))
+	return
+}
+
+// Width returns the width of the cluster in world units.
+func (g Grid) Width() float64 {
+	return g.CellSize * float64(g.CellsX)
+}
+
+// Height returns the height of the cluster in world units.
+func (g Grid) Height() float64 {
+	return g.CellSize * float64(g.CellsY)
+}
+
+// Extent returns the longest side of the cluster in world units, the divisor
+// for map coordinates.
+func (g Grid) Extent() float64 {
+	return math.Max(g.Width(), g.Height())
+}
+
+// Contains reports whether the cell coordinates are inside the grid.
+func (g Grid) Contains(cellX, cellY int) bool {
+	return cellX >= 0 && cellY >= 0 && cellX < g.CellsX && cellY < g.CellsY
+}
+
+// ServerToWorld converts a location relative to a server cell to world units.
+func (g Grid) ServerToWorld(cellX, cellY int, relX, relY float64) (x, y float64) {
+	return (float64(cellX) + relX) * g.CellSize, (float64(cellY) + relY) * g.CellSize
+}
+
+// WorldToServer returns the server cell containing a world location and the
+// location relative to it. Locations on the far edges belong to the last cell.
+func (g Grid) WorldToServer(x, y float64) (cellX, cellY int, relX, relY float64) {
+	cellX, relX = split(x/g.CellSize, g.CellsX)
+	cellY, relY = split(y/g.CellSize, g.CellsY)
+	return
+}
+
+func split(v float64, cells int) (int, float64) {
+	cell := int(math.Floor(v))
+	if cell >= cells && cells > 0 {
+		cell = cells - 1
+	}
+	return cell, v - float64(cell)
+}
+
+// PackedToWorld converts a packed server ID and relative location to world
+// units.
+func (g Grid) PackedToWorld(packed uint32, relX, relY float64) (x, y float64) {
+	cellX, cellY := Unpack(packed)
+	return g.ServerToWorld(int(cellX), int(cellY), relX, relY)
+}
+
+// WorldToPacked converts world units to a packed server ID and relative
+// location.
+func (g Grid) WorldToPacked(x, y float64) (packed uint32, relX, relY float64) {
+	cellX, cellY, relX, relY := g.WorldToServer(x, y)
+	return Pack(uint16(cellX), uint16(cellY)), relX, relY
+}
+
+// WorldToMap converts world units to map coordinates.
+func (g Grid) WorldToMap(x, y float64) (mx, my float64) {
+	extent := g.Extent()
+	return x / extent, y / extent
+}
+
+// MapToWorld converts map coordinates to world units.
+func (g Grid) MapToWorld(mx, my float64) (x, y float64) {
+	extent := g.Extent()
+	return mx * extent, my * extent
+}
+
+// WorldToMapDistance converts a length in world units to map units.
+func (g Grid) WorldToMapDistance(d float64) float64 {
+	return d / g.Extent()
+}
+
+// WorldToGPS converts world units to the in-game longitude and latitude.
+// Longitude grows to the east and latitude to the north.
+func (g Grid) WorldToGPS(x, y float64) (long, lat float64) {
+	long = (x/g.Width()*200 - 100) * g.Scaling
+	lat = (100 - y/g.Height()*200) * g.Scaling
+	return
+}
+
+// GPSToWorld converts the in-game longitude and latitude to world units.
+func (g Grid) GPSToWorld(long, lat float64) (x, y float64) {
+	x = (long/g.Scaling + 100) / 200 * g.Width()
+	y = (100 - lat/g.Scaling) / 200 * g.Height()
+	return
+}
+
+// CellName returns the in-game name of a server cell: a column letter, using
+// AA, AB, ... past Z, followed by the 1 based row, e.g. "D5".
+func CellName(cellX, cellY int) string {
+	column := ""
+	for n := cellX + 1; n > 0; n = (n - 1) / 26 {
+		column = string(rune('A'+(n-1)%26)) + column
+	}
+	return column + strconv.Itoa(cellY+1)
+}
+
+// ParseCellName parses a cell name such as "D5" into cell coordinates.
+func ParseCellName(name string) (cellX, cellY int, err error) {
+	i := 0
+	column := 0
+	for ; i < len(name) && name[i] >= 'A' && name[i] <= 'Z'; i++ {
+		column = column*26 + int(name[i]-'A') + 1
+	}
+	if i == 0 || i == len(name) {
+		return 0, 0, fmt.Errorf("invalid cell name %q", name)
+	}
+	row, err := strconv.Atoi(name[i:])
+	if err != nil || row < 1 {
+		return 0, 0, fmt.Errorf("invalid cell name %q", name)
+	}
+	return column - 1, row - 1, nil
+}
+
+// FormatGPS returns the in-game display of a world location, e.g.
+// "D5 (-45.20, 63.10)".
+func (g Grid) FormatGPS(x, y float64) string {
+	cellX, cellY, _, _ := g.WorldToServer(x, y)
+	long, lat := g.WorldToGPS(x, y)
+	return fmt.Sprintf("%s (%.2f, %.2f)", CellName(cellX, cellY), long, lat)
+}
@@ -0,0 +1,276 @@
+package coords
+
+import (
+	"math"
+	"testing"
+
+	"AtlasMapViewer/atlas"
+)
+
+const epsilon = 1e-6
+
+var testGrids = []struct {
+	name string
+	grid Grid
+}{
+	{"square", Grid{CellSize: 1400000, CellsX: 15, CellsY: 15, Scaling: 1}},
+	{"wide", Grid{CellSize: 1400000, CellsX: 12, CellsY: 8, Scaling: 1}},
+	{"tall", Grid{CellSize: 1400000, CellsX: 8, CellsY: 12, Scaling: 1}},
+	{"scaled", Grid{CellSize: 700000, CellsX: 12, CellsY: 8, Scaling: 1.5}},
+	{"single", Grid{CellSize: 1400000, CellsX: 1, CellsY: 1, Scaling: 1}},
+	{"wide columns", Grid{CellSize: 1000, CellsX: 30, CellsY: 2, Scaling: 1}},
+}
+
+// relative locations, including both edges of a cell
+var testRelative = []float64{0, 0.001, 0.25, 0.5, 0.999}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= epsilon*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func TestNew(t *testing.T) {
+	g := New(&atlas.GridConfig{GridSize: 1400000, TotalGridsX: 12, TotalGridsY: 8})
+	if g != (Grid{CellSize: 1400000, CellsX: 12, CellsY: 8, Scaling: 1}) {
+		t.Errorf("New without CoordsScaling = %+v", g)
+	}
+	g = New(&atlas.GridConfig{GridSize: 1400000, TotalGridsX: 12, TotalGridsY: 8, CoordsScaling: 2})
+	if g.Scaling != 2 {
+		t.Errorf("New scaling = %v, want 2", g.Scaling)
+	}
+}
+
+func TestPackUnpack(t *testing.T) {
+	for _, c := range []struct {
+		x, y   uint16
+		packed uint32
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{1, 0, 65536},
+		{3, 4, 196612},
+		{11, 7, 720903},
+		{65535, 65535, 4294967295},
+	} {
+		if packed := Pack(c.x, c.y); packed != c.packed {
+			t.Errorf("Pack(%d, %d) = %d, want %d", c.x, c.y, packed, c.packed)
+		}
+		if x, y := Unpack(c.packed); x != c.x || y != c.y {
+			t.Errorf("Unpack(%d) = %d, %d, want %d, %d", c.packed, x, y, c.x, c.y)
+		}
+	}
+}
+
+func TestParsePacked(t *testing.T) {
+	x, y, err := ParsePacked("720903")
+	if err != nil || x != 11 || y != 7 {
+		t.Errorf("ParsePacked(720903) = %d, %d, %v", x, y, err)
+	}
+	for _, s := range []string{"", "-1", "4294967296", "D5"} {
+		if _, _, err := ParsePacked(s); err == nil {
+			t.Errorf("ParsePacked(%q) did not fail", s)
+		}
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	for _, c := range []struct {
+		grid                  Grid
+		width, height, extent float64
+	}{
+		{Grid{CellSize: 100, CellsX: 12, CellsY: 8}, 1200, 800, 1200},
+		{Grid{CellSize: 100, CellsX: 8, CellsY: 12}, 800, 1200, 1200},
+		{Grid{CellSize: 100, CellsX: 15, CellsY: 15}, 1500, 1500, 1500},
+	} {
+		if w, h, e := c.grid.Width(), c.grid.Height(), c.grid.Extent(); w != c.width || h != c.height || e != c.extent {
+			t.Errorf("%+v: width, height, extent = %v, %v, %v, want %v, %v, %v", c.grid, w, h, e, c.width, c.height, c.extent)
+		}
+	}
+}
+
+func TestServerWorldRoundTrip(t *testing.T) {
+	for _, tg := range testGrids {
+		g := tg.grid
+		for cellX := 0; cellX < g.CellsX; cellX++ {
+			for cellY := 0; cellY < g.CellsY; cellY++ {
+				for _, relX := range testRelative {
+					for _, relY := range testRelative {
+						x, y := g.ServerToWorld(cellX, cellY, relX, relY)
+						if x < 0 || y < 0 || x >= g.Width() || y >= g.Height() {
+							t.Fatalf("%s: ServerToWorld(%d, %d, %v, %v) = %v, %v is outside the grid", tg.name, cellX, cellY, relX, relY, x, y)
+						}
+						cx, cy, rx, ry := g.WorldToServer(x, y)
+						if cx != cellX || cy != cellY || !near(rx, relX) || !near(ry, relY) {
+							t.Fatalf("%s: WorldToServer(ServerToWorld(%d, %d, %v, %v)) = %d, %d, %v, %v",
+								tg.name, cellX, cellY, relX, relY, cx, cy, rx, ry)
+						}
+
+						packed, rx, ry := g.WorldToPacked(x, y)
+						if packed != Pack(uint16(cellX), uint16(cellY)) || !near(rx, relX) || !near(ry, relY) {
+							t.Fatalf("%s: WorldToPacked(%v, %v) = %d, %v, %v", tg.name, x, y, packed, rx, ry)
+						}
+						if px, py := g.PackedToWorld(packed, relX, relY); !near(px, x) || !near(py, y) {
+							t.Fatalf("%s: PackedToWorld(%d, %v, %v) = %v, %v, want %v, %v", tg.name, packed, relX, relY, px, py, x, y)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWorldToServerEdges(t *testing.T) {
+	for _, tg := range testGrids {
+		g := tg.grid
+		// the far edges of the cluster belong to the last cells
+		cx, cy, rx, ry := g.WorldToServer(g.Width(), g.Height())
+		if cx != g.CellsX-1 || cy != g.CellsY-1 || !near(rx, 1) || !near(ry, 1) {
+			t.Errorf("%s: WorldToServer(far corner) = %d, %d, %v, %v", tg.name, cx, cy, rx, ry)
+		}
+		cx, cy, rx, ry = g.WorldToServer(0, 0)
+		if cx != 0 || cy != 0 || rx != 0 || ry != 0 {
+			t.Errorf("%s: WorldToServer(origin) = %d, %d, %v, %v", tg.name, cx, cy, rx, ry)
+		}
+		// a cell border belongs to the cell starting there
+		if g.CellsX > 1 {
+			cx, _, rx, _ = g.WorldToServer(g.CellSize, 0)
+			if cx != 1 || rx != 0 {
+				t.Errorf("%s: WorldToServer(cell border) = %d, %v, want 1, 0", tg.name, cx, rx)
+			}
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	g := Grid{CellSize: 100, CellsX: 12, CellsY: 8}
+	for _, c := range []struct {
+		x, y int
+		in   bool
+	}{
+		{0, 0, true}, {11, 7, true}, {11, 0, true}, {0, 7, true},
+		{12, 0, false}, {0, 8, false}, {7, 11, false}, {-1, 0, false}, {0, -1, false},
+	} {
+		if g.Contains(c.x, c.y) != c.in {
+			t.Errorf("Contains(%d, %d) = %v, want %v", c.x, c.y, !c.in, c.in)
+		}
+	}
+}
+
+func TestWorldMapRoundTrip(t *testing.T) {
+	for _, tg := range testGrids {
+		g := tg.grid
+		for _, fx := range []float64{0, 0.1, 0.5, 0.9, 1} {
+			for _, fy := range []float64{0, 0.1, 0.5, 0.9, 1} {
+				x, y := fx*g.Width(), fy*g.Height()
+				mx, my := g.WorldToMap(x, y)
+				// the longest axis spans [0, 1], the other keeps the aspect ratio
+				if mx < 0 || my < 0 || mx > 1+epsilon || my > 1+epsilon {
+					t.Fatalf("%s: WorldToMap(%v, %v) = %v, %v is outside [0, 1]", tg.name, x, y, mx, my)
+				}
+				if !near(mx, x/g.Extent()) || !near(my, y/g.Extent()) {
+					t.Fatalf("%s: WorldToMap(%v, %v) = %v, %v does not keep the aspect ratio", tg.name, x, y, mx, my)
+				}
+				if wx, wy := g.MapToWorld(mx, my); !near(wx, x) || !near(wy, y) {
+					t.Fatalf("%s: MapToWorld(WorldToMap(%v, %v)) = %v, %v", tg.name, x, y, wx, wy)
+				}
+			}
+		}
+		mx, my := g.WorldToMap(g.Width(), g.Height())
+		if g.CellsX >= g.CellsY && !near(mx, 1) || g.CellsY >= g.CellsX && !near(my, 1) {
+			t.Errorf("%s: the far corner is at %v, %v, the longest axis should reach 1", tg.name, mx, my)
+		}
+		if d := g.WorldToMapDistance(g.CellSize); !near(d, 1/float64(maxInt(g.CellsX, g.CellsY))) {
+			t.Errorf("%s: WorldToMapDistance(cell) = %v", tg.name, d)
+		}
+	}
+}
+
+func TestGPS(t *testing.T) {
+	for _, tg := range testGrids {
+		g := tg.grid
+		s := g.Scaling
+		for _, c := range []struct {
+			fx, fy    float64
+			long, lat float64
+		}{
+			{0, 0, -100, 100},
+			{1, 1, 100, -100},
+			{1, 0, 100, 100},
+			{0, 1, -100, -100},
+			{0.5, 0.5, 0, 0},
+			{0.25, 0.75, -50, -50},
+		} {
+			x, y := c.fx*g.Width(), c.fy*g.Height()
+			long, lat := g.WorldToGPS(x, y)
+			if !near(long, c.long*s) || !near(lat, c.lat*s) {
+				t.Errorf("%s: WorldToGPS(%v, %v) = %v, %v, want %v, %v", tg.name, x, y, long, lat, c.long*s, c.lat*s)
+			}
+			if wx, wy := g.GPSToWorld(long, lat); !near(wx, x) || !near(wy, y) {
+				t.Errorf("%s: GPSToWorld(WorldToGPS(%v, %v)) = %v, %v", tg.name, x, y, wx, wy)
+			}
+		}
+	}
+}
+
+func TestCellName(t *testing.T) {
+	for _, c := range []struct {
+		x, y int
+		name string
+	}{
+		{0, 0, "A1"},
+		{3, 4, "D5"},
+		{11, 7, "L8"},
+		{7, 11, "H12"},
+		{25, 0, "Z1"},
+		{26, 0, "AA1"},
+		{27, 9, "AB10"},
+		{51, 0, "AZ1"},
+		{52, 0, "BA1"},
+		{701, 0, "ZZ1"},
+		{702, 0, "AAA1"},
+	} {
+		if name := CellName(c.x, c.y); name != c.name {
+			t.Errorf("CellName(%d, %d) = %q, want %q", c.x, c.y, name, c.name)
+		}
+		if x, y, err := ParseCellName(c.name); err != nil || x != c.x || y != c.y {
+			t.Errorf("ParseCellName(%q) = %d, %d, %v", c.name, x, y, err)
+		}
+	}
+	for _, tg := range testGrids {
+		for x := 0; x < tg.grid.CellsX; x++ {
+			for y := 0; y < tg.grid.CellsY; y++ {
+				if px, py, err := ParseCellName(CellName(x, y)); err != nil || px != x || py != y {
+					t.Fatalf("%s: ParseCellName(CellName(%d, %d)) = %d, %d, %v", tg.name, x, y, px, py, err)
+				}
+			}
+		}
+	}
+	for _, name := range []string{"", "A", "5", "A0", "a1", "A-1", "A1B"} {
+		if _, _, err := ParseCellName(name); err == nil {
+			t.Errorf("ParseCellName(%q) did not fail", name)
+		}
+	}
+}
+
+func TestFormatGPS(t *testing.T) {
+	g := Grid{CellSize: 1000, CellsX: 12, CellsY: 8, Scaling: 1}
+	for _, c := range []struct {
+		x, y float64
+		want string
+	}{
+		{0, 0, "A1 (-100.00, 100.00)"},
+		{6000, 4000, "G5 (0.00, 0.00)"},
+		{12000, 8000, "L8 (100.00, -100.00)"},
+		{11700, 7800, "L8 (95.00, -95.00)"},
+	} {
+		if s := g.FormatGPS(c.x, c.y); s != c.want {
+			t.Errorf("FormatGPS(%v, %v) = %q, want %q", c.x, c.y, s, c.want)
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
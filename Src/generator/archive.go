@@ -0,0 +1,483 @@
+package generator
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// archiveRecord is a single line in an archive file.
+type archiveRecord struct {
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+type archiveEntry struct {
+	time   int64
+	offset int64
+}
+
+// Archive is an append-only file of gzip compressed json lines. Every record
+// is written as its own gzip member so it can be read back without
+// decompressing the whole file.
+type Archive struct {
+	path     string
+	maxBytes int64
+	keep     int
+	lock     sync.RWMutex
+	file     *os.File
+	size     int64
+	index    []archiveEntry // ordered by time
+}
+
+// countingReader tracks how much of the file the gzip reader has consumed.
+// It implements io.ByteReader so the decompressor never reads ahead.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// OpenArchive opens or creates the archive at path and indexes its records.
+// A partially written record at the end of the file is truncated.
+func OpenArchive(path string) (*Archive, error) {
+	return OpenRotatingArchive(path, 0, 0)
+}
+
+// OpenRotatingArchive opens an archive like OpenArchive. Once the file would
+// grow past maxBytes it is rotated to path.1, path.1 to path.2 and so on,
+// keeping up to keep rotated files. Only the current file is indexed; At and
+// Each fall back to reading the rotated files. A maxBytes of zero or less
+// never rotates.
+func OpenRotatingArchive(path string, maxBytes int64, keep int) (*Archive, error) {
+	a := &Archive{path: path, maxBytes: maxBytes, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) open() error {
+	file, err := os.OpenFile(a.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	a.file = file
+	a.size = 0
+	a.index = nil
+	cr := &countingReader{r: bufio.NewReader(file)}
+	for {
+		offset := cr.n
+		t, err := readArchiveTime(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Archive %s is damaged at offset %d, truncating: %v", a.path, offset, err)
+			if err = file.Truncate(offset); err != nil {
+				file.Close()
+				return err
+			}
+			break
+		}
+		a.index = append(a.index, archiveEntry{time: t, offset: offset})
+		a.size = cr.n
+	}
+	sort.SliceStable(a.index, func(i, j int) bool { return a.index[i].time < a.index[j].time })
+	return nil
+}
+
+// rotate shifts the rotated files up by one and starts a new file. Without
+// any rotated files to keep the current file is dropped.
+func (a *Archive) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.keep > 0 {
+		os.Remove(a.rotated(a.keep))
+		for i := a.keep - 1; i >= 1; i-- {
+			if err := os.Rename(a.rotated(i), a.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(a.path, a.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *Archive) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// openRotated opens rotated file i, or returns nil if it does not exist.
+func (a *Archive) openRotated(i int) (*Archive, error) {
+	if _, err := os.Stat(a.rotated(i)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	r := &Archive{path: a.rotated(i)}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readArchiveTime decodes the next member and returns its timestamp.
+func readArchiveTime(cr *countingReader) (int64, error) {
+	if _, err := cr.r.Peek(1); err != nil {
+		return 0, err
+	}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return 0, err
+	}
+	zr.Multistream(false)
+	var record struct {
+		Time int64 `json:"time"`
+	}
+	if err = json.NewDecoder(zr).Decode(&record); err != nil {
+		return 0, err
+	}
+	if _, err = io.Copy(ioutil.Discard, zr); err != nil {
+		return 0, err
+	}
+	return record.Time, nil
+}
+
+// Append writes already encoded json as a new record and returns the time it
+// was stamped with. When the clock went backwards the record is stamped with
+// the latest archived time instead, so the records stay in time order.
+func (a *Archive) Append(t time.Time, js []byte) (int64, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	unix := t.Unix()
+	if n := len(a.index); n > 0 && a.index[n-1].time > unix {
+		log.Printf("Archive clock went backwards by %ds, keeping the last time\n", a.index[n-1].time-unix)
+		unix = a.index[n-1].time
+	}
+	line, err := json.Marshal(archiveRecord{Time: unix, Data: js})
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(line)
+	zw.Write([]byte("\n"))
+	if err = zw.Close(); err != nil {
+		return 0, err
+	}
+
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(buf.Len()) > a.maxBytes {
+		if err = a.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = a.file.WriteAt(buf.Bytes(), a.size); err != nil {
+		return 0, err
+	}
+	a.index = append(a.index, archiveEntry{time: unix, offset: a.size})
+	a.size += int64(buf.Len())
+	return unix, nil
+}
+
+// At decodes the latest record written at or before t into v. It returns the
+// record time, or 0 when there is no such record.
+func (a *Archive) At(t int64, v interface{}) (int64, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	found, err := a.at(t, v)
+	// older records are in the rotated files, newest first
+	for i := 1; found == 0 && err == nil && i <= a.keep; i++ {
+		var r *Archive
+		if r, err = a.openRotated(i); r == nil {
+			break
+		}
+		found, err = r.at(t, v)
+		r.Close()
+	}
+	return found, err
+}
+
+func (a *Archive) at(t int64, v interface{}) (int64, error) {
+	i := sort.Search(len(a.index), func(i int) bool { return a.index[i].time > t })
+	if i == 0 {
+		return 0, nil
+	}
+	entry := a.index[i-1]
+	record, err := a.read(entry.offset)
+	if err != nil {
+		return 0, err
+	}
+	return entry.time, json.Unmarshal(record.Data, v)
+}
+
+// Each calls fn for every record in time order, starting with the oldest
+// rotated file, until fn returns false.
+func (a *Archive) Each(fn func(t int64, data json.RawMessage) bool) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for i := a.keep; i >= 1; i-- {
+		r, err := a.openRotated(i)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			continue
+		}
+		more, err := r.each(fn)
+		r.Close()
+		if err != nil || !more {
+			return err
+		}
+	}
+	_, err := a.each(fn)
+	return err
+}
+
+// each calls fn for the records of this file and reports whether fn asked
+// for more.
+func (a *Archive) each(fn func(t int64, data json.RawMessage) bool) (bool, error) {
+	for _, entry := range a.index {
+		record, err := a.read(entry.offset)
+		if err != nil {
+			return false, err
+		}
+		if !fn(record.Time, record.Data) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Close closes the underlying file.
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+func (a *Archive) read(offset int64) (*archiveRecord, error) {
+	section := io.NewSectionReader(a.file, offset, a.size-offset)
+	zr, err := gzip.NewReader(bufio.NewReader(section))
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	var record archiveRecord
+	if err = json.NewDecoder(zr).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// IslandOwnership is one entry in the ownership timeline of an island.
+type IslandOwnership struct {
+	Time           int64  `json:"Time"`
+	TribeID        uint64 `json:"TribeId"`
+	TribeName      string `json:"TribeName"`
+	SettlementName string `json:"SettlementName"`
+}
+
+// History persists every changed island output and periodic entity snapshots
+// so past states can be queried. The ownership timeline of every island is
+// kept in memory, built from the archive when it is opened, so timelines are
+// answered without reading the archive.
+type History struct {
+	islands      *Archive
+	entities     *Archive
+	entityRate   time.Duration
+	lastEntities time.Time
+
+	lock      sync.RWMutex
+	timelines map[int][]IslandOwnership
+}
+
+// OpenHistory opens the island and entity archives in config.ArchiveDir. A
+// negative entity rate disables entity archiving. Both archives are rotated
+// once they would grow past their configured size. Timelines are rebuilt from
+// the island files that are kept, so rotating drops the oldest changes.
+//
+// Nothing reads the entity archive back; it is kept for offline analysis.
+func OpenHistory(config *Config) (*History, error) {
+	dir := config.ArchiveDir
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	islands, err := OpenRotatingArchive(filepath.Join(dir, "islands.jsonl.gz"), config.ArchiveIslandMaxBytes, config.ArchiveIslandKeep)
+	if err != nil {
+		return nil, err
+	}
+	entityRateInSeconds := config.ArchiveEntityRateInSeconds
+	h := &History{
+		islands:    islands,
+		entityRate: time.Duration(entityRateInSeconds) * time.Second,
+		timelines:  make(map[int][]IslandOwnership),
+	}
+	err = islands.Each(func(t int64, data json.RawMessage) bool {
+		var output IslandOutput
+		if err := json.Unmarshal(data, &output); err != nil {
+			log.Printf("Skipping archived islands at %d: %v\n", t, err)
+			return true
+		}
+		h.indexIslands(t, &output)
+		return true
+	})
+	if err != nil {
+		islands.Close()
+		return nil, err
+	}
+	if entityRateInSeconds >= 0 {
+		h.entities, err = OpenRotatingArchive(filepath.Join(dir, "entities.jsonl.gz"), config.ArchiveEntityMaxBytes, config.ArchiveEntityKeep)
+		if err != nil {
+			islands.Close()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// RecordIslands appends a changed island output. A nil History records nothing.
+func (h *History) RecordIslands(output *IslandOutput) {
+	if h == nil {
+		return
+	}
+	js, err := json.Marshal(output)
+	if err == nil {
+		var t int64
+		if t, err = h.islands.Append(time.Now(), js); err == nil {
+			h.indexIslands(t, output)
+		}
+	}
+	if err != nil {
+		log.Printf("Error archiving islands! %v\n", err)
+	}
+}
+
+// indexIslands extends the island timelines with an island output archived at
+// unix time t.
+func (h *History) indexIslands(t int64, output *IslandOutput) {
+	names := make(map[uint64]string, len(output.Companies))
+	for i := range output.Companies {
+		company := &output.Companies[i]
+		if _, found := names[company.TribeID]; !found {
+			names[company.TribeID] = company.TribeName
+		}
+	}
+	current := make(map[int]IslandOwnership, len(output.Islands))
+	for i := range output.Islands {
+		island := &output.Islands[i]
+		if _, found := current[island.IslandID]; !found {
+			current[island.IslandID] = IslandOwnership{
+				Time:           t,
+				TribeID:        island.TribeID,
+				TribeName:      names[island.TribeID],
+				SettlementName: island.SettlementName,
+			}
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// islands missing from the output are unclaimed
+	for id := range h.timelines {
+		if _, found := current[id]; !found {
+			current[id] = IslandOwnership{Time: t, TribeName: names[0]}
+		}
+	}
+	for id, entry := range current {
+		timeline := h.timelines[id]
+		if n := len(timeline); n > 0 {
+			last := &timeline[n-1]
+			if last.TribeID == entry.TribeID && last.SettlementName == entry.SettlementName {
+				continue
+			}
+		} else if entry.TribeID == 0 {
+			continue
+		}
+		h.timelines[id] = append(timeline, entry)
+	}
+}
+
+// RecordEntities appends the encoded entity snapshot if the entity archive
+// rate has elapsed since the last one.
+func (h *History) RecordEntities(js []byte) {
+	if h == nil || h.entities == nil || time.Since(h.lastEntities) < h.entityRate {
+		return
+	}
+	h.lastEntities = time.Now()
+	if _, err := h.entities.Append(h.lastEntities, js); err != nil {
+		log.Printf("Error archiving entities! %v\n", err)
+	}
+}
+
+// IslandsAt returns the island output that was current at unix time t, or nil
+// if t predates the archive.
+func (h *History) IslandsAt(t int64) (*IslandOutput, error) {
+	var output IslandOutput
+	found, err := h.islands.At(t, &output)
+	if err != nil || found == 0 {
+		return nil, err
+	}
+	return &output, nil
+}
+
+// LatestIslands returns the most recently archived island output, or nil if
+// there is none. A nil History has none.
+func (h *History) LatestIslands() *IslandOutput {
+	if h == nil {
+		return nil
+	}
+	output, err := h.IslandsAt(time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+	}
+	return output
+}
+
+// IslandTimeline returns every ownership or settlement name change of one
+// island. An entry with a zero TribeID means the island was unclaimed.
+func (h *History) IslandTimeline(islandID int) []IslandOwnership {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return append(make([]IslandOwnership, 0, len(h.timelines[islandID])), h.timelines[islandID]...)
+}
+
+// Close closes the archives.
+func (h *History) Close() error {
+	err := h.islands.Close()
+	if h.entities != nil {
+		if entitiesErr := h.entities.Close(); err == nil {
+			err = entitiesErr
+		}
+	}
+	return err
+}
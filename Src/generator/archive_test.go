@@ -0,0 +1,215 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArchiveClockBackwards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.jsonl.gz")
+
+	a, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		t    int64
+		data string
+	}{{100, `"a"`}, {200, `"b"`}, {150, `"c"`}, {300, `"d"`}} {
+		if _, err := a.Append(time.Unix(r.t, 0), []byte(r.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(a *Archive) {
+		for _, c := range []struct {
+			at   int64
+			time int64
+			data string
+		}{{99, 0, ""}, {100, 100, "a"}, {199, 100, "a"}, {200, 200, "c"}, {299, 200, "c"}, {300, 300, "d"}} {
+			var data string
+			found, err := a.At(c.at, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != c.time || data != c.data {
+				t.Errorf("At(%d) = %d %q, want %d %q", c.at, found, data, c.time, c.data)
+			}
+		}
+	}
+	check(a)
+	a.Close()
+
+	// the clamped time is written too, so a reopened archive agrees
+	a, err = OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	check(a)
+}
+
+func TestArchiveRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.jsonl.gz")
+
+	// every record takes a few dozen bytes, so each file holds a handful
+	a, err := OpenRotatingArchive(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 1; i <= 40; i++ {
+		if _, err := a.Append(time.Unix(int64(i), 0), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s is %d bytes, want at most 200", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 kept: %v", filepath.Base(path), err)
+	}
+
+	// Each reads the kept rotated files first, in time order
+	var times []int64
+	a.Each(func(t int64, data json.RawMessage) bool {
+		times = append(times, t)
+		return true
+	})
+	first := times[0]
+	if first <= 1 || times[len(times)-1] != 40 {
+		t.Errorf("archive holds %v, want the newest records up to 40", times)
+	}
+	for i := range times {
+		if times[i] != first+int64(i) {
+			t.Errorf("archive holds %v, want consecutive records", times)
+			break
+		}
+	}
+
+	// At finds records in the rotated files, also after reopening
+	b, err := OpenRotatingArchive(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, c := range []struct{ at, want int64 }{{40, 40}, {first, first}, {first + 1, first + 1}, {first - 1, 0}} {
+		var data int64
+		if found, err := b.At(c.at, &data); err != nil || found != c.want || data != c.want {
+			t.Errorf("At(%d) after reopen = %d %d %v, want %d", c.at, found, data, err, c.want)
+		}
+	}
+}
+
+func TestHistoryIslandTimeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := func(islands ...IslandInfoOutput) *IslandOutput {
+		return &IslandOutput{
+			Islands: islands,
+			Companies: []CompanyInfoOutput{
+				{TribeID: 1, TribeName: "One"},
+				{TribeID: 2, TribeName: "Two"},
+			},
+		}
+	}
+	polls := []*IslandOutput{
+		output(),
+		output(IslandInfoOutput{IslandID: 7, TribeID: 1, SettlementName: "a"}),
+		output(IslandInfoOutput{IslandID: 7, TribeID: 1, SettlementName: "a"}, IslandInfoOutput{IslandID: 8, TribeID: 2}),
+		output(IslandInfoOutput{IslandID: 7, TribeID: 1, SettlementName: "b"}, IslandInfoOutput{IslandID: 8, TribeID: 2}),
+		output(IslandInfoOutput{IslandID: 7, TribeID: 2, SettlementName: "b"}),
+		output(IslandInfoOutput{IslandID: 7, TribeID: 2, SettlementName: "b"}),
+	}
+
+	// archive the polls a minute apart, each in its own rotated file, and the
+	// history rebuilds the timelines when it is opened
+	config := &Config{ArchiveDir: dir, ArchiveEntityRateInSeconds: -1, ArchiveIslandMaxBytes: 1, ArchiveIslandKeep: 10}
+	a, err := OpenRotatingArchive(filepath.Join(dir, "islands.jsonl.gz"), config.ArchiveIslandMaxBytes, config.ArchiveIslandKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, poll := range polls {
+		js, _ := json.Marshal(poll)
+		if _, err := a.Append(time.Unix(int64(i+1)*60, 0), js); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	h, err := OpenHistory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int][]IslandOwnership{
+		7: {
+			{Time: 120, TribeID: 1, TribeName: "One", SettlementName: "a"},
+			{Time: 240, TribeID: 1, TribeName: "One", SettlementName: "b"},
+			{Time: 300, TribeID: 2, TribeName: "Two", SettlementName: "b"},
+		},
+		8: {
+			{Time: 180, TribeID: 2, TribeName: "Two"},
+			{Time: 300},
+		},
+		9: {},
+	}
+	check := func(h *History) {
+		for id, timeline := range want {
+			if got := h.IslandTimeline(id); !reflect.DeepEqual(got, timeline) {
+				t.Errorf("IslandTimeline(%d) = %+v, want %+v", id, got, timeline)
+			}
+		}
+	}
+	check(h)
+	if past, err := h.IslandsAt(150); err != nil || past == nil || len(past.Islands) != 1 {
+		t.Errorf("IslandsAt(150) = %+v, %v, want the second poll", past, err)
+	}
+
+	// recorded outputs extend the timelines
+	h.RecordIslands(output(IslandInfoOutput{IslandID: 8, TribeID: 1}))
+	now := time.Now().Unix()
+	want[7] = append(want[7], IslandOwnership{})
+	want[8] = append(want[8], IslandOwnership{TribeID: 1, TribeName: "One"})
+	for _, id := range []int{7, 8} {
+		timeline := h.IslandTimeline(id)
+		if n := len(timeline); n > 0 && timeline[n-1].Time >= now-1 && timeline[n-1].Time <= now {
+			want[id][n-1].Time = timeline[n-1].Time
+		}
+	}
+	check(h)
+	h.Close()
+
+	h, err = OpenHistory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	check(h)
+}
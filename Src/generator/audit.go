@@ -0,0 +1,272 @@
+package generator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"AtlasMapViewer/atlas/coords"
+)
+
+// Audit entry statuses
+const (
+	AuditAttempt   = "attempt"
+	AuditPublished = "published"
+	AuditDenied    = "denied"
+	AuditFailed    = "failed"
+	AuditThrottled = "throttled"
+)
+
+// AuditEntry records one command someone tried to send. Subscribers is the
+// number of game servers redis delivered a published command to.
+type AuditEntry struct {
+	Time        time.Time     `json:"Time"`
+	User        string        `json:"User"`
+	Role        string        `json:"Role"`
+	RemoteAddr  string        `json:"RemoteAddr"`
+	Command     string        `json:"Command"`
+	Target      CommandTarget `json:"Target"`
+	Cell        string        `json:"Cell,omitempty"`
+	Payload     string        `json:"Payload"`
+	Status      string        `json:"Status"`
+	Subscribers int64         `json:"Subscribers"`
+	Error       string        `json:"Error,omitempty"`
+}
+
+// AuditFilter selects entries from the audit log. Zero values match
+// everything.
+type AuditFilter struct {
+	User     string
+	Command  string
+	ServerID uint32
+	Status   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (f *AuditFilter) matches(e *AuditEntry) bool {
+	if len(f.User) > 0 && e.User != f.User {
+		return false
+	}
+	if len(f.Command) > 0 && !strings.EqualFold(e.Command, f.Command) {
+		return false
+	}
+	if f.ServerID != 0 && e.Target.ServerID != f.ServerID {
+		return false
+	}
+	if len(f.Status) > 0 && e.Status != f.Status {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only file of json lines, one per command. Every entry
+// is synced to disk before Record returns. Once the file would grow past its
+// size limit it is rotated to path.1, path.1 to path.2 and so on, dropping
+// the oldest file beyond the number kept.
+type AuditLog struct {
+	path     string
+	maxBytes int64
+	keep     int
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+// OpenAuditLog opens or creates the audit log at path, keeping up to keep
+// rotated files of about maxBytes each. A maxBytes or keep of zero or less
+// never rotates, so no history is ever dropped.
+func OpenAuditLog(path string, maxBytes int64, keep int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxBytes: maxBytes, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Record appends an entry, filling in its time and the cell name of its
+// target server. A nil AuditLog records nothing.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if entry.Target.Kind == TargetServer || entry.Target.Kind == TargetLocation {
+		x, y := coords.Unpack(entry.Target.ServerID)
+		entry.Cell = coords.CellName(int(x), int(y))
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		err = a.append(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("Error writing audit log! %v %+v\n", err, entry)
+	}
+	return err
+}
+
+func (a *AuditLog) append(line []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.maxBytes > 0 && a.keep > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// rotate shifts the rotated files up by one and starts a new file.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(a.rotated(a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotated(i), a.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.rotated(1)); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Query returns matching entries from the current and rotated files, oldest
+// first. With a limit only the newest matches are returned. The lock is only
+// held while the files are opened, so a rotation cannot shift them halfway,
+// and Record is not blocked by the scan.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	files, err := a.openAll()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	results := make([]AuditEntry, 0)
+	for _, file := range files {
+		err := eachLine(file, maxAuditLine, func(line []byte) {
+			var entry AuditEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				// a line cut short by a crash, or still being written
+				return
+			}
+			if !filter.matches(&entry) {
+				return
+			}
+			results = append(results, entry)
+			if filter.Limit > 0 && len(results) > 2*filter.Limit {
+				results = append(results[:0], results[len(results)-filter.Limit:]...)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(results) > filter.Limit {
+		results = results[len(results)-filter.Limit:]
+	}
+	return results, nil
+}
+
+// maxAuditLine is the longest audit log line read back. Longer ones can only
+// come from a damaged file and are skipped.
+const maxAuditLine = 1024 * 1024
+
+// eachLine calls fn for every line of r without its line break, skipping the
+// lines longer than max bytes.
+func eachLine(r io.Reader, max int, fn func(line []byte)) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	line := make([]byte, 0, 1024)
+	skip := false
+	for {
+		part, more, err := reader.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !skip {
+			line = append(line, part...)
+			skip = len(line) > max
+		}
+		if more {
+			continue
+		}
+		if !skip {
+			fn(line)
+		}
+		line, skip = line[:0], false
+	}
+}
+
+// openAll opens the rotated files, oldest first, and then the current file.
+func (a *AuditLog) openAll() ([]*os.File, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	files := make([]*os.File, 0, a.keep+1)
+	for i := a.keep; i >= 0; i-- {
+		path := a.path
+		if i > 0 {
+			path = a.rotated(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -0,0 +1,184 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLogQueryRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small enough to rotate every few entries, large enough to keep them all
+	a, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 600, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		a.Record(AuditEntry{User: "u" + strconv.Itoa(i%2), Command: "broadcast", Status: AuditPublished})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.jsonl.2")); err != nil {
+		t.Fatalf("not rotated: %v", err)
+	}
+
+	all, err := a.Query(AuditFilter{})
+	if err != nil || len(all) != 20 {
+		t.Fatalf("Query = %d entries, %v", len(all), err)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Time.Before(all[i-1].Time) {
+			t.Errorf("entry %d is older than the one before", i)
+		}
+	}
+	newest, err := a.Query(AuditFilter{User: "u1", Limit: 3})
+	if err != nil || len(newest) != 3 {
+		t.Fatalf("Query with a limit = %d entries, %v", len(newest), err)
+	}
+	if newest[2] != all[19] {
+		t.Errorf("newest match %+v, want %+v", newest[2], all[19])
+	}
+}
+
+func TestAuditLogQueryWhileRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 2000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			a.Record(AuditEntry{User: "u", Command: "broadcast", Status: AuditPublished})
+		}
+	}()
+	last := 0
+	for i := 0; i < 20; i++ {
+		entries, err := a.Query(AuditFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) < last {
+			t.Fatalf("Query returned %d entries after %d", len(entries), last)
+		}
+		last = len(entries)
+	}
+	wg.Wait()
+	if entries, _ := a.Query(AuditFilter{}); len(entries) != 200 {
+		t.Errorf("Query = %d entries, want 200", len(entries))
+	}
+}
+
+func TestAuditLogKeepNone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without rotated files to keep the log grows past its size limit
+	a, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := a.Record(AuditEntry{User: "u", Command: "broadcast", Status: AuditPublished}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("audit files = %v, want only the log", files)
+	}
+	if entries, err := a.Query(AuditFilter{}); err != nil || len(entries) != 20 {
+		t.Errorf("Query = %d entries, %v, want 20", len(entries), err)
+	}
+}
+
+func TestAuditLogRecordError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.file.Close()
+	if err := a.Record(AuditEntry{User: "u"}); err == nil {
+		t.Errorf("Record() to a closed file succeeded")
+	}
+	var none *AuditLog
+	if err := none.Record(AuditEntry{User: "u"}); err != nil {
+		t.Errorf("nil Record() = %v", err)
+	}
+}
+
+func TestAuditLogQuerySkipsLongLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	a, err := OpenAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(AuditEntry{User: "before", Status: AuditPublished})
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := `{"User":"long","Command":"` + strings.Repeat("x", 2*maxAuditLine) + `"}` + "\n"
+	if _, err := file.WriteString(long); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	a.Record(AuditEntry{User: "after", Status: AuditPublished})
+
+	entries, err := a.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].User != "before" || entries[1].User != "after" {
+		t.Errorf("Query() = %+v, want the entries around the long line", entries)
+	}
+}
+
+func TestEachLine(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"a\nbb\n", []string{"a", "bb"}},
+		{"a\r\n\nc", []string{"a", "", "c"}},
+		{"abcdef\nab\nabcd\n", []string{"ab", "abcd"}},
+	} {
+		var got []string
+		err := eachLine(strings.NewReader(c.text), 4, func(line []byte) {
+			got = append(got, string(line))
+		})
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("eachLine(%q) = %q, %v, want %q", c.text, got, err, c.want)
+		}
+	}
+}
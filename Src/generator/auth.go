@@ -0,0 +1,248 @@
+package generator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles deciding which command verbs a user may send.
+const (
+	RoleViewer    = "viewer"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// ErrBadLogin is returned for an unknown user or a wrong password.
+var ErrBadLogin = errors.New("bad user name or password")
+
+// Account is a user of the web UI. PasswordHash is a bcrypt hash, see the
+// passwd subcommand.
+type Account struct {
+	Name         string
+	PasswordHash string
+	Role         string
+}
+
+// APIKey grants a role to scripts. KeyHash is the hex SHA-256 of the key, see
+// the apikey subcommand.
+type APIKey struct {
+	Name    string
+	KeyHash string
+	Role    string
+}
+
+// Session is a logged in user, or an API key for a single request.
+type Session struct {
+	Name      string    `json:"Name"`
+	Role      string    `json:"Role"`
+	CSRFToken string    `json:"CSRFToken,omitempty"`
+	Commands  []string  `json:"Commands"`
+	Expires   time.Time `json:"Expires"`
+}
+
+// Auth checks the accounts and API keys from the config and keeps the
+// sessions of logged in users in memory.
+type Auth struct {
+	accounts map[string]Account
+	keys     map[string]APIKey
+	roles    map[string]map[string]bool
+	timeout  time.Duration
+	dummy    []byte // compared for unknown users, so they take as long as known ones
+	lock     sync.Mutex
+	sessions map[string]*Session
+	pruned   time.Time // when expired sessions were last dropped
+}
+
+// sessionPruneInterval is how often session lookups drop expired sessions.
+const sessionPruneInterval = time.Minute
+
+// NewAuth returns the authenticator for the configured accounts, API keys and
+// role commands.
+func NewAuth(config *Config) (*Auth, error) {
+	a := &Auth{
+		accounts: make(map[string]Account),
+		keys:     make(map[string]APIKey),
+		roles:    make(map[string]map[string]bool),
+		timeout:  time.Duration(config.SessionTimeoutInSeconds) * time.Second,
+		sessions: make(map[string]*Session),
+	}
+	dummy, err := HashPassword("")
+	if err != nil {
+		return nil, err
+	}
+	a.dummy = []byte(dummy)
+	for role, verbs := range config.RoleCommands {
+		a.roles[role] = make(map[string]bool)
+		for _, verb := range verbs {
+			a.roles[role][strings.ToLower(verb)] = true
+		}
+	}
+	for _, account := range config.Accounts {
+		if _, found := a.roles[account.Role]; !found {
+			return nil, fmt.Errorf("account %q has unknown role %q", account.Name, account.Role)
+		}
+		a.accounts[account.Name] = account
+	}
+	for _, key := range config.APIKeys {
+		if _, found := a.roles[key.Role]; !found {
+			return nil, fmt.Errorf("API key %q has unknown role %q", key.Name, key.Role)
+		}
+		a.keys[strings.ToLower(key.KeyHash)] = key
+	}
+	return a, nil
+}
+
+// Login checks a user's password and starts a session. The returned token
+// identifies the session. Unknown users are checked against a dummy hash so
+// the time taken does not tell which accounts exist.
+func (a *Auth) Login(name, password string) (string, *Session, error) {
+	account, found := a.accounts[name]
+	hash := a.dummy
+	if found {
+		hash = []byte(account.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !found {
+		return "", nil, ErrBadLogin
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	session := &Session{
+		Name:      account.Name,
+		Role:      account.Role,
+		CSRFToken: csrf,
+		Commands:  a.commands(account.Role),
+		Expires:   time.Now().Add(a.timeout),
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.prune(time.Now())
+	a.sessions[token] = session
+	return token, session, nil
+}
+
+// Logout ends a session.
+func (a *Auth) Logout(token string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.sessions, token)
+}
+
+// Session returns the unexpired session of a token. Every so often it also
+// drops the other expired sessions.
+func (a *Auth) Session(token string) (*Session, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	if now.Sub(a.pruned) >= sessionPruneInterval {
+		a.prune(now)
+	}
+	session, found := a.sessions[token]
+	if !found {
+		return nil, false
+	}
+	if now.After(session.Expires) {
+		delete(a.sessions, token)
+		return nil, false
+	}
+	return session, true
+}
+
+// prune drops the expired sessions. Callers hold the lock.
+func (a *Auth) prune(now time.Time) {
+	for t, s := range a.sessions {
+		if now.After(s.Expires) {
+			delete(a.sessions, t)
+		}
+	}
+	a.pruned = now
+}
+
+// Key returns a session for a valid API key.
+func (a *Auth) Key(key string) (*Session, bool) {
+	k, found := a.keys[HashAPIKey(key)]
+	if !found {
+		return nil, false
+	}
+	return &Session{Name: k.Name, Role: k.Role, Commands: a.commands(k.Role)}, true
+}
+
+// User returns a session with the current role of an account or API key by
+// name, for acting on behalf of a user who is not logged in.
+func (a *Auth) User(name string) (*Session, bool) {
+	if account, found := a.accounts[name]; found {
+		return &Session{Name: account.Name, Role: account.Role, Commands: a.commands(account.Role)}, true
+	}
+	for _, k := range a.keys {
+		if k.Name == name {
+			return &Session{Name: k.Name, Role: k.Role, Commands: a.commands(k.Role)}, true
+		}
+	}
+	return nil, false
+}
+
+// CheckCSRF compares a request's CSRF token with the session's.
+func (s *Session) CheckCSRF(token string) bool {
+	return len(s.CSRFToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
+
+// Allowed reports whether a role may send a command verb. A role with the
+// verb "*" may send anything.
+func (a *Auth) Allowed(role, verb string) bool {
+	verbs := a.roles[role]
+	return verbs["*"] || (len(verb) > 0 && verbs[strings.ToLower(verb)])
+}
+
+func (a *Auth) commands(role string) []string {
+	commands := make([]string, 0, len(a.roles[role]))
+	for verb := range a.roles[role] {
+		commands = append(commands, verb)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// HashPassword returns the bcrypt hash of a password for an Account.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// NewAPIKey returns a random API key and its hash for an APIKey.
+func NewAPIKey() (string, string, error) {
+	key, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hex SHA-256 of an API key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,202 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuth returns an Auth with an admin "alice" and a moderator "bob",
+// both with password "secret", and a moderator API key "key".
+func newTestAuth(t *testing.T) *Auth {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuth(&Config{
+		Accounts: []Account{
+			{Name: "alice", PasswordHash: string(hash), Role: RoleAdmin},
+			{Name: "bob", PasswordHash: string(hash), Role: RoleModerator},
+		},
+		APIKeys: []APIKey{{Name: "script", KeyHash: HashAPIKey("key"), Role: RoleModerator}},
+		RoleCommands: map[string][]string{
+			RoleViewer:    {},
+			RoleModerator: {"SpawnShipFast", "spawnbed"},
+			RoleAdmin:     {"*"},
+		},
+		SessionTimeoutInSeconds: 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestNewAuthUnknownRole(t *testing.T) {
+	roles := map[string][]string{RoleAdmin: {"*"}}
+	for _, config := range []*Config{
+		{RoleCommands: roles, Accounts: []Account{{Name: "alice", Role: "root"}}},
+		{RoleCommands: roles, APIKeys: []APIKey{{Name: "script", Role: "root"}}},
+		{Accounts: []Account{{Name: "alice", Role: RoleAdmin}}},
+	} {
+		if _, err := NewAuth(config); err == nil {
+			t.Errorf("NewAuth(%+v) accepted an unknown role", config)
+		}
+	}
+	if _, err := NewAuth(&Config{RoleCommands: roles, Accounts: []Account{{Name: "alice", Role: RoleAdmin}}}); err != nil {
+		t.Errorf("NewAuth() = %v", err)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	auth := newTestAuth(t)
+	for _, c := range []struct {
+		name, password string
+	}{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"carol", "secret"},
+		{"", ""},
+		{"Alice", "secret"},
+	} {
+		if token, session, err := auth.Login(c.name, c.password); err != ErrBadLogin || len(token) > 0 || session != nil {
+			t.Errorf("Login(%q, %q) = %q, %v, %v, want %v", c.name, c.password, token, session, err, ErrBadLogin)
+		}
+	}
+
+	before := time.Now()
+	token, session, err := auth.Login("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Name != "bob" || session.Role != RoleModerator || len(session.CSRFToken) == 0 || len(token) == 0 {
+		t.Errorf("Login() = %q, %+v", token, session)
+	}
+	if !reflect.DeepEqual(session.Commands, []string{"spawnbed", "spawnshipfast"}) {
+		t.Errorf("Login() commands = %v", session.Commands)
+	}
+	if session.Expires.Before(before.Add(time.Hour)) || session.Expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Login() expires %v, want an hour from now", session.Expires)
+	}
+	if got, ok := auth.Session(token); !ok || got != session {
+		t.Errorf("Session() = %+v, %v, want the login's session", got, ok)
+	}
+	if _, ok := auth.Session("unknown"); ok {
+		t.Errorf("Session() found an unknown token")
+	}
+
+	// every login gets its own session and tokens
+	other, otherSession, err := auth.Login("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token || otherSession.CSRFToken == session.CSRFToken {
+		t.Errorf("second Login() reused the tokens")
+	}
+
+	auth.Logout(token)
+	if _, ok := auth.Session(token); ok {
+		t.Errorf("Session() found a logged out token")
+	}
+	if _, ok := auth.Session(other); !ok {
+		t.Errorf("Logout() ended the other session")
+	}
+}
+
+func TestAuthSessionExpiry(t *testing.T) {
+	auth := newTestAuth(t)
+	token, session, err := auth.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Expires = time.Now().Add(-time.Second)
+	if _, ok := auth.Session(token); ok {
+		t.Errorf("Session() found an expired session")
+	}
+	if _, found := auth.sessions[token]; found {
+		t.Errorf("expired session was kept")
+	}
+
+	// expired sessions are also dropped by the next login
+	stale, session, err := auth.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Expires = time.Now().Add(-time.Second)
+	if _, _, err := auth.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := auth.sessions[stale]; found {
+		t.Errorf("Login() kept an expired session")
+	}
+
+	// and every so often by looking up another session
+	expired, session, err := auth.Login("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Expires = time.Now().Add(-time.Second)
+	auth.Session("unknown")
+	if _, found := auth.sessions[expired]; !found {
+		t.Errorf("Session() pruned again within %v", sessionPruneInterval)
+	}
+	auth.pruned = auth.pruned.Add(-sessionPruneInterval)
+	auth.Session("unknown")
+	if _, found := auth.sessions[expired]; found {
+		t.Errorf("Session() kept an expired session")
+	}
+}
+
+func TestSessionCheckCSRF(t *testing.T) {
+	session := &Session{CSRFToken: "abc"}
+	for _, c := range []struct {
+		token string
+		want  bool
+	}{{"abc", true}, {"abd", false}, {"ab", false}, {"", false}} {
+		if got := session.CheckCSRF(c.token); got != c.want {
+			t.Errorf("CheckCSRF(%q) = %v, want %v", c.token, got, c.want)
+		}
+	}
+	// API key sessions have no token to check against
+	if (&Session{}).CheckCSRF("") {
+		t.Errorf("CheckCSRF() without a token passed")
+	}
+}
+
+func TestAuthKey(t *testing.T) {
+	auth := newTestAuth(t)
+	session, ok := auth.Key("key")
+	if !ok || session.Name != "script" || session.Role != RoleModerator || len(session.CSRFToken) > 0 {
+		t.Errorf("Key() = %+v, %v", session, ok)
+	}
+	for _, key := range []string{"", "Key", HashAPIKey("key")} {
+		if _, ok := auth.Key(key); ok {
+			t.Errorf("Key(%q) accepted", key)
+		}
+	}
+}
+
+func TestAuthAllowed(t *testing.T) {
+	auth := newTestAuth(t)
+	for _, c := range []struct {
+		role, verb string
+		want       bool
+	}{
+		{RoleAdmin, "destroyall", true},
+		{RoleAdmin, "anything", true},
+		{RoleAdmin, "", true},
+		{RoleModerator, "spawnshipfast", true},
+		{RoleModerator, "SpawnBed", true},
+		{RoleModerator, "destroyall", false},
+		{RoleModerator, "*", false},
+		{RoleModerator, "", false},
+		{RoleViewer, "spawnbed", false},
+		{"root", "spawnbed", false},
+	} {
+		if got := auth.Allowed(c.role, c.verb); got != c.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", c.role, c.verb, got, c.want)
+		}
+	}
+}
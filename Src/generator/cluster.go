@@ -0,0 +1,102 @@
+package generator
+
+import (
+	"math"
+	"sort"
+
+	"AtlasMapViewer/atlas/coords"
+)
+
+// EntityCount is the number of entities in a cluster sharing a type, subtype
+// and tribe.
+type EntityCount struct {
+	EntityType    string `json:"EntityType"`
+	EntitySubType string `json:"EntitySubType"`
+	TribeID       string `json:"TribeID"`
+	Count         int    `json:"Count"`
+}
+
+// EntityCluster aggregates the entities on one server. X and Y are the
+// centroid of the entities in map coordinates.
+type EntityCluster struct {
+	ServerID uint32        `json:"ServerId"`
+	Cell     string        `json:"Cell"`
+	X        float64       `json:"X"`
+	Y        float64       `json:"Y"`
+	Count    int           `json:"Count"`
+	Counts   []EntityCount `json:"Counts"`
+}
+
+// EntityView is the part of the map a client asked for at a zoom level: either
+// clusters when zoomed out or the individual entities when zoomed in.
+type EntityView struct {
+	Zoom     int                   `json:"Zoom"`
+	Clusters []EntityCluster       `json:"Clusters,omitempty"`
+	Entities map[string]EntityInfo `json:"Entities,omitempty"`
+}
+
+// Clusters aggregates the entities inside a bounding box in map coordinates
+// per server, ordered by server.
+func (s *SpatialIndex) Clusters(minX, minY, maxX, maxY float64) []EntityCluster {
+	x0, y0 := s.grid.MapToWorld(math.Min(minX, maxX), math.Min(minY, maxY))
+	x1, y1 := s.grid.MapToWorld(math.Max(minX, maxX), math.Max(minY, maxY))
+
+	type accumulator struct {
+		sumX, sumY float64
+		count      int
+		counts     map[EntityCount]int
+	}
+	servers := make(map[uint32]*accumulator)
+
+	s.lock.RLock()
+	s.entities.Query(Bounds{x0, y0, x1, y1}, func(value interface{}) bool {
+		entity := value.(*spatialEntity)
+		acc := servers[entity.server]
+		if acc == nil {
+			acc = &accumulator{counts: make(map[EntityCount]int)}
+			servers[entity.server] = acc
+		}
+		acc.sumX += entity.x
+		acc.sumY += entity.y
+		acc.count++
+		acc.counts[EntityCount{
+			EntityType:    entity.info.EntityType,
+			EntitySubType: entity.info.EntitySubType,
+			TribeID:       entity.info.TribeID,
+		}]++
+		return true
+	})
+	s.lock.RUnlock()
+
+	clusters := make([]EntityCluster, 0, len(servers))
+	for server, acc := range servers {
+		cellX, cellY := coords.Unpack(server)
+		cluster := EntityCluster{
+			ServerID: server,
+			Cell:     coords.CellName(int(cellX), int(cellY)),
+			Count:    acc.count,
+			Counts:   make([]EntityCount, 0, len(acc.counts)),
+		}
+		cluster.X, cluster.Y = s.grid.WorldToMap(acc.sumX/float64(acc.count), acc.sumY/float64(acc.count))
+		for key, n := range acc.counts {
+			key.Count = n
+			cluster.Counts = append(cluster.Counts, key)
+		}
+		sort.Slice(cluster.Counts, func(i, j int) bool {
+			a, b := &cluster.Counts[i], &cluster.Counts[j]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+			if a.EntityType != b.EntityType {
+				return a.EntityType < b.EntityType
+			}
+			if a.EntitySubType != b.EntitySubType {
+				return a.EntitySubType < b.EntitySubType
+			}
+			return a.TribeID < b.TribeID
+		})
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].ServerID < clusters[j].ServerID })
+	return clusters
+}
@@ -0,0 +1,85 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+func TestSpatialIndexClusters(t *testing.T) {
+	// 2 by 1 cells of 1000 units, so a cell is 0.5 by 0.5 on the map
+	index := NewSpatialIndex(&atlas.GridConfig{GridSize: 1000, TotalGridsX: 2, TotalGridsY: 1})
+	entity := func(id string, parent string, x, y uint16, relX, relY float64, entityType string, tribe string) EntityInfo {
+		return EntityInfo{
+			EntityID:                id,
+			ParentEntityID:          parent,
+			EntityType:              entityType,
+			TribeID:                 tribe,
+			ServerXRelativeLocation: relX,
+			ServerYRelativeLocation: relY,
+			ServerID:                [2]uint16{y, x},
+		}
+	}
+	index.UpdateEntities(map[string]EntityInfo{
+		"1": entity("1", "0", 0, 0, 0.2, 0.2, "Ship", "10"),
+		"2": entity("2", "0", 0, 0, 0.4, 0.6, "Ship", "10"),
+		"3": entity("3", "0", 0, 0, 0.6, 0.4, "Ship", "20"),
+		// beds are placed relative to their ship at 0.4, 0.6
+		"4": entity("4", "2", 0, 0, 0.1, 0.1, "Bed", "10"),
+		"5": entity("5", "0", 1, 0, 0.5, 0.5, "Bed", "20"),
+		"6": entity("6", "0", 1, 0, 0.9, 0.1, "Bed", "20"),
+	})
+
+	west := coords.Pack(0, 0)
+	east := coords.Pack(1, 0)
+	want := []EntityCluster{
+		{
+			ServerID: west,
+			Cell:     "A1",
+			X:        (0.2 + 0.4 + 0.6 + 0.5) / 4 / 2,
+			Y:        (0.2 + 0.6 + 0.4 + 0.7) / 4 / 2,
+			Count:    4,
+			Counts: []EntityCount{
+				{EntityType: "Ship", TribeID: "10", Count: 2},
+				{EntityType: "Bed", TribeID: "10", Count: 1},
+				{EntityType: "Ship", TribeID: "20", Count: 1},
+			},
+		},
+		{
+			ServerID: east,
+			Cell:     "B1",
+			X:        (1.5 + 1.9) / 2 / 2,
+			Y:        (0.5 + 0.1) / 2 / 2,
+			Count:    2,
+			Counts:   []EntityCount{{EntityType: "Bed", TribeID: "20", Count: 2}},
+		},
+	}
+
+	check := func(name string, got, want []EntityCluster) {
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d clusters, want %d", name, len(got), len(want))
+		}
+		for i := range want {
+			g, w := got[i], want[i]
+			if !nearlyEqual(g.X, w.X) || !nearlyEqual(g.Y, w.Y) {
+				t.Errorf("%s: cluster %s at %v, %v, want %v, %v", name, w.Cell, g.X, g.Y, w.X, w.Y)
+			}
+			g.X, g.Y = w.X, w.Y
+			if !reflect.DeepEqual(g, w) {
+				t.Errorf("%s: cluster = %+v, want %+v", name, g, w)
+			}
+		}
+	}
+	check("everything", index.Clusters(0, 0, 1, 0.5), want)
+
+	// only the entities inside the box count, the box may be given either way
+	// round
+	westOnly := want[0]
+	westOnly.X, westOnly.Y, westOnly.Count = (0.2+0.4)/2/2, (0.2+0.6)/2/2, 2
+	westOnly.Counts = []EntityCount{{EntityType: "Ship", TribeID: "10", Count: 2}}
+	check("box", index.Clusters(0.24, 0.34, 0, 0), []EntityCluster{westOnly})
+
+	check("empty", index.Clusters(0.6, 0.4, 0.7, 0.5), nil)
+}
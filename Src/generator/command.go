@@ -0,0 +1,419 @@
+package generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+// Command targets. Global commands run on every server, server commands on
+// one ("Server::ID::cmd") and location commands at a point relative to one
+// server cell ("Map::ID::X,Y::cmd" or "ID::X,Y::cmd").
+const (
+	TargetGlobal   = "global"
+	TargetServer   = "server"
+	TargetLocation = "location"
+)
+
+// Command parameter types. A text parameter takes the rest of the line and
+// must come last.
+const (
+	ParamWord  = "word"
+	ParamInt   = "int"
+	ParamFloat = "float"
+	ParamText  = "text"
+)
+
+// CommandParam describes one parameter of a command.
+type CommandParam struct {
+	Name     string `json:"Name"`
+	Type     string `json:"Type"`
+	Optional bool   `json:"Optional,omitempty"`
+}
+
+// CommandSpec describes a known command: its parameters and the targets it
+// may be sent to.
+type CommandSpec struct {
+	Name        string         `json:"Name"`
+	Description string         `json:"Description"`
+	Targets     []string       `json:"Targets"`
+	Params      []CommandParam `json:"Params"`
+}
+
+// CommandTarget is where a command runs. X and Y are relative to the server
+// cell, 0 to 1.
+type CommandTarget struct {
+	Kind     string  `json:"Kind"`
+	ServerID uint32  `json:"ServerId,omitempty"`
+	X        float64 `json:"X,omitempty"`
+	Y        float64 `json:"Y,omitempty"`
+}
+
+// Command is a parsed and validated command.
+type Command struct {
+	Name   string        `json:"Name"`
+	Target CommandTarget `json:"Target"`
+	Args   []string      `json:"Args"`
+	Spec   *CommandSpec  `json:"-"` // nil for commands missing from the registry
+}
+
+// String returns the command as sent to the game servers.
+func (c *Command) String() string {
+	line := strings.Join(append([]string{c.Name}, c.Args...), " ")
+	switch c.Target.Kind {
+	case TargetServer:
+		return "Server::" + strconv.FormatUint(uint64(c.Target.ServerID), 10) + "::" + line
+	case TargetLocation:
+		return "Map::" + strconv.FormatUint(uint64(c.Target.ServerID), 10) + "::" +
+			strconv.FormatFloat(c.Target.X, 'f', -1, 64) + "," +
+			strconv.FormatFloat(c.Target.Y, 'f', -1, 64) + "::" + line
+	}
+	return line
+}
+
+// CommandRequest is the JSON body of POST /commands/{name}. The server is
+// given by packed ID or cell name, e.g. "D5"; X and Y make it a location.
+// Args are by parameter name.
+type CommandRequest struct {
+	ServerID *uint32           `json:"ServerId"`
+	Cell     string            `json:"Cell"`
+	X        *float64          `json:"X"`
+	Y        *float64          `json:"Y"`
+	Args     map[string]string `json:"Args"`
+}
+
+// DefaultCommands returns the built-in command specs.
+func DefaultCommands() []CommandSpec {
+	everywhere := []string{TargetGlobal, TargetServer, TargetLocation}
+	return []CommandSpec{
+		{
+			Name:        "spawnshipfast",
+			Description: "Spawns a ship at the location",
+			Targets:     []string{TargetLocation},
+			Params:      []CommandParam{{Name: "name", Type: ParamText}},
+		},
+		{
+			Name:        "spawnbed",
+			Description: "Spawns a bed at the location",
+			Targets:     []string{TargetLocation},
+			Params:      []CommandParam{{Name: "name", Type: ParamText}},
+		},
+		{
+			Name:        "SpawnWorldActor",
+			Description: "Spawns a blueprint at the location",
+			Targets:     []string{TargetLocation},
+			Params:      []CommandParam{{Name: "blueprint", Type: ParamWord}},
+		},
+		{
+			Name:        "destroyall",
+			Description: "Destroys every actor of a class",
+			Targets:     everywhere,
+			Params:      []CommandParam{{Name: "class", Type: ParamWord, Optional: true}},
+		},
+		{
+			Name:        "destroywilddinos",
+			Description: "Destroys all wild creatures",
+			Targets:     everywhere,
+			Params:      []CommandParam{},
+		},
+		{
+			Name:        "broadcast",
+			Description: "Shows a message to every player",
+			Targets:     []string{TargetGlobal, TargetServer},
+			Params:      []CommandParam{{Name: "message", Type: ParamText}},
+		},
+		{
+			Name:        "GenerateTribePNG",
+			Description: "Renders a tribe's flag into redis",
+			Targets:     []string{TargetServer},
+			Params:      []CommandParam{{Name: "tribe", Type: ParamInt}},
+		},
+		{
+			Name:        "ReloadTopTribes",
+			Description: "Reloads the top tribes from redis",
+			Targets:     []string{TargetGlobal},
+			Params:      []CommandParam{},
+		},
+	}
+}
+
+// CommandRegistry parses and validates commands against the known command
+// specs and the servers of the grid.
+type CommandRegistry struct {
+	specs   []CommandSpec
+	byName  map[string]*CommandSpec
+	servers map[uint32]bool
+}
+
+// NewCommandRegistry returns a registry of the given specs for the servers
+// in the grid config.
+func NewCommandRegistry(gridConfig *atlas.GridConfig, specs []CommandSpec) (*CommandRegistry, error) {
+	r := &CommandRegistry{
+		specs:   specs,
+		byName:  make(map[string]*CommandSpec),
+		servers: make(map[uint32]bool),
+	}
+	for i := range r.specs {
+		spec := &r.specs[i]
+		for j, param := range spec.Params {
+			switch param.Type {
+			case ParamWord, ParamInt, ParamFloat:
+			case ParamText:
+				if j != len(spec.Params)-1 {
+					return nil, fmt.Errorf("command %s: text parameter %s must be last", spec.Name, param.Name)
+				}
+			default:
+				return nil, fmt.Errorf("command %s: unknown parameter type %q", spec.Name, param.Type)
+			}
+		}
+		r.byName[strings.ToLower(spec.Name)] = spec
+	}
+	for _, server := range gridConfig.Servers {
+		r.servers[coords.Pack(uint16(server.GridX), uint16(server.GridY))] = true
+	}
+	return r, nil
+}
+
+// Specs returns the known commands.
+func (r *CommandRegistry) Specs() []CommandSpec {
+	return r.specs
+}
+
+// Lookup returns the spec of a command name, ignoring case.
+func (r *CommandRegistry) Lookup(name string) (*CommandSpec, bool) {
+	spec, found := r.byName[strings.ToLower(name)]
+	return spec, found
+}
+
+// Parse parses a command string with an optional target prefix. Commands
+// missing from the registry are returned with a nil Spec and unchecked
+// arguments.
+func (r *CommandRegistry) Parse(s string) (*Command, error) {
+	c := &Command{Target: CommandTarget{Kind: TargetGlobal}}
+	parts := strings.Split(strings.TrimSpace(s), "::")
+	if len(parts) > 1 && parts[0] == "Map" {
+		parts = parts[1:]
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("expected Map::ID::X,Y::command")
+		}
+	}
+	switch len(parts) {
+	case 1:
+	case 2:
+		return nil, fmt.Errorf("expected Server::ID::command or ID::X,Y::command")
+	case 3:
+		if parts[0] == "Server" {
+			c.Target.Kind = TargetServer
+			if err := r.parseServer(parts[1], &c.Target); err != nil {
+				return nil, err
+			}
+			break
+		}
+		c.Target.Kind = TargetLocation
+		if err := r.parseServer(parts[0], &c.Target); err != nil {
+			return nil, err
+		}
+		xy := strings.Split(parts[1], ",")
+		if len(xy) != 2 {
+			return nil, fmt.Errorf("invalid location %q", parts[1])
+		}
+		var err error
+		if c.Target.X, err = strconv.ParseFloat(strings.TrimSpace(xy[0]), 64); err != nil {
+			return nil, fmt.Errorf("invalid location %q", parts[1])
+		}
+		if c.Target.Y, err = strconv.ParseFloat(strings.TrimSpace(xy[1]), 64); err != nil {
+			return nil, fmt.Errorf("invalid location %q", parts[1])
+		}
+	default:
+		return nil, fmt.Errorf("too many :: separators")
+	}
+	line := strings.TrimSpace(parts[len(parts)-1])
+	if len(line) == 0 {
+		return nil, fmt.Errorf("missing command")
+	}
+
+	name := strings.Fields(line)[0]
+	c.Name = name
+	rest := strings.TrimSpace(line[len(name):])
+	spec, found := r.Lookup(name)
+	if !found {
+		c.Args = splitArgs(rest, -1)
+		return c, r.validateTarget(c)
+	}
+	c.Name = spec.Name
+	c.Spec = spec
+
+	n := len(spec.Params)
+	if n > 0 && spec.Params[n-1].Type == ParamText {
+		c.Args = splitArgs(rest, n)
+	} else {
+		c.Args = splitArgs(rest, -1)
+	}
+	return c, r.Validate(c)
+}
+
+// Build returns the command name with the arguments and target of a JSON
+// request.
+func (r *CommandRegistry) Build(name string, req *CommandRequest) (*Command, error) {
+	spec, found := r.Lookup(name)
+	if !found {
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+	c := &Command{Name: spec.Name, Spec: spec, Target: CommandTarget{Kind: TargetGlobal}}
+
+	if req.ServerID != nil || len(req.Cell) > 0 {
+		c.Target.Kind = TargetServer
+		if req.ServerID != nil {
+			c.Target.ServerID = *req.ServerID
+		} else {
+			x, y, err := coords.ParseCellName(strings.ToUpper(req.Cell))
+			if err != nil {
+				return nil, err
+			}
+			c.Target.ServerID = coords.Pack(uint16(x), uint16(y))
+		}
+		if req.X != nil || req.Y != nil {
+			if req.X == nil || req.Y == nil {
+				return nil, fmt.Errorf("a location needs both X and Y")
+			}
+			c.Target.Kind = TargetLocation
+			c.Target.X, c.Target.Y = *req.X, *req.Y
+		}
+	} else if req.X != nil || req.Y != nil {
+		return nil, fmt.Errorf("a location needs a server")
+	}
+
+	for _, param := range spec.Params {
+		value := strings.TrimSpace(req.Args[param.Name])
+		if len(value) == 0 {
+			if !param.Optional {
+				return nil, fmt.Errorf("missing %s", param.Name)
+			}
+			break
+		}
+		c.Args = append(c.Args, value)
+	}
+	for arg := range req.Args {
+		if !spec.hasParam(arg) {
+			return nil, fmt.Errorf("unknown parameter %q", arg)
+		}
+	}
+	return c, r.Validate(c)
+}
+
+// Validate checks a command's target and, for known commands, its
+// arguments.
+func (r *CommandRegistry) Validate(c *Command) error {
+	if err := r.validateTarget(c); err != nil {
+		return err
+	}
+	spec := c.Spec
+	if spec == nil {
+		return nil
+	}
+
+	allowed := false
+	for _, kind := range spec.Targets {
+		allowed = allowed || kind == c.Target.Kind
+	}
+	if !allowed {
+		return fmt.Errorf("%s can not be sent to a %s target", spec.Name, c.Target.Kind)
+	}
+
+	if len(c.Args) > len(spec.Params) {
+		return fmt.Errorf("%s takes at most %d arguments", spec.Name, len(spec.Params))
+	}
+	for i, param := range spec.Params {
+		if i >= len(c.Args) {
+			if !param.Optional {
+				return fmt.Errorf("%s: missing %s", spec.Name, param.Name)
+			}
+			continue
+		}
+		arg := c.Args[i]
+		switch param.Type {
+		case ParamWord:
+			if strings.ContainsAny(arg, " \t") && !isQuoted(arg) {
+				return fmt.Errorf("%s: %s must be one word", spec.Name, param.Name)
+			}
+		case ParamInt:
+			if _, err := strconv.ParseInt(arg, 10, 64); err != nil {
+				return fmt.Errorf("%s: %s must be an integer", spec.Name, param.Name)
+			}
+		case ParamFloat:
+			if _, err := strconv.ParseFloat(arg, 64); err != nil {
+				return fmt.Errorf("%s: %s must be a number", spec.Name, param.Name)
+			}
+		}
+		if strings.Contains(arg, "::") || strings.ContainsAny(arg, "\r\n") {
+			return fmt.Errorf("%s: invalid %s", spec.Name, param.Name)
+		}
+	}
+	return nil
+}
+
+func (r *CommandRegistry) validateTarget(c *Command) error {
+	if c.Target.Kind == TargetGlobal {
+		return nil
+	}
+	if !r.servers[c.Target.ServerID] {
+		x, y := coords.Unpack(c.Target.ServerID)
+		return fmt.Errorf("unknown server %d (%s)", c.Target.ServerID, coords.CellName(int(x), int(y)))
+	}
+	if c.Target.Kind == TargetLocation {
+		if c.Target.X < 0 || c.Target.X > 1 || c.Target.Y < 0 || c.Target.Y > 1 {
+			return fmt.Errorf("location %g,%g is outside the server", c.Target.X, c.Target.Y)
+		}
+	}
+	return nil
+}
+
+func (r *CommandRegistry) parseServer(s string, target *CommandTarget) error {
+	id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid server ID %q", s)
+	}
+	target.ServerID = uint32(id)
+	return nil
+}
+
+func (s *CommandSpec) hasParam(name string) bool {
+	for _, param := range s.Params {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArgs splits command arguments on white space outside double quotes,
+// keeping the quotes. With n > 0 at most n arguments are returned, the last
+// holding the rest of the line.
+func splitArgs(s string, n int) []string {
+	args := make([]string, 0)
+	s = strings.TrimSpace(s)
+	for len(s) > 0 {
+		if n == 1 {
+			return append(args, s)
+		}
+		end, quoted := 0, false
+		for ; end < len(s); end++ {
+			if s[end] == '"' {
+				quoted = !quoted
+			} else if !quoted && (s[end] == ' ' || s[end] == '\t') {
+				break
+			}
+		}
+		args = append(args, s[:end])
+		s = strings.TrimSpace(s[end:])
+		n--
+	}
+	return args
+}
+
+func isQuoted(s string) bool {
+	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"'
+}
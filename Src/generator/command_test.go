@@ -0,0 +1,198 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+// newTestRegistry returns the built-in commands on a 2 by 2 grid.
+func newTestRegistry(t *testing.T) *CommandRegistry {
+	gridConfig := &atlas.GridConfig{TotalGridsX: 2, TotalGridsY: 2}
+	for x := 0; x < 2; x++ {
+		for y := 0; y < 2; y++ {
+			gridConfig.Servers = append(gridConfig.Servers, atlas.ServerGridConfig{GridX: x, GridY: y})
+		}
+	}
+	r, err := NewCommandRegistry(gridConfig, DefaultCommands())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCommandRegistryParse(t *testing.T) {
+	r := newTestRegistry(t)
+	b1, a2, b2 := coords.Pack(1, 0), coords.Pack(0, 1), coords.Pack(1, 1)
+	for _, c := range []struct {
+		command string
+		name    string
+		target  CommandTarget
+		args    []string
+		known   bool
+	}{
+		{"destroywilddinos", "destroywilddinos", CommandTarget{Kind: TargetGlobal}, []string{}, true},
+		{"Server::65536::destroywilddinos", "destroywilddinos", CommandTarget{Kind: TargetServer, ServerID: b1}, []string{}, true},
+		{" Server:: 1 ::DESTROYALL  Ship ", "destroyall", CommandTarget{Kind: TargetServer, ServerID: a2}, []string{"Ship"}, true},
+		{"Map::1::0.25,0.75::spawnshipfast My Ship", "spawnshipfast", CommandTarget{Kind: TargetLocation, ServerID: a2, X: 0.25, Y: 0.75}, []string{"My Ship"}, true},
+		{"65537::0, 1::spawnbed Bed", "spawnbed", CommandTarget{Kind: TargetLocation, ServerID: b2, X: 0, Y: 1}, []string{"Bed"}, true},
+		// a quoted word keeps its quotes and spaces
+		{`65537::0.5,0.5::SpawnWorldActor "Blueprint'/Game/A B'"`, "SpawnWorldActor", CommandTarget{Kind: TargetLocation, ServerID: b2, X: 0.5, Y: 0.5}, []string{`"Blueprint'/Game/A B'"`}, true},
+		// a trailing text parameter takes the rest of the line as it is
+		{`broadcast  hello   "there" world `, "broadcast", CommandTarget{Kind: TargetGlobal}, []string{`hello   "there" world`}, true},
+		{"Server::0::GenerateTribePNG 12345", "GenerateTribePNG", CommandTarget{Kind: TargetServer, ServerID: 0}, []string{"12345"}, true},
+		// commands missing from the registry only have their target checked
+		{`Server::1::cheat give "a b" c`, "cheat", CommandTarget{Kind: TargetServer, ServerID: a2}, []string{"give", `"a b"`, "c"}, false},
+	} {
+		command, err := r.Parse(c.command)
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", c.command, err)
+			continue
+		}
+		if command.Name != c.name || command.Target != c.target || !reflect.DeepEqual(command.Args, c.args) || (command.Spec != nil) != c.known {
+			t.Errorf("Parse(%q) = %+v, want %s %+v %q", c.command, command, c.name, c.target, c.args)
+		}
+
+		// the string sent to the game parses back to the same command
+		again, err := r.Parse(command.String())
+		if err != nil || !reflect.DeepEqual(again, command) {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", command.String(), again, err, command)
+		}
+	}
+}
+
+func TestCommandRegistryParseErrors(t *testing.T) {
+	r := newTestRegistry(t)
+	for _, command := range []string{
+		"",
+		"   ",
+		"Server::1::",
+		// unknown servers, for known and unknown commands
+		"Server::2::destroywilddinos",
+		"Server::131072::cheat",
+		"Map::2::0.5,0.5::spawnbed Bed",
+		"Server::x::destroywilddinos",
+		"Server::-1::destroywilddinos",
+		// the location has to be inside the server
+		"1::1.5,0.5::spawnbed Bed",
+		"1::0.5,-0.1::spawnbed Bed",
+		"1::0.5::spawnbed Bed",
+		"1::a,b::spawnbed Bed",
+		"1::0.5,0.5,0.5::spawnbed Bed",
+		// malformed targets
+		"Server::1",
+		"Map::1::destroyall",
+		"Map::1::0.5,0.5",
+		// targets the command can not be sent to
+		"spawnbed Bed",
+		"Server::1::spawnbed Bed",
+		"1::0.5,0.5::ReloadTopTribes",
+		// arguments
+		"broadcast",
+		"spawnshipfast",
+		"SpawnWorldActor",
+		"1::0.5,0.5::SpawnWorldActor a b",
+		"Server::1::GenerateTribePNG tribe",
+		"destroywilddinos now",
+		// an injected :: or line break can not smuggle in another command
+		"broadcast hi::Server::1::destroyall",
+		"Server::1::broadcast a::b",
+		"broadcast hi\ndestroyall",
+		`1::0.5,0.5::SpawnWorldActor "a::b"`,
+	} {
+		if c, err := r.Parse(command); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", command, c)
+		}
+	}
+}
+
+func TestCommandRegistryBuild(t *testing.T) {
+	r := newTestRegistry(t)
+	id := func(v uint32) *uint32 { return &v }
+	f := func(v float64) *float64 { return &v }
+	for _, c := range []struct {
+		name    string
+		req     CommandRequest
+		command string
+	}{
+		{"destroywilddinos", CommandRequest{}, "destroywilddinos"},
+		{"DestroyAll", CommandRequest{Cell: "B1", Args: map[string]string{"class": "Ship"}}, "Server::65536::destroyall Ship"},
+		{"destroyall", CommandRequest{ServerID: id(1)}, "Server::1::destroyall"},
+		{"spawnbed", CommandRequest{Cell: "b2", X: f(0.25), Y: f(0.5), Args: map[string]string{"name": " My Bed "}}, "Map::65537::0.25,0.5::spawnbed My Bed"},
+		{"broadcast", CommandRequest{Args: map[string]string{"message": "hello  world"}}, "broadcast hello  world"},
+	} {
+		command, err := r.Build(c.name, &c.req)
+		if err != nil {
+			t.Errorf("Build(%s, %+v) = %v", c.name, c.req, err)
+			continue
+		}
+		if got := command.String(); got != c.command {
+			t.Errorf("Build(%s, %+v) = %q, want %q", c.name, c.req, got, c.command)
+		}
+		if parsed, err := r.Parse(command.String()); err != nil || !reflect.DeepEqual(parsed.Target, command.Target) || parsed.Spec != command.Spec {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", command.String(), parsed, err, command)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		req  CommandRequest
+	}{
+		{"cheat", CommandRequest{}},
+		{"broadcast", CommandRequest{}},
+		{"broadcast", CommandRequest{Args: map[string]string{"message": "hi", "extra": "x"}}},
+		{"broadcast", CommandRequest{Args: map[string]string{"message": "a::b"}}},
+		{"broadcast", CommandRequest{Args: map[string]string{"message": "a\nb"}}},
+		{"destroyall", CommandRequest{Cell: "C1"}},
+		{"destroyall", CommandRequest{Cell: "1A"}},
+		{"destroyall", CommandRequest{ServerID: id(2)}},
+		{"spawnbed", CommandRequest{Cell: "A1", X: f(0.5), Args: map[string]string{"name": "Bed"}}},
+		{"spawnbed", CommandRequest{X: f(0.5), Y: f(0.5), Args: map[string]string{"name": "Bed"}}},
+		{"spawnbed", CommandRequest{Cell: "A1", X: f(0.5), Y: f(1.01), Args: map[string]string{"name": "Bed"}}},
+		{"spawnbed", CommandRequest{Cell: "A1", Args: map[string]string{"name": "Bed"}}},
+		{"SpawnWorldActor", CommandRequest{Cell: "A1", X: f(0.5), Y: f(0.5), Args: map[string]string{"blueprint": "a b"}}},
+		{"GenerateTribePNG", CommandRequest{Cell: "A1", Args: map[string]string{"tribe": "1.5"}}},
+	} {
+		if command, err := r.Build(c.name, &c.req); err == nil {
+			t.Errorf("Build(%s, %+v) = %q, want an error", c.name, c.req, command.String())
+		}
+	}
+}
+
+func TestNewCommandRegistryParams(t *testing.T) {
+	gridConfig := &atlas.GridConfig{}
+	for _, params := range [][]CommandParam{
+		{{Name: "a", Type: ParamText}, {Name: "b", Type: ParamWord}},
+		{{Name: "a", Type: "bool"}},
+	} {
+		specs := []CommandSpec{{Name: "test", Targets: []string{TargetGlobal}, Params: params}}
+		if _, err := NewCommandRegistry(gridConfig, specs); err == nil {
+			t.Errorf("NewCommandRegistry() accepted %+v", params)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want []string
+	}{
+		{"", -1, []string{}},
+		{"  ", 2, []string{}},
+		{"a b\tc", -1, []string{"a", "b", "c"}},
+		{` a  "b c"  d `, -1, []string{"a", `"b c"`, "d"}},
+		{`x"y z"w v`, -1, []string{`x"y z"w`, "v"}},
+		{`"a b`, -1, []string{`"a b`}},
+		{"a b  c", 2, []string{"a", "b  c"}},
+		{`"a b" c d`, 2, []string{`"a b"`, "c d"}},
+		{"a b c", 1, []string{"a b c"}},
+		{"a", 3, []string{"a"}},
+	} {
+		if got := splitArgs(c.s, c.n); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitArgs(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
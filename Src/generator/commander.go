@@ -0,0 +1,159 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrCommandDenied is returned for commands the user's role may not send.
+var ErrCommandDenied = errors.New("command not allowed")
+
+// ErrNotConfirmed is returned for dangerous commands that were not confirmed.
+var ErrNotConfirmed = errors.New("command needs confirming")
+
+// pendingConfirm is a dangerous command waiting for its user to confirm it.
+type pendingConfirm struct {
+	user    string
+	encoded string
+	expires time.Time
+}
+
+// Commander publishes commands to the game servers on the
+// GeneralNotifications:GlobalCommands redis PubSub channel, checking them
+// against the user's role and the rate limits and recording every attempt in
+// the audit log. It also hands out the tokens confirming dangerous commands.
+type Commander struct {
+	client         *redis.Client
+	auth           *Auth
+	audit          *AuditLog
+	limiter        *RateLimiter
+	dangerous      map[string]bool
+	confirmTimeout time.Duration
+	lock           sync.Mutex
+	confirms       map[string]pendingConfirm
+}
+
+// NewCommander returns a commander publishing through client. A nil audit
+// log records nothing and a nil limiter allows any rate. The dangerous verbs
+// have to be confirmed within confirmTimeout.
+func NewCommander(client *redis.Client, auth *Auth, audit *AuditLog, limiter *RateLimiter, dangerous []string, confirmTimeout time.Duration) *Commander {
+	c := &Commander{
+		client:         client,
+		auth:           auth,
+		audit:          audit,
+		limiter:        limiter,
+		dangerous:      make(map[string]bool),
+		confirmTimeout: confirmTimeout,
+		confirms:       make(map[string]pendingConfirm),
+	}
+	for _, verb := range dangerous {
+		c.dangerous[strings.ToLower(verb)] = true
+	}
+	return c
+}
+
+// Allowed reports whether the user's role may send the command.
+func (c *Commander) Allowed(user *Session, command *Command) bool {
+	return c.auth.Allowed(user.Role, command.Name)
+}
+
+// Dangerous reports whether a command verb has to be confirmed.
+func (c *Commander) Dangerous(name string) bool {
+	return c.dangerous[strings.ToLower(name)]
+}
+
+// Confirmation returns a single use token with which the user can confirm
+// the encoded command until it expires.
+func (c *Commander) Confirmation(user *Session, encoded string) (string, time.Time, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(c.confirmTimeout)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for t, pending := range c.confirms {
+		if now.After(pending.expires) {
+			delete(c.confirms, t)
+		}
+	}
+	c.confirms[token] = pendingConfirm{user: user.Name, encoded: encoded, expires: expires}
+	return token, expires, nil
+}
+
+// Confirm uses up a token and reports whether it was handed to the user for
+// exactly the encoded command and has not expired.
+func (c *Commander) Confirm(user *Session, encoded string, token string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending, found := c.confirms[token]
+	if !found {
+		return false
+	}
+	delete(c.confirms, token)
+	return pending.user == user.Name && pending.encoded == encoded && time.Now().Before(pending.expires)
+}
+
+// Publish sends the encoded command for a user whose role allows it and who
+// is within the rate limits, and returns the number of game servers that
+// received it. Remote is where the request came from, for the audit log.
+// Nothing is published when the attempt can not be recorded. Dangerous
+// commands are refused unless confirmed, see Confirm.
+func (c *Commander) Publish(user *Session, remote string, command *Command, encoded string, confirmed bool) (int64, error) {
+	entry := AuditEntry{
+		User:       user.Name,
+		Role:       user.Role,
+		RemoteAddr: remote,
+		Command:    command.Name,
+		Target:     command.Target,
+		Payload:    encoded,
+	}
+	if !c.auth.Allowed(user.Role, command.Name) {
+		log.Println("denied:", user.Name, encoded)
+		entry.Status = AuditDenied
+		c.audit.Record(entry)
+		return 0, ErrCommandDenied
+	}
+	if c.Dangerous(command.Name) && !confirmed {
+		log.Println("unconfirmed:", user.Name, encoded)
+		entry.Status = AuditDenied
+		entry.Error = ErrNotConfirmed.Error()
+		c.audit.Record(entry)
+		return 0, ErrNotConfirmed
+	}
+	if ok, wait := c.limiter.Allow(user.Name); !ok {
+		log.Println("throttled:", user.Name, encoded)
+		entry.Status = AuditThrottled
+		c.audit.Record(entry)
+		return 0, &RateLimitError{Wait: wait}
+	}
+
+	// the attempt is on disk before the game sees the command, so nothing is
+	// published that the audit log could miss
+	entry.Status = AuditAttempt
+	if err := c.audit.Record(entry); err != nil {
+		return 0, fmt.Errorf("audit log: %v", err)
+	}
+
+	log.Println("publish:", user.Name, encoded)
+	result, err := c.client.Publish("GeneralNotifications:GlobalCommands", encoded).Result()
+	if err != nil {
+		log.Println("redis error for: ", encoded, "; ", err)
+		entry.Status = AuditFailed
+		entry.Error = err.Error()
+		c.audit.Record(entry)
+		return 0, err
+	}
+	entry.Status = AuditPublished
+	entry.Subscribers = result
+	c.audit.Record(entry)
+	return result, nil
+}
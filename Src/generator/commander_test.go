@@ -0,0 +1,186 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// newTestCommander returns a commander for newTestAuth's users, publishing
+// to a redis server that is not there.
+func newTestCommander(t *testing.T, audit *AuditLog, limiter *RateLimiter) *Commander {
+	client := redis.NewClient(&redis.Options{Network: "unix", Addr: filepath.Join(os.TempDir(), "no-such-redis.sock")})
+	return NewCommander(client, newTestAuth(t), audit, limiter, []string{"DestroyAll"}, time.Minute)
+}
+
+func TestCommanderPublishAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commander")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commander := newTestCommander(t, audit, nil)
+	r := newTestRegistry(t)
+	bob, _ := commander.auth.User("bob")
+	command, err := r.Parse("broadcast hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// denied commands never get as far as an attempt
+	if _, err := commander.Publish(bob, "10.0.0.1", command, command.String(), false); err != ErrCommandDenied {
+		t.Errorf("Publish() = %v, want %v", err, ErrCommandDenied)
+	}
+	alice, _ := commander.auth.User("alice")
+	if _, err := commander.Publish(alice, "10.0.0.1", command, command.String(), false); err == nil {
+		t.Errorf("Publish() without redis succeeded")
+	}
+	entries, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]string, 0)
+	for _, entry := range entries {
+		statuses = append(statuses, entry.Status)
+	}
+	if got, want := strings.Join(statuses, " "), "denied attempt failed"; got != want {
+		t.Errorf("audit statuses = %s, want %s", got, want)
+	}
+	if attempt := entries[1]; attempt.User != "alice" || attempt.RemoteAddr != "10.0.0.1" || attempt.Payload != "broadcast hello" {
+		t.Errorf("attempt = %+v", attempt)
+	}
+
+	// without a working audit log nothing is published
+	audit.file.Close()
+	if _, err := commander.Publish(alice, "10.0.0.1", command, command.String(), false); err == nil || !strings.HasPrefix(err.Error(), "audit log:") {
+		t.Errorf("Publish() with a broken audit log = %v, want an audit log error", err)
+	}
+}
+
+func TestCommanderConfirm(t *testing.T) {
+	commander := newTestCommander(t, nil, nil)
+	alice, _ := commander.auth.User("alice")
+	bob, _ := commander.auth.User("bob")
+	const encoded = "Server::1::destroyall Ship"
+
+	before := time.Now()
+	token, expires, err := commander.Confirmation(alice, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Before(before.Add(time.Minute)) || expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Confirmation() expires %v, want a minute from now", expires)
+	}
+	if !commander.Confirm(alice, encoded, token) {
+		t.Errorf("Confirm() refused its token")
+	}
+	if commander.Confirm(alice, encoded, token) {
+		t.Errorf("Confirm() accepted a token twice")
+	}
+
+	// a token is bound to its user and payload, and used up by any attempt
+	for _, c := range []struct {
+		name    string
+		user    *Session
+		encoded string
+	}{
+		{"other user", bob, encoded},
+		{"other payload", alice, "Server::1::destroyall"},
+		{"other server", alice, "Server::65536::destroyall Ship"},
+	} {
+		token, _, err := commander.Confirmation(alice, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commander.Confirm(c.user, c.encoded, token) {
+			t.Errorf("%s: Confirm() accepted", c.name)
+		}
+		if commander.Confirm(alice, encoded, token) {
+			t.Errorf("%s: Confirm() accepted a token after a failed attempt", c.name)
+		}
+	}
+	if commander.Confirm(alice, encoded, "") || commander.Confirm(alice, encoded, "unknown") {
+		t.Errorf("Confirm() accepted an unknown token")
+	}
+
+	// tokens expire, and expired ones are dropped when the next is handed out
+	token, _, err = commander.Confirmation(alice, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := commander.confirms[token]
+	pending.expires = time.Now().Add(-time.Second)
+	commander.confirms[token] = pending
+	if commander.Confirm(alice, encoded, token) {
+		t.Errorf("Confirm() accepted an expired token")
+	}
+	stale, _, _ := commander.Confirmation(alice, encoded)
+	pending = commander.confirms[stale]
+	pending.expires = time.Now().Add(-time.Second)
+	commander.confirms[stale] = pending
+	if _, _, err := commander.Confirmation(alice, encoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := commander.confirms[stale]; found {
+		t.Errorf("expired token kept")
+	}
+}
+
+func TestCommanderPublishDangerous(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commander")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commander := newTestCommander(t, audit, nil)
+	r := newTestRegistry(t)
+	alice, _ := commander.auth.User("alice")
+
+	for _, name := range []string{"destroyall", "DESTROYALL", "DestroyAll"} {
+		if !commander.Dangerous(name) {
+			t.Errorf("Dangerous(%s) = false", name)
+		}
+	}
+	if commander.Dangerous("broadcast") {
+		t.Errorf("Dangerous(broadcast) = true")
+	}
+
+	command, err := r.Parse("Server::1::DESTROYALL Ship")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commander.Publish(alice, "10.0.0.1", command, command.String(), false); err != ErrNotConfirmed {
+		t.Errorf("unconfirmed Publish() = %v, want %v", err, ErrNotConfirmed)
+	}
+	// confirmed it gets as far as redis, which is not there
+	if _, err := commander.Publish(alice, "10.0.0.1", command, command.String(), true); err == nil || err == ErrNotConfirmed {
+		t.Errorf("confirmed Publish() = %v, want a redis error", err)
+	}
+	entries, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]string, 0)
+	for _, entry := range entries {
+		statuses = append(statuses, entry.Status)
+	}
+	if got, want := strings.Join(statuses, " "), "denied attempt failed"; got != want {
+		t.Errorf("audit statuses = %s, want %s", got, want)
+	}
+	if entries[0].Error != ErrNotConfirmed.Error() {
+		t.Errorf("unconfirmed entry error = %q", entries[0].Error)
+	}
+}
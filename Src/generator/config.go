@@ -2,9 +2,14 @@ package generator
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 )
 
+// MaxLeaderboardSize caps the number of top tribes, for LeaderboardSize and
+// /leaderboard.
+const MaxLeaderboardSize = 100
+
 // Config holds generator configuration
 type Config struct {
 	Host               string
@@ -15,6 +20,48 @@ type Config struct {
 	DisableTerritory   bool   // Disable territory generation
 	EntityFetchRateInSeconds int    // Polling rate for colonies
 	ColonyFetchRateInSeconds int // Polling rate for ships and beds
+	StreamHistorySize        int // Number of changes kept for resuming /stream clients
+	ArchiveDir               string // Directory for the island and entity history, blank disables
+	ArchiveEntityRateInSeconds int  // Minimum time between archived entity snapshots, negative disables
+	ArchiveEntityMaxBytes    int64 // The entity archive is rotated when it would grow past this, zero or negative never rotates
+	ArchiveEntityKeep        int // Number of rotated entity archive files kept
+	ArchiveIslandMaxBytes    int64 // The island archive is rotated when it would grow past this, zero or negative never rotates
+	ArchiveIslandKeep        int // Number of rotated island archive files kept, older island history is lost
+	EventLogSize             int // Number of colony events kept for /events
+	TrackLength              int // Positions kept per entity track, zero or negative disables
+	TrackMaxAgeInSeconds     int // Positions older than this are pruned from tracks, zero or negative keeps them
+	NPCShipSpeed             float64 // World units per second used to estimate NPC ships on ship paths
+	ClusterZoom              int // /getdata?zoom= below this returns per server clusters
+	RankingStrategy          string // Strategy picking the top tribes, and default of /leaderboard
+	LeaderboardSize          int // Number of top tribes, and default of /leaderboard, at most MaxLeaderboardSize
+	WarWinWindowInSeconds    int // Wars that ended longer ago do not count for the warwins strategy, counted from the in-memory event log so a restart starts over
+	TribeColorsFile          string // File keeping the tribe colors across restarts, blank keeps them in memory
+	TribeColorDistance       float64 // Tribes with islands closer than this in world units get different colors
+	EnableTribes             bool // Update tribes.json and fetch the flags of the top tribes after each colony update
+	TribeWriteBack           bool // Ask game servers for tribe flags and push the top tribes back to redis
+	TribeFlagWaitInSeconds   int // Longest wait for requested tribe flags
+	ClusterPrefix            string // URL prefix of tribes.json, served at <ClusterPrefix>tribes/tribes.json
+	FlagDir                  string // Directory for the tribe flags served at /flags, blank keeps them in memory
+	FlagSize                 int // Tribe flags are resized to this many pixels square, zero keeps their size
+	FlagCacheSize            int // Number of tribe flags kept in memory or in FlagDir, zero or negative keeps all
+	Accounts                 []Account // Users allowed to log in to send commands
+	APIKeys                  []APIKey // Keys allowed to send commands
+	RoleCommands             map[string][]string // Command verbs each role may send, "*" for all
+	SessionTimeoutInSeconds  int // Logged in users have to log in again after this
+	LoginFailuresPerMinute   float64 // Failed logins each address may make per minute after a burst, zero or negative disables
+	LoginFailureBurst        int // Failed logins each address may make at once
+	Commands                 []CommandSpec // Commands known in addition to the built-in ones
+	AuditLog                 string // File recording every command sent, blank disables. Not opened with DisableCommands
+	AuditMaxBytes            int64 // The audit log is rotated when it would grow past this, zero or negative never rotates
+	AuditKeep                int // Number of rotated audit log files kept, zero or negative never rotates
+	AuditRoles               []string // Roles allowed to read /audit
+	ScheduleFile             string // File keeping the scheduled commands across restarts, blank keeps them in memory
+	CommandRatePerMinute     float64 // Commands each user may send per minute after a burst, zero or negative disables
+	CommandBurst             int // Commands each user may send at once
+	GlobalCommandRatePerMinute float64 // Commands everyone together may send per minute after a burst, zero or negative disables
+	GlobalCommandBurst       int // Commands everyone together may send at once
+	DangerousCommands        []string // Command verbs that have to be confirmed with a second request
+	ConfirmTimeoutInSeconds  int // Dangerous commands have to be confirmed within this
 }
 
 // LoadConfig loads and returns generator config from specified file
@@ -29,16 +76,65 @@ func LoadConfig(path string) (*Config, error) {
 	cfg := Config{
 		Host:               "",
 		Port:               8880,
-		TerritoryURL:       "http://localhost:8881/territoryTiles/",
+		TerritoryURL:       "territoryTiles/",
 		DisableCommands:    true,
 		StaticDir:          "./www",
 		ColonyFetchRateInSeconds: 1800,
 		EntityFetchRateInSeconds: 300,
+		StreamHistorySize:        4096,
+		ArchiveDir:               "",
+		ArchiveEntityRateInSeconds: 3600,
+		ArchiveEntityMaxBytes:    256 << 20,
+		ArchiveEntityKeep:        4,
+		ArchiveIslandMaxBytes:    64 << 20,
+		ArchiveIslandKeep:        4,
+		EventLogSize:             10000,
+		TrackLength:              500,
+		TrackMaxAgeInSeconds:     86400,
+		NPCShipSpeed:             1000,
+		ClusterZoom:              4,
+		RankingStrategy:          "points",
+		LeaderboardSize:          5,
+		WarWinWindowInSeconds:    604800,
+		TribeColorsFile:          "",
+		TribeColorDistance:       200000,
+		EnableTribes:             false,
+		TribeWriteBack:           false,
+		TribeFlagWaitInSeconds:   15,
+		ClusterPrefix:            "",
+		FlagDir:                  "",
+		FlagSize:                 128,
+		FlagCacheSize:            1024,
+		RoleCommands: map[string][]string{
+			RoleViewer:    []string{},
+			RoleModerator: []string{"spawnshipfast", "spawnbed"},
+			RoleAdmin:     []string{"*"},
+		},
+		SessionTimeoutInSeconds:  43200,
+		LoginFailuresPerMinute:   5,
+		LoginFailureBurst:        10,
+		AuditLog:                 "audit.jsonl",
+		AuditMaxBytes:            10 << 20,
+		AuditKeep:                5,
+		AuditRoles:               []string{RoleAdmin},
+		ScheduleFile:             "schedule.json",
+		CommandRatePerMinute:     30,
+		CommandBurst:             10,
+		GlobalCommandRatePerMinute: 120,
+		GlobalCommandBurst:       30,
+		DangerousCommands:        []string{"destroyall", "destroywilddinos"},
+		ConfirmTimeoutInSeconds:  120,
 	}
 
 	if err = decoder.Decode(&cfg); err != nil {
 		return nil, err
 	}
+	if cfg.LeaderboardSize <= 0 {
+		return nil, fmt.Errorf("LeaderboardSize must be positive, got %d", cfg.LeaderboardSize)
+	}
+	if cfg.LeaderboardSize > MaxLeaderboardSize {
+		cfg.LeaderboardSize = MaxLeaderboardSize
+	}
 
 	return &cfg, nil
 }
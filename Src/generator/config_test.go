@@ -0,0 +1,42 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigLeaderboardSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	for _, c := range []struct {
+		json string
+		want int
+		ok   bool
+	}{
+		{`{}`, 5, true},
+		{`{"LeaderboardSize": 20}`, 20, true},
+		{`{"LeaderboardSize": 100}`, MaxLeaderboardSize, true},
+		{`{"LeaderboardSize": 100000}`, MaxLeaderboardSize, true},
+		{`{"LeaderboardSize": 0}`, 0, false},
+		{`{"LeaderboardSize": -1}`, 0, false},
+	} {
+		if err := ioutil.WriteFile(path, []byte(c.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(path)
+		if (err == nil) != c.ok {
+			t.Errorf("LoadConfig(%s) error = %v, want ok %v", c.json, err, c.ok)
+			continue
+		}
+		if err == nil && config.LeaderboardSize != c.want {
+			t.Errorf("LoadConfig(%s) LeaderboardSize = %d, want %d", c.json, config.LeaderboardSize, c.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package generator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@every",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+	} {
+		if c, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) = %+v, want an error", expr, c)
+		}
+	}
+}
+
+func TestParseCronFields(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		var b uint64
+		for _, v := range values {
+			b |= 1 << uint(v)
+		}
+		return b
+	}
+	for _, c := range []struct {
+		expr                     string
+		minute, hour, dom, month uint64
+		dow                      uint64
+		anyDom, anyDow           bool
+	}{
+		{"5 4 3 2 1", bits(5), bits(4), bits(3), bits(2), bits(1), false, false},
+		{"0,30 9-11 1-3,31 */4 ?", bits(0, 30), bits(9, 10, 11), bits(1, 2, 3, 31), bits(1, 5, 9), bits(0, 1, 2, 3, 4, 5, 6, 7), false, true},
+		{"10-20/5 5/6 * 12 7", bits(10, 15, 20), bits(5, 11, 17, 23), 0xfffffffe, bits(12), bits(0, 7), true, false},
+		{"@weekly", bits(0), bits(0), 0xfffffffe, 0x1ffe, bits(0), true, false},
+		{" @hourly ", bits(0), 0xffffff, 0xfffffffe, 0x1ffe, 0xff, true, true},
+	} {
+		got, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) = %v", c.expr, err)
+			continue
+		}
+		want := Cron{c.minute, c.hour, c.dom, c.month, c.dow, c.anyDom, c.anyDow}
+		if *got != want {
+			t.Errorf("ParseCron(%q) = %+v, want %+v", c.expr, *got, want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, c := range []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"* * * * *", "2024-01-31 23:59:30", "2024-02-01 00:00:00"},
+		{"@hourly", "2024-01-01 10:00:00", "2024-01-01 11:00:00"},
+		{"*/15 * * * *", "2024-01-01 10:07:00", "2024-01-01 10:15:00"},
+		{"0 9-17/4 * * *", "2024-01-01 10:00:00", "2024-01-01 13:00:00"},
+		{"0 9-17/4 * * *", "2024-01-01 17:00:00", "2024-01-02 09:00:00"},
+		{"0 0 1,15 * *", "2024-01-15 00:00:00", "2024-02-01 00:00:00"},
+		// across months without the day, and years
+		{"30 12 31 * *", "2024-02-01 00:00:00", "2024-03-31 12:30:00"},
+		{"@yearly", "2024-06-15 12:00:00", "2025-01-01 00:00:00"},
+		{"59 23 31 12 *", "2024-12-31 23:59:00", "2025-12-31 23:59:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00:00"},
+		// 2024-01-01 is a Monday
+		{"0 0 * * 7", "2024-01-01 00:00:00", "2024-01-07 00:00:00"},
+		{"0 0 ? * 0", "2024-01-01 00:00:00", "2024-01-07 00:00:00"},
+		{"0 0 * * 1-5", "2024-01-06 00:00:00", "2024-01-08 00:00:00"},
+		// with both day fields restricted either matches
+		{"0 0 13 * 5", "2024-01-01 00:00:00", "2024-01-05 00:00:00"},
+		{"0 0 13 * 5", "2024-01-12 00:00:00", "2024-01-13 00:00:00"},
+		// never within five years
+		{"0 0 30 2 *", "2024-01-01 00:00:00", ""},
+		{"0 0 31 4 *", "2024-01-01 00:00:00", ""},
+	} {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) = %v", c.expr, err)
+		}
+		got := cron.Next(at(c.from))
+		if c.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q Next(%s) = %v, want none", c.expr, c.from, got)
+			}
+		} else if !got.Equal(at(c.want)) {
+			t.Errorf("%q Next(%s) = %v, want %s", c.expr, c.from, got, c.want)
+		}
+	}
+
+	// the location of t is kept
+	cron, _ := ParseCron("0 12 * * *")
+	zone := time.FixedZone("test", 3600)
+	if got := cron.Next(time.Date(2024, 1, 1, 13, 0, 0, 0, zone)); !got.Equal(time.Date(2024, 1, 2, 12, 0, 0, 0, zone)) {
+		t.Errorf("Next() in another location = %v", got)
+	}
+}
+
+func TestCronDayMatches(t *testing.T) {
+	// 2024-01-05 is a Friday, 2024-01-13 a Saturday
+	friday5 := time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)
+	saturday13 := time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)
+	sunday14 := time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		expr string
+		day  time.Time
+		want bool
+	}{
+		{"* * * * *", sunday14, true},
+		{"0 0 13 * 5", friday5, true},
+		{"0 0 13 * 5", saturday13, true},
+		{"0 0 13 * 5", sunday14, false},
+		{"0 0 13 * *", saturday13, true},
+		{"0 0 13 * *", friday5, false},
+		{"0 0 * * 5", friday5, true},
+		{"0 0 * * 5", saturday13, false},
+		{"0 0 ? * 0", sunday14, true},
+		{"0 0 13 * ?", saturday13, true},
+		{"0 0 13 * ?", sunday14, false},
+	} {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cron.dayMatches(c.day); got != c.want {
+			t.Errorf("%q dayMatches(%s) = %v, want %v", c.expr, c.day.Format("Mon 2"), got, c.want)
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package generator
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/json"
 	"log"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+
 	"github.com/go-redis/redis"
 )
 
@@ -27,6 +29,8 @@ type EntityInfo struct {
 	NextAllowedUseTime      uint64
 }
 
+const scanBatchSize = 2000
+
 // ServerLocation relative percentage to a specific server's origin.
 type ServerLocation struct {
 	ServerID                [2]uint16
@@ -34,115 +38,344 @@ type ServerLocation struct {
 	ServerYRelativeLocation float64
 }
 
-func ProcessEntities(client *redis.Client, config *Config, entityData *string, entityDataLock *sync.RWMutex, tribeData *string, tribeDataLock *sync.RWMutex) {
-	var kidsWithBadParents map[string]bool
-	kidsWithBadParents = make(map[string]bool)
-	_ = kidsWithBadParents
+// EntityDelta holds the visible changes found by a single entity poll.
+type EntityDelta struct {
+	Added   []EntityInfo `json:"Added"`
+	Updated []EntityInfo `json:"Updated"`
+	Removed []string     `json:"Removed"`
+}
+
+// Empty reports whether the poll changed anything.
+func (d *EntityDelta) Empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0
+}
+
+// EntityTracker incrementally maintains the entity snapshot between polls.
+// Each poll is diffed against the previous one by EntityID so only changed
+// entities are re-encoded before being published to the store.
+type EntityTracker struct {
+	store              *SnapshotStore
+	entities           map[string]EntityInfo      // everything seen in the last poll
+	children           map[string]map[string]bool // parent -> kids
+	kidsWithBadParents map[string]string          // kid -> missing parent
+	encoded            map[string][]byte          // json per visible entity
+}
+
+// EntityPoll collects the records streamed from redis for one poll.
+type EntityPoll struct {
+	tracker *EntityTracker
+	seen    map[string]bool
+	changed map[string]EntityInfo
+}
+
+// NewEntityTracker returns an empty tracker publishing to store.
+func NewEntityTracker(store *SnapshotStore) *EntityTracker {
+	return &EntityTracker{
+		store:              store,
+		entities:           make(map[string]EntityInfo),
+		children:           make(map[string]map[string]bool),
+		kidsWithBadParents: make(map[string]string),
+		encoded:            make(map[string][]byte),
+	}
+}
+
+// Begin starts a new poll. Nothing is applied until Commit is called, so an
+// aborted poll leaves the previous snapshot untouched.
+func (t *EntityTracker) Begin() *EntityPoll {
+	return &EntityPoll{
+		tracker: t,
+		seen:    make(map[string]bool, len(t.entities)),
+		changed: make(map[string]EntityInfo),
+	}
+}
+
+// Add records one entity from the current poll.
+func (p *EntityPoll) Add(info *EntityInfo) {
+	if len(info.EntityID) == 0 {
+		return
+	}
+	p.seen[info.EntityID] = true
+	if old, found := p.tracker.entities[info.EntityID]; !found || old != *info {
+		p.changed[info.EntityID] = *info
+	}
+}
+
+// Commit applies the poll to the tracker, publishes the result to the store
+// and returns the visible changes.
+func (t *EntityTracker) Commit(p *EntityPoll) *EntityDelta {
+	delta := &EntityDelta{}
+	candidates := make(map[string]bool)
+	orphansChanged := false
+
+	for id, info := range p.changed {
+		if old, found := t.entities[id]; found && old.ParentEntityID != info.ParentEntityID {
+			t.unlink(id, old.ParentEntityID)
+		}
+		t.link(id, info.ParentEntityID)
+		t.entities[id] = info
+		candidates[id] = true
+		for kid := range t.children[id] {
+			candidates[kid] = true
+		}
+	}
+
+	for id, info := range t.entities {
+		if p.seen[id] {
+			continue
+		}
+		t.unlink(id, info.ParentEntityID)
+		delete(t.entities, id)
+		if _, found := t.kidsWithBadParents[id]; found {
+			delete(t.kidsWithBadParents, id)
+			orphansChanged = true
+		}
+		for kid := range t.children[id] {
+			candidates[kid] = true
+		}
+		if _, visible := t.encoded[id]; visible {
+			delete(t.encoded, id)
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+
+	// sanity check entity data, e.g. any missing parent ids?
+	for id := range candidates {
+		info, found := t.entities[id]
+		if !found {
+			continue
+		}
+		_, wasVisible := t.encoded[id]
+		if hasParent(&info) {
+			if _, parentFound := t.entities[info.ParentEntityID]; !parentFound {
+				if parent, dontSpamLog := t.kidsWithBadParents[id]; !dontSpamLog || parent != info.ParentEntityID {
+					log.Printf("Entity %s references parent %s that does not exist, removing from list", id, info.ParentEntityID)
+					t.kidsWithBadParents[id] = info.ParentEntityID
+					orphansChanged = true
+				}
+				if wasVisible {
+					delete(t.encoded, id)
+					delta.Removed = append(delta.Removed, id)
+				}
+				continue
+			}
+		}
+		if _, found := t.kidsWithBadParents[id]; found {
+			delete(t.kidsWithBadParents, id)
+			orphansChanged = true
+		}
+
+		_, changed := p.changed[id]
+		if wasVisible && !changed {
+			continue
+		}
+		js, err := json.Marshal(info)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		t.encoded[id] = js
+		if wasVisible {
+			delta.Updated = append(delta.Updated, info)
+		} else {
+			delta.Added = append(delta.Added, info)
+		}
+	}
+
+	if !delta.Empty() {
+		visible := make(map[string]EntityInfo, len(t.encoded))
+		for id := range t.encoded {
+			visible[id] = t.entities[id]
+		}
+		t.store.SetEntities(visible, t.encode())
+	}
+	if orphansChanged {
+		orphans := make(map[string]string, len(t.kidsWithBadParents))
+		for k, v := range t.kidsWithBadParents {
+			orphans[k] = v
+		}
+		if err := t.store.SetOrphans(orphans); err != nil {
+			log.Println(err)
+		}
+	}
+	return delta
+}
+
+func (t *EntityTracker) link(id string, parent string) {
+	kids := t.children[parent]
+	if kids == nil {
+		kids = make(map[string]bool)
+		t.children[parent] = kids
+	}
+	kids[id] = true
+}
+
+func (t *EntityTracker) unlink(id string, parent string) {
+	kids := t.children[parent]
+	delete(kids, id)
+	if len(kids) == 0 {
+		delete(t.children, parent)
+	}
+}
+
+// encode stitches the per-entity json into a single object. Only entities
+// changed since the last poll were re-marshalled.
+func (t *EntityTracker) encode() []byte {
+	size := 2
+	for id, js := range t.encoded {
+		size += len(id) + len(js) + 4
+	}
+	var buf bytes.Buffer
+	buf.Grow(size)
+	buf.WriteByte('{')
+	first := true
+	for id, js := range t.encoded {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		key, _ := json.Marshal(id)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(js)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// worldLocation converts the server relative location of an entity to world
+// units.
+func worldLocation(info *EntityInfo, grid coords.Grid) (x float64, y float64) {
+	return grid.ServerToWorld(int(info.ServerID[1]), int(info.ServerID[0]), info.ServerXRelativeLocation, info.ServerYRelativeLocation)
+}
+
+func hasParent(info *EntityInfo) bool {
+	return len(info.ParentEntityID) > 0 && info.ParentEntityID != "0"
+}
+
+// ProcessEntities runs in a loop streaming ships and beds from the database
+// into the snapshot store
+func ProcessEntities(client *redis.Client, gridConfig *atlas.GridConfig, config *Config, store *SnapshotStore, feed *Feed, history *History, tracks *TrackStore, index *SpatialIndex) {
+	entities := NewEntityTracker(store)
+	grid := coords.New(gridConfig)
+	var previousTribes map[string]string
 
 	for {
+		records, err := scan(client, "tribedata:*")
+		if err != nil {
+			log.Printf("Error! %v\n", err)
+			time.Sleep(time.Duration(config.EntityFetchRateInSeconds) * time.Second)
+			continue
+		}
 		tribes := make(map[string]string)
-		entities := make(map[string]EntityInfo)
-		_ = entities
-
-		for _, record := range scan(client, "tribedata:*") {
+		for _, record := range records {
 			tribes[record["TribeID"]] = record["TribeName"]
 		}
+		for id, name := range tribes {
+			if previousName, found := previousTribes[id]; found && previousName != name {
+				feed.Publish("tribe.renamed", TribeRename{
+					TribeID:      id,
+					TribeName:    name,
+					PreviousName: previousName,
+				})
+			}
+		}
+		previousTribes = tribes
 
-		js, _ := json.Marshal(tribes)
-		tribeDataLock.Lock()
-		*tribeData = string(js)
-		tribeDataLock.Unlock()
-/*
-		for _, record := range scan(client, "entityinfo:*") {
-			// log.Println(id)
-			info := newEntityInfo(record)
-			entities[info.EntityID] = *info
-		}
-
-		// sanity check entity data, e.g. any missing parent ids?
-		for k, v := range entities {
-			if v.ParentEntityID != "0" {
-				if _, parentFound := entities[v.ParentEntityID]; !parentFound {
-					if _, dontSpamLog := kidsWithBadParents[k]; !dontSpamLog {
-						kidsWithBadParents[k] = true
-						log.Printf("Entity %s references parent %s that does not exist, removing from list", k, v.ParentEntityID)
-					}
-					delete(entities, k)
-				}
+		if err := store.SetTribes(tribes); err != nil {
+			log.Println(err)
+		}
+
+		poll := entities.Begin()
+		err = scanEach(client, "entityinfo:*", func(key string, record map[string]string) {
+			poll.Add(newEntityInfo(record))
+		})
+		if err != nil {
+			log.Printf("Error! %v\n", err)
+		} else {
+			delta := entities.Commit(poll)
+			log.Printf("Entities: %d added, %d updated, %d removed", len(delta.Added), len(delta.Updated), len(delta.Removed))
+			if !delta.Empty() {
+				feed.Publish("entities", delta)
+				history.RecordEntities(store.Get("entities").JSON)
+				index.UpdateEntities(store.Entities())
+			}
+			if tracks != nil {
+				now := time.Now()
+				tracks.Record(delta, grid, now)
+				tracks.Prune(now)
 			}
 		}
 
-		js, _ = json.Marshal(entities)
-		entityDataLock.Lock()
-		*entityData = string(js)
-		entityDataLock.Unlock()
-*/
 		time.Sleep(time.Duration(config.EntityFetchRateInSeconds) * time.Second)
 	}
 }
 
-func scan(client *redis.Client, pattern string) map[string]map[string]string {
+// scan returns every hash matching pattern by key.
+func scan(client *redis.Client, pattern string) (map[string]map[string]string, error) {
 	records := make(map[string]map[string]string)
+	err := scanEach(client, pattern, func(key string, record map[string]string) {
+		records[key] = record
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
 
+// scanEach streams every hash matching pattern to fn. Keys are fetched in
+// pipelined batches as the scan progresses so the whole key set never has to
+// be held in memory.
+func scanEach(client *redis.Client, pattern string, fn func(key string, record map[string]string)) error {
 	start := time.Now()
 
+	keys := make([]string, 0, scanBatchSize)
+	flush := func() error {
+		// Batch fetch each entity to avoid overwhelming redis
+		pipe := client.Pipeline()
+		results := make([]*redis.StringStringMapCmd, len(keys))
+		for i := range keys {
+			results[i] = pipe.HGetAll(keys[i])
+		}
+		_, err := pipe.Exec()
+		pipe.Close()
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			fn(keys[i], results[i].Val())
+		}
+		keys = keys[:0]
+		return nil
+	}
+
 	// Scan is slower than Keys but provides gaps for other things to execute
-	var keys []string
 	iter := client.Scan(0, pattern, 5000).Iterator()
 	for iter.Next() {
 		keys = append(keys, iter.Val())
-	}
-	if err := iter.Err(); err != nil {
-		log.Fatal(err)
-	}
-
-	// Batch fetch each entity to avoid overwhelming redis
-	results := make(map[string]*redis.StringStringMapCmd)
-	batch := 0
-	pipe := client.Pipeline()
-	for i := 0; i < len(keys); i++ {
-		results[keys[i]] = pipe.HGetAll(keys[i])
-		batch++
-		if batch > 2000 {
-			pipe.Exec()		
-			batch = 0
-			pipe = client.Pipeline()
+		if len(keys) >= scanBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
 		}
 	}
-	if batch > 0 {
-		pipe.Exec()
+	if err := iter.Err(); err != nil {
+		return err
 	}
-	for _, id := range keys {
-		var err error
-		records[id], err = results[id].Result()
-		if err != nil {
-			log.Fatal(err)
+	if len(keys) > 0 {
+		if err := flush(); err != nil {
+			return err
 		}
 	}
 
 	elapsed := time.Since(start)
-	log.Printf("Redis scan took %s", elapsed)
-
-	return records
+	log.Printf("Redis scan of %s took %s", pattern, elapsed)
+	return nil
 }
 
-// serverID unpacks the packed server ID. Each Server has an X and Y ID which
-// corresponds to its 2D location in the game world. The ID is packed into
-// 32-bits as follows:
-//   +--------------+--------------+
-//   | X (uint16_t) | Y (uint16_t) |
-//   +--------------+--------------+
+// serverID unpacks the packed server ID into [Y, X], the order the front end
+// expects. See coords.Pack for the packing.
 func serverID(packed string) (split [2]uint16, err error) {
-	var id uint64
-	id, err = strconv.ParseUint(packed, 10, 32)
-	if err != nil {
-		return
-	}
-
-	buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buf, uint32(id))
-	split[0] = binary.LittleEndian.Uint16(buf[:2])
-	split[1] = binary.LittleEndian.Uint16(buf[2:])
+	split[1], split[0], err = coords.ParsePacked(packed)
 	return
 }
 
@@ -0,0 +1,105 @@
+package generator
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestEntityTrackerCommit(t *testing.T) {
+	store := NewSnapshotStore()
+	tracker := NewEntityTracker(store)
+	commit := func(entities ...EntityInfo) *EntityDelta {
+		poll := tracker.Begin()
+		for i := range entities {
+			poll.Add(&entities[i])
+		}
+		return tracker.Commit(poll)
+	}
+	ids := func(infos []EntityInfo) []string {
+		ids := make([]string, 0, len(infos))
+		for _, info := range infos {
+			ids = append(ids, info.EntityID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	check := func(poll int, delta *EntityDelta, added, updated, removed []string, orphans map[string]string) {
+		if got := ids(delta.Added); !reflect.DeepEqual(got, added) {
+			t.Errorf("poll %d: Added = %v, want %v", poll, got, added)
+		}
+		if got := ids(delta.Updated); !reflect.DeepEqual(got, updated) {
+			t.Errorf("poll %d: Updated = %v, want %v", poll, got, updated)
+		}
+		got := append([]string{}, delta.Removed...)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, removed) {
+			t.Errorf("poll %d: Removed = %v, want %v", poll, got, removed)
+		}
+		if got := store.Orphans(); !reflect.DeepEqual(got, orphans) {
+			t.Errorf("poll %d: orphans = %v, want %v", poll, got, orphans)
+		}
+		var orphansJSON map[string]string
+		if err := json.Unmarshal(store.Get("orphans").JSON, &orphansJSON); err != nil || !reflect.DeepEqual(orphansJSON, orphans) {
+			t.Errorf("poll %d: orphans snapshot = %v %v, want %v", poll, orphansJSON, err, orphans)
+		}
+	}
+	visible := func(poll int, want ...string) {
+		var got []string
+		for id := range store.Entities() {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("poll %d: visible = %v, want %v", poll, got, want)
+		}
+		var snapshot map[string]EntityInfo
+		if err := json.Unmarshal(store.Get("entities").JSON, &snapshot); err != nil {
+			t.Fatalf("poll %d: %v", poll, err)
+		}
+		if !reflect.DeepEqual(snapshot, store.Entities()) {
+			t.Errorf("poll %d: entities snapshot = %v, want %v", poll, snapshot, store.Entities())
+		}
+	}
+
+	ship := EntityInfo{EntityID: "1", ParentEntityID: "0", EntityType: "Ship", ServerXRelativeLocation: 0.1, ServerYRelativeLocation: 0.2}
+	bed := EntityInfo{EntityID: "2", ParentEntityID: "1", EntityType: "Bed"}
+	lostBed := EntityInfo{EntityID: "3", ParentEntityID: "9", EntityType: "Bed"}
+
+	delta := commit(ship, bed, lostBed)
+	check(1, delta, []string{"1", "2"}, []string{}, []string{}, map[string]string{"3": "9"})
+	visible(1, "1", "2")
+
+	// the ship moves and sinks its bed, the lost bed's parent turns up and a
+	// new bed references a ship that does not exist
+	moved := ship
+	moved.ServerXRelativeLocation = 0.5
+	parent := EntityInfo{EntityID: "9", ParentEntityID: "0", EntityType: "Ship"}
+	newBed := EntityInfo{EntityID: "4", ParentEntityID: "8", EntityType: "Bed"}
+
+	delta = commit(moved, lostBed, parent, newBed)
+	check(2, delta, []string{"3", "9"}, []string{"1"}, []string{"2"}, map[string]string{"4": "8"})
+	visible(2, "1", "3", "9")
+	if got := store.Entities()["1"].ServerXRelativeLocation; got != 0.5 {
+		t.Errorf("moved ship X = %v, want 0.5", got)
+	}
+
+	// removing a parent hides its kids again
+	version := store.Version()
+	delta = commit(moved, lostBed, newBed)
+	check(3, delta, []string{}, []string{}, []string{"3", "9"}, map[string]string{"3": "9", "4": "8"})
+	visible(3, "1")
+	if store.Version() == version {
+		t.Errorf("version not bumped by a changing poll")
+	}
+
+	// an identical poll changes nothing and publishes nothing
+	version = store.Version()
+	if delta = commit(moved, lostBed, newBed); !delta.Empty() {
+		t.Errorf("identical poll delta = %+v, want empty", delta)
+	}
+	if store.Version() != version {
+		t.Errorf("identical poll bumped the version from %d to %d", version, store.Version())
+	}
+}
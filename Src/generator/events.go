@@ -0,0 +1,202 @@
+package generator
+
+import (
+	"sort"
+	"sync"
+)
+
+// Colony event types
+const (
+	EventIslandCaptured    = "island.captured"
+	EventIslandLost        = "island.lost"
+	EventSettlementRenamed = "settlement.renamed"
+	EventTaxRateChanged    = "tax.changed"
+	EventWarDeclared       = "war.declared"
+	EventWarEnded          = "war.ended"
+)
+
+// ColonyEvent is a semantic change between two colony polls. TribeID is the
+// owning tribe after the change, or the former owner for a lost island.
+// OtherTribeID is the previous owner of a captured island or the attacker in
+// a war.
+type ColonyEvent struct {
+	ID                     uint64  `json:"ID"`
+	Type                   string  `json:"Type"`
+	Time                   int64   `json:"Time"`
+	IslandID               int     `json:"IslandID"`
+	TribeID                uint64  `json:"TribeId"`
+	OtherTribeID           uint64  `json:"OtherTribeId,omitempty"`
+	SettlementName         string  `json:"SettlementName"`
+	PreviousSettlementName string  `json:"PreviousSettlementName,omitempty"`
+	TaxRate                float64 `json:"TaxRate"`
+	PreviousTaxRate        float64 `json:"PreviousTaxRate,omitempty"`
+	WarStartUTC            uint32  `json:"WarStartUTC,omitempty"`
+	WarEndUTC              uint32  `json:"WarEndUTC,omitempty"`
+}
+
+// EventFilter selects events from the log. Zero values match everything.
+type EventFilter struct {
+	TribeID  uint64
+	IslandID int
+	Type     string
+	SinceID  uint64
+	Limit    int
+}
+
+func (f *EventFilter) matches(e *ColonyEvent) bool {
+	if e.ID <= f.SinceID {
+		return false
+	}
+	if f.TribeID != 0 && e.TribeID != f.TribeID && e.OtherTribeID != f.TribeID {
+		return false
+	}
+	if f.IslandID != 0 && e.IslandID != f.IslandID {
+		return false
+	}
+	if len(f.Type) > 0 && e.Type != f.Type {
+		return false
+	}
+	return true
+}
+
+// EventLog is a bounded in-memory ring of colony events.
+type EventLog struct {
+	lock   sync.RWMutex
+	nextID uint64
+	events []ColonyEvent
+	start  int
+	count  int
+}
+
+// NewEventLog returns a log remembering up to size events.
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &EventLog{
+		nextID: 1,
+		events: make([]ColonyEvent, size),
+	}
+}
+
+// Add assigns IDs to the events and appends them, dropping the oldest.
+func (l *EventLog) Add(events []ColonyEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i := range events {
+		events[i].ID = l.nextID
+		l.nextID++
+		if l.count < len(l.events) {
+			l.events[(l.start+l.count)%len(l.events)] = events[i]
+			l.count++
+		} else {
+			l.events[l.start] = events[i]
+			l.start = (l.start + 1) % len(l.events)
+		}
+	}
+}
+
+// Query returns matching events oldest first. With a limit only the newest
+// matches are returned.
+func (l *EventLog) Query(filter EventFilter) []ColonyEvent {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	results := make([]ColonyEvent, 0)
+	for i := l.count - 1; i >= 0; i-- {
+		e := &l.events[(l.start+i)%len(l.events)]
+		if e.ID <= filter.SinceID {
+			break
+		}
+		if !filter.matches(e) {
+			continue
+		}
+		results = append(results, *e)
+		if filter.Limit > 0 && len(results) >= filter.Limit {
+			break
+		}
+	}
+	for i := len(results)/2 - 1; i >= 0; i-- {
+		opp := len(results) - 1 - i
+		results[i], results[opp] = results[opp], results[i]
+	}
+	return results
+}
+
+// diffIslands computes the semantic changes between two island outputs. Each
+// output's Version is the unix time it was generated.
+func diffIslands(previous *IslandOutput, current *IslandOutput) []ColonyEvent {
+	events := make([]ColonyEvent, 0)
+	now := current.Version
+	before := make(map[int]*IslandInfoOutput)
+	for i := range previous.Islands {
+		before[previous.Islands[i].IslandID] = &previous.Islands[i]
+	}
+
+	newEvent := func(eventType string, island *IslandInfoOutput) ColonyEvent {
+		return ColonyEvent{
+			Type:           eventType,
+			Time:           now,
+			IslandID:       island.IslandID,
+			TribeID:        island.TribeID,
+			SettlementName: island.SettlementName,
+			TaxRate:        island.TaxRate,
+		}
+	}
+	warEvent := func(eventType string, island *IslandInfoOutput) ColonyEvent {
+		e := newEvent(eventType, island)
+		e.OtherTribeID = island.WarringTribeID
+		e.WarStartUTC = island.WarStartUTC
+		e.WarEndUTC = island.WarEndUTC
+		return e
+	}
+	warPending := func(island *IslandInfoOutput, at int64) bool {
+		return island.WarringTribeID != 0 && int64(island.WarEndUTC) > at
+	}
+
+	for i := range current.Islands {
+		island := &current.Islands[i]
+		old, found := before[island.IslandID]
+		delete(before, island.IslandID)
+
+		if !found || old.TribeID != island.TribeID {
+			e := newEvent(EventIslandCaptured, island)
+			if found {
+				e.OtherTribeID = old.TribeID
+			}
+			events = append(events, e)
+		} else {
+			if old.SettlementName != island.SettlementName {
+				e := newEvent(EventSettlementRenamed, island)
+				e.PreviousSettlementName = old.SettlementName
+				events = append(events, e)
+			}
+			if old.TaxRate != island.TaxRate {
+				e := newEvent(EventTaxRateChanged, island)
+				e.PreviousTaxRate = old.TaxRate
+				events = append(events, e)
+			}
+		}
+
+		wasAtWar := found && warPending(old, previous.Version)
+		isAtWar := warPending(island, now)
+		sameWar := wasAtWar && isAtWar && old.WarringTribeID == island.WarringTribeID && old.WarStartUTC == island.WarStartUTC
+		if wasAtWar && !sameWar {
+			events = append(events, warEvent(EventWarEnded, old))
+		}
+		if isAtWar && !sameWar {
+			events = append(events, warEvent(EventWarDeclared, island))
+		}
+	}
+
+	for _, old := range before {
+		if warPending(old, previous.Version) {
+			events = append(events, warEvent(EventWarEnded, old))
+		}
+		events = append(events, newEvent(EventIslandLost, old))
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].IslandID < events[j].IslandID })
+	return events
+}
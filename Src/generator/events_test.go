@@ -0,0 +1,178 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffIslands(t *testing.T) {
+	const before, now = 1000, 2000
+	island := func(id int, tribe uint64, settlement string, tax float64) IslandInfoOutput {
+		return IslandInfoOutput{IslandID: id, TribeID: tribe, SettlementName: settlement, TaxRate: tax}
+	}
+	atWar := func(i IslandInfoOutput, attacker uint64, start, end uint32) IslandInfoOutput {
+		i.WarringTribeID = attacker
+		i.WarStartUTC = start
+		i.WarEndUTC = end
+		return i
+	}
+
+	for _, c := range []struct {
+		name     string
+		previous []IslandInfoOutput
+		current  []IslandInfoOutput
+		want     []ColonyEvent
+	}{
+		{
+			name:     "unchanged",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5)},
+			current:  []IslandInfoOutput{island(1, 10, "a", 5)},
+			want:     []ColonyEvent{},
+		},
+		{
+			name:    "claimed",
+			current: []IslandInfoOutput{island(1, 10, "a", 5)},
+			want: []ColonyEvent{
+				{Type: EventIslandCaptured, Time: now, IslandID: 1, TribeID: 10, SettlementName: "a", TaxRate: 5},
+			},
+		},
+		{
+			name:     "captured",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5)},
+			current:  []IslandInfoOutput{island(1, 20, "b", 7)},
+			want: []ColonyEvent{
+				{Type: EventIslandCaptured, Time: now, IslandID: 1, TribeID: 20, OtherTribeID: 10, SettlementName: "b", TaxRate: 7},
+			},
+		},
+		{
+			name:     "lost",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5), island(2, 10, "b", 5)},
+			current:  []IslandInfoOutput{island(1, 10, "a", 5)},
+			want: []ColonyEvent{
+				{Type: EventIslandLost, Time: now, IslandID: 2, TribeID: 10, SettlementName: "b", TaxRate: 5},
+			},
+		},
+		{
+			name:     "renamed",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5)},
+			current:  []IslandInfoOutput{island(1, 10, "b", 5)},
+			want: []ColonyEvent{
+				{Type: EventSettlementRenamed, Time: now, IslandID: 1, TribeID: 10, SettlementName: "b", PreviousSettlementName: "a", TaxRate: 5},
+			},
+		},
+		{
+			name:     "tax",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5)},
+			current:  []IslandInfoOutput{island(1, 10, "a", 12.5)},
+			want: []ColonyEvent{
+				{Type: EventTaxRateChanged, Time: now, IslandID: 1, TribeID: 10, SettlementName: "a", TaxRate: 12.5, PreviousTaxRate: 5},
+			},
+		},
+		{
+			name:     "renamed and tax",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5)},
+			current:  []IslandInfoOutput{island(1, 10, "b", 6)},
+			want: []ColonyEvent{
+				{Type: EventSettlementRenamed, Time: now, IslandID: 1, TribeID: 10, SettlementName: "b", PreviousSettlementName: "a", TaxRate: 6},
+				{Type: EventTaxRateChanged, Time: now, IslandID: 1, TribeID: 10, SettlementName: "b", TaxRate: 6, PreviousTaxRate: 5},
+			},
+		},
+		{
+			name:     "war declared",
+			previous: []IslandInfoOutput{island(1, 10, "a", 5)},
+			current:  []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 1500, 3000)},
+			want: []ColonyEvent{
+				{Type: EventWarDeclared, Time: now, IslandID: 1, TribeID: 10, OtherTribeID: 20, SettlementName: "a", TaxRate: 5, WarStartUTC: 1500, WarEndUTC: 3000},
+			},
+		},
+		{
+			name:     "war ongoing",
+			previous: []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 3000)},
+			current:  []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 3000)},
+			want:     []ColonyEvent{},
+		},
+		{
+			name:     "war ended by time",
+			previous: []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 1500)},
+			current:  []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 1500)},
+			want: []ColonyEvent{
+				{Type: EventWarEnded, Time: now, IslandID: 1, TribeID: 10, OtherTribeID: 20, SettlementName: "a", TaxRate: 5, WarStartUTC: 900, WarEndUTC: 1500},
+			},
+		},
+		{
+			name:     "war ended by capture",
+			previous: []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 3000)},
+			current:  []IslandInfoOutput{island(1, 20, "a", 5)},
+			want: []ColonyEvent{
+				{Type: EventIslandCaptured, Time: now, IslandID: 1, TribeID: 20, OtherTribeID: 10, SettlementName: "a", TaxRate: 5},
+				{Type: EventWarEnded, Time: now, IslandID: 1, TribeID: 10, OtherTribeID: 20, SettlementName: "a", TaxRate: 5, WarStartUTC: 900, WarEndUTC: 3000},
+			},
+		},
+		{
+			name:     "war ended by loss",
+			previous: []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 3000)},
+			want: []ColonyEvent{
+				{Type: EventWarEnded, Time: now, IslandID: 1, TribeID: 10, OtherTribeID: 20, SettlementName: "a", TaxRate: 5, WarStartUTC: 900, WarEndUTC: 3000},
+				{Type: EventIslandLost, Time: now, IslandID: 1, TribeID: 10, SettlementName: "a", TaxRate: 5},
+			},
+		},
+		{
+			name:     "new war",
+			previous: []IslandInfoOutput{atWar(island(1, 10, "a", 5), 20, 900, 3000)},
+			current:  []IslandInfoOutput{atWar(island(1, 10, "a", 5), 30, 1800, 4000)},
+			want: []ColonyEvent{
+				{Type: EventWarEnded, Time: now, IslandID: 1, TribeID: 10, OtherTribeID: 20, SettlementName: "a", TaxRate: 5, WarStartUTC: 900, WarEndUTC: 3000},
+				{Type: EventWarDeclared, Time: now, IslandID: 1, TribeID: 10, OtherTribeID: 30, SettlementName: "a", TaxRate: 5, WarStartUTC: 1800, WarEndUTC: 4000},
+			},
+		},
+		{
+			name:     "ordered by island",
+			previous: []IslandInfoOutput{island(3, 10, "c", 5)},
+			current:  []IslandInfoOutput{island(2, 10, "b", 5), island(1, 10, "a", 5)},
+			want: []ColonyEvent{
+				{Type: EventIslandCaptured, Time: now, IslandID: 1, TribeID: 10, SettlementName: "a", TaxRate: 5},
+				{Type: EventIslandCaptured, Time: now, IslandID: 2, TribeID: 10, SettlementName: "b", TaxRate: 5},
+				{Type: EventIslandLost, Time: now, IslandID: 3, TribeID: 10, SettlementName: "c", TaxRate: 5},
+			},
+		},
+	} {
+		previous := &IslandOutput{Version: before, Islands: c.previous}
+		current := &IslandOutput{Version: now, Islands: c.current}
+		if got := diffIslands(previous, current); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: diffIslands() =\n%+v\nwant\n%+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEventLogQuery(t *testing.T) {
+	l := NewEventLog(3)
+	l.Add([]ColonyEvent{
+		{Type: EventIslandCaptured, IslandID: 1, TribeID: 10},
+		{Type: EventIslandCaptured, IslandID: 2, TribeID: 20, OtherTribeID: 10},
+		{Type: EventIslandLost, IslandID: 3, TribeID: 10},
+		{Type: EventTaxRateChanged, IslandID: 1, TribeID: 10},
+	})
+	ids := func(events []ColonyEvent) []uint64 {
+		ids := make([]uint64, 0, len(events))
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	for _, c := range []struct {
+		filter EventFilter
+		want   []uint64
+	}{
+		{EventFilter{}, []uint64{2, 3, 4}},
+		{EventFilter{TribeID: 10}, []uint64{2, 3, 4}},
+		{EventFilter{TribeID: 20}, []uint64{2}},
+		{EventFilter{IslandID: 1}, []uint64{4}},
+		{EventFilter{Type: EventIslandLost}, []uint64{3}},
+		{EventFilter{SinceID: 2}, []uint64{3, 4}},
+		{EventFilter{Limit: 2}, []uint64{3, 4}},
+	} {
+		if got := ids(l.Query(c.filter)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Query(%+v) = %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+
+	"github.com/go-redis/redis"
+)
+
+// Projection converts map coordinates to the coordinates written by an
+// export.
+type Projection func(x, y float64) [2]float64
+
+// NewProjection returns the projection for units "map" (the default), "world"
+// or "gps", where GPS coordinates are longitude and latitude as shown in game.
+func NewProjection(grid coords.Grid, units string) (Projection, error) {
+	switch units {
+	case "", "map":
+		return func(x, y float64) [2]float64 { return [2]float64{x, y} }, nil
+	case "world":
+		return func(x, y float64) [2]float64 {
+			wx, wy := grid.MapToWorld(x, y)
+			return [2]float64{wx, wy}
+		}, nil
+	case "gps":
+		return func(x, y float64) [2]float64 {
+			long, lat := grid.WorldToGPS(grid.MapToWorld(x, y))
+			return [2]float64{long, lat}
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown units %q", units)
+}
+
+// ExportGeoJSON returns the whole world state as one feature collection:
+// servers, islands and disco zones as polygons, claimed islands with their
+// owner, tax and war properties, ship paths and entities. Every feature has a
+// "kind" property naming its data set.
+func ExportGeoJSON(data *GridData, splines []*ShipPathSpline, grid coords.Grid, islands *IslandOutput, index *SpatialIndex, project Projection) *GeoJSONFeatureCollection {
+	collection := NewFeatureCollection()
+	add := func(feature GeoJSONFeature, kind string) {
+		feature.Properties["kind"] = kind
+		feature.Geometry.Coordinates = reproject(feature.Geometry.Coordinates, project)
+		collection.Features = append(collection.Features, feature)
+	}
+
+	for _, server := range data.Layout.Servers {
+		b := server.Bounds
+		ring := [][2]float64{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}}
+		feature := NewFeature(server.ServerID, "Polygon", [][][2]float64{closeRing(ring)})
+		feature.Properties["ServerId"] = server.ServerID
+		feature.Properties["Name"] = server.Name
+		feature.Properties["Cell"] = server.Cell
+		feature.Properties["GridX"] = server.GridX
+		feature.Properties["GridY"] = server.GridY
+		feature.Properties["IsHomeServer"] = server.IsHomeServer
+		feature.Properties["TemplateName"] = server.TemplateName
+		add(feature, "server")
+	}
+
+	footprints := make(map[int][][2]float64, len(data.Islands))
+	for i := range data.Islands {
+		island := &data.Islands[i]
+		footprints[island.IslandID] = island.Footprint()
+		feature := NewFeature(island.IslandID, "Polygon", [][][2]float64{closeRing(footprints[island.IslandID])})
+		feature.Properties["IslandID"] = island.IslandID
+		feature.Properties["Name"] = island.Name
+		feature.Properties["ServerId"] = island.ServerID
+		feature.Properties["IslandPoints"] = island.IslandPoints
+		feature.Properties["Rotation"] = island.Rotation
+		add(feature, "island")
+	}
+
+	tribeNames := make(map[uint64]string, len(islands.Companies))
+	for _, company := range islands.Companies {
+		tribeNames[company.TribeID] = company.TribeName
+	}
+	for i := range islands.Islands {
+		claim := &islands.Islands[i]
+		footprint, found := footprints[claim.IslandID]
+		if !found {
+			continue
+		}
+		feature := NewFeature(claim.IslandID, "Polygon", [][][2]float64{closeRing(footprint)})
+		feature.Properties["IslandID"] = claim.IslandID
+		feature.Properties["TribeId"] = claim.TribeID
+		feature.Properties["TribeName"] = tribeNames[claim.TribeID]
+		feature.Properties["Color"] = claim.Color
+		feature.Properties["SettlementName"] = claim.SettlementName
+		feature.Properties["IslandPoints"] = claim.IslandPoints
+		feature.Properties["TaxRate"] = claim.TaxRate
+		feature.Properties["NumSettlers"] = claim.NumSettlers
+		feature.Properties["CombatPhaseStartTime"] = claim.CombatPhaseStartTime
+		feature.Properties["WarringTribeID"] = claim.WarringTribeID
+		feature.Properties["WarStartUTC"] = claim.WarStartUTC
+		feature.Properties["WarEndUTC"] = claim.WarEndUTC
+		add(feature, "claim")
+	}
+
+	for i := range data.DiscoZones {
+		zone := &data.DiscoZones[i]
+		feature := NewFeature(zone.ID, "Polygon", [][][2]float64{closeRing(zone.Footprint())})
+		feature.Properties["ID"] = zone.ID
+		feature.Properties["Name"] = zone.Name
+		feature.Properties["ServerId"] = zone.ServerID
+		feature.Properties["Xp"] = zone.Xp
+		feature.Properties["AllowSea"] = zone.AllowSea
+		feature.Properties["ExplorerNoteIndex"] = zone.ExplorerNoteIndex
+		add(feature, "discozone")
+	}
+
+	for _, feature := range ShipPathsGeoJSON(splines, grid, time.Now(), 0).Features {
+		add(feature, "shippath")
+	}
+
+	inf := math.Inf(1)
+	index.EachEntityIn(-inf, -inf, inf, inf, func(info *EntityInfo, x, y float64) {
+		feature := NewFeature(entityFeatureID(info.EntityID), "Point", [2]float64{x, y})
+		feature.Properties["EntityID"] = info.EntityID
+		feature.Properties["ParentEntityID"] = info.ParentEntityID
+		feature.Properties["EntityType"] = info.EntityType
+		feature.Properties["EntitySubType"] = info.EntitySubType
+		feature.Properties["EntityName"] = info.EntityName
+		feature.Properties["TribeID"] = info.TribeID
+		feature.Properties["ServerId"] = coords.Pack(info.ServerID[1], info.ServerID[0])
+		feature.Properties["LastUpdatedDBAt"] = info.LastUpdatedDBAt
+		add(feature, "entity")
+	})
+
+	return collection
+}
+
+// closeRing returns a polygon ring with the first point repeated at the end,
+// as GeoJSON requires.
+func closeRing(polygon [][2]float64) [][2]float64 {
+	ring := make([][2]float64, len(polygon), len(polygon)+1)
+	copy(ring, polygon)
+	return append(ring, polygon[0])
+}
+
+// reproject applies a projection to Point, LineString and Polygon
+// coordinates. Polygons have a single exterior ring.
+func reproject(coordinates interface{}, project Projection) interface{} {
+	switch c := coordinates.(type) {
+	case [2]float64:
+		return project(c[0], c[1])
+	case [][2]float64:
+		out := make([][2]float64, len(c))
+		for i, p := range c {
+			out[i] = project(p[0], p[1])
+		}
+		return out
+	case [][][2]float64:
+		out := make([][][2]float64, len(c))
+		for i, ring := range c {
+			out[i] = counterClockwise(reproject(ring, project).([][2]float64))
+		}
+		return out
+	}
+	return coordinates
+}
+
+// counterClockwise rewinds a ring in place so its exterior winds counter
+// clockwise as RFC 7946 recommends.
+func counterClockwise(ring [][2]float64) [][2]float64 {
+	area := 0.0
+	for i := 0; i+1 < len(ring); i++ {
+		area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+	if area < 0 {
+		for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+			ring[i], ring[j] = ring[j], ring[i]
+		}
+	}
+	return ring
+}
+
+// LoadWorld fetches the island claims and entities from redis once into the
+// store and index, for exporting without running the service.
+func LoadWorld(tribeDB *redis.Client, territoryDB *redis.Client, gridConfig *atlas.GridConfig, colors *TribeColors, store *SnapshotStore, index *SpatialIndex) error {
+	counts, _, err := fetchIslandClaims(territoryDB, gridConfig)
+	if err != nil {
+		return err
+	}
+	if err := colors.Assign(counts); err != nil {
+		return err
+	}
+	output := generateIslandData(counts, coords.New(gridConfig))
+	if err := store.SetIslands(output); err != nil {
+		return err
+	}
+
+	entities := NewEntityTracker(store)
+	poll := entities.Begin()
+	err = scanEach(tribeDB, "entityinfo:*", func(key string, record map[string]string) {
+		poll.Add(newEntityInfo(record))
+	})
+	if err != nil {
+		return err
+	}
+	entities.Commit(poll)
+	index.UpdateEntities(store.Entities())
+	return nil
+}
+
+// entityFeatureID keeps numeric entity IDs numeric in exports.
+func entityFeatureID(id string) interface{} {
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return n
+	}
+	return id
+}
@@ -0,0 +1,211 @@
+package generator
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"AtlasMapViewer/atlas/coords"
+)
+
+func TestNewProjection(t *testing.T) {
+	// a 2 by 1 grid is 2000 world units across
+	grid := coords.New(loadTestGrid(t, 2, 1, 1000))
+	for _, c := range []struct {
+		units string
+		x, y  float64
+		want  [2]float64
+	}{
+		{"", 0.5, 0.25, [2]float64{0.5, 0.25}},
+		{"map", 0.1, 0.2, [2]float64{0.1, 0.2}},
+		{"world", 0.5, 0.25, [2]float64{1000, 500}},
+		{"world", 1, 0.5, [2]float64{2000, 1000}},
+		{"gps", 0.5, 0.25, [2]float64{0, 0}},
+		{"gps", 0, 0, [2]float64{-100, 100}},
+		{"gps", 1, 0.5, [2]float64{100, -100}},
+	} {
+		project, err := NewProjection(grid, c.units)
+		if err != nil {
+			t.Errorf("NewProjection(%q) = %v", c.units, err)
+			continue
+		}
+		if got := project(c.x, c.y); !nearlyEqual(got[0], c.want[0]) || !nearlyEqual(got[1], c.want[1]) {
+			t.Errorf("NewProjection(%q)(%v, %v) = %v, want %v", c.units, c.x, c.y, got, c.want)
+		}
+	}
+	if _, err := NewProjection(grid, "feet"); err == nil {
+		t.Errorf("NewProjection(feet) accepted unknown units")
+	}
+}
+
+type testGeoJSON struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Type     string      `json:"type"`
+		ID       interface{} `json:"id"`
+		Geometry struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	} `json:"features"`
+}
+
+// exportTestWorld exports a 2 by 1 grid with the island of A1 claimed and a
+// ship on it, read back from its json.
+func exportTestWorld(t *testing.T, units string) testGeoJSON {
+	cfg := loadTestGrid(t, 2, 1, 1000)
+	grid := coords.New(cfg)
+	project, err := NewProjection(grid, units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	islands := &IslandOutput{
+		Islands: []IslandInfoOutput{
+			{IslandID: testIslandID(0, 0), TribeID: 5, Color: "#ff0000", SettlementName: "Port", TaxRate: 0.25, NumSettlers: 3},
+			// claims of islands missing from the grid are skipped
+			{IslandID: 999, TribeID: 5},
+		},
+		Companies: []CompanyInfoOutput{{TribeID: 5, TribeName: "Five"}},
+	}
+	index := NewSpatialIndex(cfg)
+	index.UpdateEntities(map[string]EntityInfo{
+		"42": {EntityID: "42", ParentEntityID: "0", EntityType: "Ship", EntityName: "Boat", TribeID: "5", ServerXRelativeLocation: 0.5, ServerYRelativeLocation: 0.5},
+	})
+
+	js, err := json.Marshal(ExportGeoJSON(NewGridData(cfg), nil, grid, islands, index, project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collection testGeoJSON
+	if err := json.Unmarshal(js, &collection); err != nil {
+		t.Fatal(err)
+	}
+	return collection
+}
+
+func TestExportGeoJSON(t *testing.T) {
+	collection := exportTestWorld(t, "map")
+	if collection.Type != "FeatureCollection" {
+		t.Errorf("type = %q, want FeatureCollection", collection.Type)
+	}
+
+	kinds := make(map[string]int)
+	for _, f := range collection.Features {
+		kind, _ := f.Properties["kind"].(string)
+		kinds[kind]++
+		if f.Type != "Feature" {
+			t.Errorf("%s feature type = %q", kind, f.Type)
+		}
+
+		switch f.Geometry.Type {
+		case "Polygon":
+			var rings [][][2]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &rings); err != nil || len(rings) != 1 {
+				t.Fatalf("%s %v coordinates = %s, %v", kind, f.ID, f.Geometry.Coordinates, err)
+			}
+			ring := rings[0]
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				t.Errorf("%s %v ring %v is not closed", kind, f.ID, ring)
+			}
+			area := 0.0
+			for i := 0; i+1 < len(ring); i++ {
+				area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+			}
+			if area <= 0 {
+				t.Errorf("%s %v ring winds clockwise", kind, f.ID)
+			}
+		case "Point":
+		default:
+			t.Errorf("%s %v has a %s geometry", kind, f.ID, f.Geometry.Type)
+		}
+
+		switch kind {
+		case "server":
+			var rings [][][2]float64
+			json.Unmarshal(f.Geometry.Coordinates, &rings)
+			// servers cover their cell of the map, which is twice as wide as high
+			x := 0.0
+			if f.Properties["Cell"] == "B1" {
+				x = 0.5
+			}
+			for _, p := range rings[0] {
+				if (!nearlyEqual(p[0], x) && !nearlyEqual(p[0], x+0.5)) || (!nearlyEqual(p[1], 0) && !nearlyEqual(p[1], 0.5)) {
+					t.Errorf("server %v corner %v, want x %v..%v and y 0..0.5", f.Properties["Cell"], p, x, x+0.5)
+				}
+			}
+		case "claim":
+			want := map[string]interface{}{
+				"kind":                 "claim",
+				"IslandID":             float64(testIslandID(0, 0)),
+				"TribeId":              float64(5),
+				"TribeName":            "Five",
+				"Color":                "#ff0000",
+				"SettlementName":       "Port",
+				"IslandPoints":         float64(0),
+				"TaxRate":              0.25,
+				"NumSettlers":          float64(3),
+				"CombatPhaseStartTime": float64(0),
+				"WarringTribeID":       float64(0),
+				"WarStartUTC":          float64(0),
+				"WarEndUTC":            float64(0),
+			}
+			if !reflect.DeepEqual(f.Properties, want) {
+				t.Errorf("claim properties = %v, want %v", f.Properties, want)
+			}
+		case "entity":
+			var p [2]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &p); err != nil {
+				t.Fatal(err)
+			}
+			// the middle of A1
+			if !nearlyEqual(p[0], 0.25) || !nearlyEqual(p[1], 0.25) || f.ID != float64(42) {
+				t.Errorf("entity %v at %v, want 42 at 0.25, 0.25", f.ID, p)
+			}
+			if f.Properties["EntityName"] != "Boat" || f.Properties["EntityType"] != "Ship" || f.Properties["TribeID"] != "5" {
+				t.Errorf("entity properties = %v", f.Properties)
+			}
+		}
+	}
+	want := map[string]int{"server": 2, "island": 2, "claim": 1, "entity": 1}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("feature kinds = %v, want %v", kinds, want)
+	}
+}
+
+func TestExportGeoJSONUnits(t *testing.T) {
+	// every coordinate of a world export is the map one scaled by the extent
+	var scale func(a, b interface{}) bool
+	scale = func(a, b interface{}) bool {
+		switch a := a.(type) {
+		case float64:
+			return math.Abs(a*2000-b.(float64)) < 1e-6
+		case []interface{}:
+			b, ok := b.([]interface{})
+			if !ok || len(a) != len(b) {
+				return false
+			}
+			for i := range a {
+				if !scale(a[i], b[i]) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+
+	mapped, world := exportTestWorld(t, "map"), exportTestWorld(t, "world")
+	if len(mapped.Features) != len(world.Features) {
+		t.Fatalf("%d map features, %d world features", len(mapped.Features), len(world.Features))
+	}
+	for i := range mapped.Features {
+		var a, b interface{}
+		json.Unmarshal(mapped.Features[i].Geometry.Coordinates, &a)
+		json.Unmarshal(world.Features[i].Geometry.Coordinates, &b)
+		if !scale(a, b) {
+			t.Errorf("feature %v: map %v, world %v", mapped.Features[i].ID, a, b)
+		}
+	}
+}
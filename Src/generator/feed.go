@@ -0,0 +1,134 @@
+package generator
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Change is a single live map delta pushed to stream subscribers.
+type Change struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+	js   []byte
+}
+
+// JSON returns the encoded change.
+func (c *Change) JSON() []byte {
+	return c.js
+}
+
+// TribeRename is published when a tribe changes its name.
+type TribeRename struct {
+	TribeID      string `json:"TribeId"`
+	TribeName    string `json:"TribeName"`
+	PreviousName string `json:"PreviousName"`
+}
+
+// Feed keeps a bounded history of changes so reconnecting clients can resume
+// from the last change they received.
+type Feed struct {
+	lock        sync.Mutex
+	nextID      uint64
+	history     []*Change // ring buffer
+	start       int
+	count       int
+	subscribers map[chan struct{}]bool
+}
+
+// NewFeed returns a feed remembering up to size changes.
+func NewFeed(size int) *Feed {
+	if size <= 0 {
+		size = 1
+	}
+	return &Feed{
+		nextID:      1,
+		history:     make([]*Change, size),
+		subscribers: make(map[chan struct{}]bool),
+	}
+}
+
+// Publish appends a change and wakes up all subscribers.
+func (f *Feed) Publish(changeType string, data interface{}) {
+	change := &Change{
+		Type: changeType,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	change.ID = f.nextID
+	js, err := json.Marshal(change)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	change.js = js
+	f.nextID++
+
+	if f.count < len(f.history) {
+		f.history[(f.start+f.count)%len(f.history)] = change
+		f.count++
+	} else {
+		f.history[f.start] = change
+		f.start = (f.start + 1) % len(f.history)
+	}
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// LastID returns the ID of the most recent change, or 0 if there is none.
+func (f *Feed) LastID() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.nextID - 1
+}
+
+// Since returns every change after the given ID. The bool is false when
+// changes after that ID have already been dropped from the history and the
+// client has to refetch the full snapshots.
+func (f *Feed) Since(id uint64) ([]*Change, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	last := f.nextID - 1
+	if id == last {
+		return nil, true
+	}
+	if id > last || id+1 < f.history[f.start].ID {
+		return nil, false
+	}
+
+	skip := int(id + 1 - f.history[f.start].ID)
+	changes := make([]*Change, 0, f.count-skip)
+	for i := skip; i < f.count; i++ {
+		changes = append(changes, f.history[(f.start+i)%len(f.history)])
+	}
+	return changes, true
+}
+
+// Subscribe returns a channel signalled whenever a change is published and a
+// function to unsubscribe.
+func (f *Feed) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	f.lock.Lock()
+	f.subscribers[ch] = true
+	f.lock.Unlock()
+
+	return ch, func() {
+		f.lock.Lock()
+		delete(f.subscribers, ch)
+		f.lock.Unlock()
+	}
+}
@@ -0,0 +1,77 @@
+package generator
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFeedSince(t *testing.T) {
+	ids := func(changes []*Change) []uint64 {
+		ids := make([]uint64, 0, len(changes))
+		for _, c := range changes {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+
+	empty := NewFeed(4)
+	if changes, ok := empty.Since(0); !ok || len(changes) != 0 {
+		t.Errorf("empty Since(0) = %v %v, want nothing and ok", ids(changes), ok)
+	}
+	if changes, ok := empty.Since(3); ok || len(changes) != 0 {
+		t.Errorf("empty Since(3) = %v %v, want a resync", ids(changes), ok)
+	}
+
+	// seven changes through a ring of four leaves 4..7
+	f := NewFeed(4)
+	for i := 0; i < 7; i++ {
+		f.Publish("test", i)
+	}
+	if got := f.LastID(); got != 7 {
+		t.Fatalf("LastID() = %d, want 7", got)
+	}
+	for _, c := range []struct {
+		since uint64
+		want  []uint64
+		ok    bool
+	}{
+		{0, []uint64{}, false},
+		{2, []uint64{}, false},
+		{3, []uint64{4, 5, 6, 7}, true},
+		{5, []uint64{6, 7}, true},
+		{6, []uint64{7}, true},
+		{7, []uint64{}, true},
+		{8, []uint64{}, false},
+	} {
+		changes, ok := f.Since(c.since)
+		if got := ids(changes); ok != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Since(%d) = %v %v, want %v %v", c.since, got, ok, c.want, c.ok)
+		}
+	}
+
+	// every returned change carries its encoded form
+	changes, _ := f.Since(6)
+	if want := `{"id":7,"type":"test","time":` + strconv.FormatInt(changes[0].Time, 10) + `,"data":6}`; string(changes[0].JSON()) != want {
+		t.Errorf("JSON() = %s, want %s", changes[0].JSON(), want)
+	}
+}
+
+func TestFeedSubscribe(t *testing.T) {
+	f := NewFeed(1)
+	ch, unsubscribe := f.Subscribe()
+	f.Publish("test", nil)
+	f.Publish("test", nil)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("subscriber not signalled")
+	}
+	unsubscribe()
+	f.Publish("test", nil)
+	select {
+	case <-ch:
+		t.Error("unsubscribed channel signalled")
+	default:
+	}
+}
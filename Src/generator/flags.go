@@ -0,0 +1,283 @@
+package generator
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// largest flag accepted from the game, in bytes and pixels
+	maxFlagBytes = 1 << 20
+	maxFlagSide  = 2048
+	// number of rejected flags remembered so they are not decoded again
+	maxBadFlags = 1024
+)
+
+// ErrNoFlag is returned for tribes without a flag in redis.
+var ErrNoFlag = errors.New("no tribe flag")
+
+// ErrBadFlag is returned for flags that already failed validation.
+var ErrBadFlag = errors.New("bad tribe flag")
+
+type flagEntry struct {
+	hash string
+	png  []byte // nil when the flag is a file
+}
+
+// FlagStore keeps validated tribe flags addressed by the hash of their
+// content, either as files in a directory or in memory, dropping the least
+// recently used flags beyond its capacity.
+type FlagStore struct {
+	dir      string
+	size     int
+	capacity int
+	lock     sync.Mutex
+	tribes   map[uint64]string // current flag hash of each tribe
+	lru      *list.List
+	entries  map[string]*list.Element
+	bad      map[string]bool // hashes of the flags that failed validation
+}
+
+// NewFlagStore returns a store writing to dir, or keeping flags in memory
+// when dir is blank. Up to capacity flags are kept either way, zero or
+// negative keeps all of them. Flags are resized to size pixels square, zero
+// keeps their size.
+func NewFlagStore(dir string, size int, capacity int) (*FlagStore, error) {
+	f := &FlagStore{
+		dir:      dir,
+		size:     size,
+		capacity: capacity,
+		tribes:   make(map[uint64]string),
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		bad:      make(map[string]bool),
+	}
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := f.scan(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// scan adds the flag files left by an earlier run to the store, the most
+// recently written first, and removes the ones beyond its capacity.
+func (f *FlagStore) scan() error {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || filepath.Ext(name) != ".png" {
+			continue
+		}
+		hash := strings.TrimSuffix(name, ".png")
+		f.entries[hash] = f.lru.PushFront(&flagEntry{hash: hash})
+	}
+	f.evict()
+	return nil
+}
+
+// Put validates and stores a tribe's flag and returns its content hash.
+func (f *FlagStore) Put(tribeID uint64, data []byte) (string, error) {
+	raw := flagHash(data)
+	f.lock.Lock()
+	bad := f.bad[raw]
+	f.lock.Unlock()
+	if bad {
+		return "", ErrBadFlag
+	}
+	encoded, err := f.normalize(data)
+	if err != nil {
+		f.lock.Lock()
+		if len(f.bad) >= maxBadFlags {
+			f.bad = make(map[string]bool)
+		}
+		f.bad[raw] = true
+		f.lock.Unlock()
+		return "", fmt.Errorf("tribe %d flag: %v", tribeID, err)
+	}
+	hash := flagHash(encoded)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if e, found := f.entries[hash]; found {
+		f.lru.MoveToFront(e)
+	} else {
+		entry := &flagEntry{hash: hash}
+		if len(f.dir) > 0 {
+			// written aside first so readers never see part of a flag
+			file := filepath.Join(f.dir, hash+".png")
+			if err := ioutil.WriteFile(file+".tmp", encoded, 0644); err != nil {
+				return "", err
+			}
+			if err := os.Rename(file+".tmp", file); err != nil {
+				return "", err
+			}
+		} else {
+			entry.png = encoded
+		}
+		f.entries[hash] = f.lru.PushFront(entry)
+		f.evict()
+	}
+	f.tribes[tribeID] = hash
+	return hash, nil
+}
+
+// evict drops the least recently used flags beyond the store's capacity,
+// removing their files.
+func (f *FlagStore) evict() {
+	for f.capacity > 0 && f.lru.Len() > f.capacity {
+		oldest := f.lru.Remove(f.lru.Back()).(*flagEntry)
+		delete(f.entries, oldest.hash)
+		if len(f.dir) > 0 {
+			if err := os.Remove(filepath.Join(f.dir, oldest.hash+".png")); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Get returns a tribe's flag and its content hash.
+func (f *FlagStore) Get(tribeID uint64) (string, []byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	hash, found := f.tribes[tribeID]
+	if !found {
+		return "", nil, false
+	}
+	e, found := f.entries[hash]
+	if !found {
+		delete(f.tribes, tribeID)
+		return "", nil, false
+	}
+	data := e.Value.(*flagEntry).png
+	if len(f.dir) > 0 {
+		var err error
+		if data, err = ioutil.ReadFile(filepath.Join(f.dir, hash+".png")); err != nil {
+			delete(f.tribes, tribeID)
+			return "", nil, false
+		}
+	}
+	f.lru.MoveToFront(e)
+	return hash, data, true
+}
+
+// Fetch returns a tribe's flag, loading it from its tribeflag: key in redis
+// when it is not in the store. Flags that fail validation are logged once
+// and answered with ErrNoFlag.
+func (f *FlagStore) Fetch(client flagGetter, tribeID uint64) (string, []byte, error) {
+	if hash, data, found := f.Get(tribeID); found {
+		return hash, data, nil
+	}
+	data, err := client.Get("tribeflag:" + strconv.FormatUint(tribeID, 10)).Bytes()
+	if err == redis.Nil || (err == nil && len(data) == 0) {
+		return "", nil, ErrNoFlag
+	} else if err != nil {
+		return "", nil, err
+	}
+	if _, err := f.Put(tribeID, data); err == ErrBadFlag {
+		return "", nil, ErrNoFlag
+	} else if err != nil {
+		f.lock.Lock()
+		bad := f.bad[flagHash(data)]
+		f.lock.Unlock()
+		if bad {
+			log.Println(err)
+			return "", nil, ErrNoFlag
+		}
+		return "", nil, err
+	}
+	hash, data, found := f.Get(tribeID)
+	if !found {
+		return "", nil, ErrNoFlag
+	}
+	return hash, data, nil
+}
+
+type flagGetter interface {
+	Get(key string) *redis.StringCmd
+}
+
+func flagHash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalize checks that data is a sane PNG and re-encodes it at the store's
+// size, dropping any extra chunks.
+func (f *FlagStore) normalize(data []byte) ([]byte, error) {
+	if len(data) > maxFlagBytes {
+		return nil, fmt.Errorf("%d bytes is too large", len(data))
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxFlagSide || config.Height > maxFlagSide {
+		return nil, fmt.Errorf("bad size %dx%d", config.Width, config.Height)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if f.size > 0 && (config.Width != f.size || config.Height != f.size) {
+		img = resizeImage(img, f.size, f.size)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeImage scales an image to width by height pixels, averaging the source
+// pixels covered by each target pixel.
+func resizeImage(src image.Image, width, height int) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + Max((y+1)*b.Dy()/height, y*b.Dy()/height+1)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + Max((x+1)*b.Dx()/width, x*b.Dx()/width+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// premultiplied, so transparent pixels do not bleed
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			c := color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)}
+			dst.Set(x, y, c)
+		}
+	}
+	return dst
+}
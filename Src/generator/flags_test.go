@@ -0,0 +1,176 @@
+package generator
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// testFlag returns a PNG of a single color.
+func testFlag(t *testing.T, shade uint8) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = shade, 0, 0, 255
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func flagFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestFlagStoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flags, err := NewFlagStore(dir, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[uint64]string)
+	for tribe := uint64(1); tribe <= 2; tribe++ {
+		if hashes[tribe], err = flags.Put(tribe, testFlag(t, uint8(tribe))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// tribe 1 is used again, so tribe 2 is the least recently used
+	if hash, _, found := flags.Get(1); !found || hash != hashes[1] {
+		t.Fatalf("Get(1) = %s, %v, want %s", hash, found, hashes[1])
+	}
+	if hashes[3], err = flags.Put(3, testFlag(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{hashes[1] + ".png", hashes[3] + ".png"}
+	sort.Strings(want)
+	if got := flagFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("flag files = %v, want %v", got, want)
+	}
+	if _, _, found := flags.Get(2); found {
+		t.Errorf("Get(2) found an evicted flag")
+	}
+
+	// a tribe with the same flag shares the file
+	if hash, err := flags.Put(4, testFlag(t, 3)); err != nil || hash != hashes[3] {
+		t.Errorf("Put(4) = %s, %v, want %s", hash, err, hashes[3])
+	}
+	if got := flagFiles(t, dir); len(got) != 2 {
+		t.Errorf("flag files = %v, want 2", got)
+	}
+
+	// a restart keeps the most recently written files up to the capacity
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, hashes[1]+".png"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFlagStore(dir, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := flagFiles(t, dir); !reflect.DeepEqual(got, []string{hashes[3] + ".png"}) {
+		t.Errorf("flag files after a restart = %v, want %s.png", got, hashes[3])
+	}
+}
+
+func TestFlagStoreMemory(t *testing.T) {
+	flags, err := NewFlagStore("", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tribe := uint64(1); tribe <= 3; tribe++ {
+		if _, err := flags.Put(tribe, testFlag(t, uint8(tribe))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, found := flags.Get(1); found {
+		t.Errorf("Get(1) found an evicted flag")
+	}
+	_, data, found := flags.Get(3)
+	if !found {
+		t.Fatalf("Get(3) did not find the flag")
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Errorf("flag is %dx%d, want it resized to 2x2", b.Dx(), b.Dy())
+	}
+	if got := color.NRGBAModel.Convert(img.At(1, 1)).(color.NRGBA); got != (color.NRGBA{3, 0, 0, 255}) {
+		t.Errorf("resized flag color = %v", got)
+	}
+}
+
+type fakeFlagGetter struct {
+	keys  map[string][]byte
+	calls int
+}
+
+func (f *fakeFlagGetter) Get(key string) *redis.StringCmd {
+	f.calls++
+	data, found := f.keys[key]
+	if !found {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(string(data), nil)
+}
+
+func TestFlagStoreFetch(t *testing.T) {
+	flags, err := NewFlagStore("", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeFlagGetter{keys: map[string][]byte{
+		"tribeflag:1": testFlag(t, 1),
+		"tribeflag:2": []byte("not a png"),
+		"tribeflag:3": {},
+	}}
+
+	hash, data, err := flags.Fetch(client, 1)
+	if err != nil || len(data) == 0 || hash != flagHash(data) {
+		t.Fatalf("Fetch(1) = %s, %d bytes, %v", hash, len(data), err)
+	}
+	// stored flags are not fetched again
+	if _, _, err := flags.Fetch(client, 1); err != nil || client.calls != 1 {
+		t.Errorf("second Fetch(1) = %v after %d calls, want 1 call", err, client.calls)
+	}
+
+	for _, tribe := range []uint64{2, 3, 4} {
+		if _, _, err := flags.Fetch(client, tribe); err != ErrNoFlag {
+			t.Errorf("Fetch(%d) error = %v, want %v", tribe, err, ErrNoFlag)
+		}
+	}
+	// the broken flag is remembered instead of decoded again
+	if !flags.bad[flagHash([]byte("not a png"))] {
+		t.Errorf("broken flag not remembered")
+	}
+	if _, err := flags.Put(2, []byte("not a png")); err != ErrBadFlag {
+		t.Errorf("Put() of the broken flag = %v, want %v", err, ErrBadFlag)
+	}
+	if _, _, err := flags.Fetch(client, 2); err != ErrNoFlag {
+		t.Errorf("second Fetch(2) error = %v, want %v", err, ErrNoFlag)
+	}
+}
@@ -0,0 +1,70 @@
+package generator
+
+import (
+	"math"
+)
+
+// rotatedRect returns the corners of a width by height rectangle centered on
+// x, y and rotated clockwise by rotation degrees, the way the game places
+// islands and discovery zones. With y growing downwards the corners are in
+// clockwise order.
+func rotatedRect(x, y, width, height, rotation float64) [][2]float64 {
+	cos, sin := direction(rotation)
+	w, h := width/2, height/2
+	corners := [4][2]float64{{-w, -h}, {w, -h}, {w, h}, {-w, h}}
+	polygon := make([][2]float64, len(corners))
+	for i, c := range corners {
+		polygon[i] = [2]float64{x + c[0]*cos - c[1]*sin, y + c[0]*sin + c[1]*cos}
+	}
+	return polygon
+}
+
+// polygonBounds returns the bounding box of a polygon.
+func polygonBounds(polygon [][2]float64) Bounds {
+	b := Bounds{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range polygon {
+		b.MinX = math.Min(b.MinX, p[0])
+		b.MinY = math.Min(b.MinY, p[1])
+		b.MaxX = math.Max(b.MaxX, p[0])
+		b.MaxY = math.Max(b.MaxY, p[1])
+	}
+	return b
+}
+
+// polygonDistance returns the distance from a point to the edge of a
+// polygon, or 0 if the point is inside.
+func polygonDistance(polygon [][2]float64, x, y float64) float64 {
+	inside := false
+	distance := math.Inf(1)
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i+1)%len(polygon)]
+		if (a[1] > y) != (b[1] > y) && x < a[0]+(y-a[1])*(b[0]-a[0])/(b[1]-a[1]) {
+			inside = !inside
+		}
+		distance = math.Min(distance, segmentDistance(a, b, x, y))
+	}
+	if inside {
+		return 0
+	}
+	return distance
+}
+
+// segmentDistance returns the distance from a point to the segment a-b.
+func segmentDistance(a, b [2]float64, x, y float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, ((x-a[0])*dx+(y-a[1])*dy)/length))
+	}
+	return math.Hypot(a[0]+t*dx-x, a[1]+t*dy-y)
+}
+
+// Footprint returns the island's rotated rectangle in map coordinates.
+func (i *GridIslandOutput) Footprint() [][2]float64 {
+	return rotatedRect(i.X, i.Y, i.Width, i.Height, i.Rotation)
+}
+
+// Footprint returns the zone's rotated rectangle in map coordinates.
+func (z *GridDiscoZoneOutput) Footprint() [][2]float64 {
+	return rotatedRect(z.X, z.Y, z.SizeX, z.SizeY, z.Rotation)
+}
@@ -2,6 +2,7 @@ package generator
 
 import (
 	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
 	"image/color"
 	"log"
 	"sync"
@@ -10,18 +11,6 @@ import (
 	"github.com/go-redis/redis"
 )
 
-var colors = [...]string{
-	"lime",
-	"blue",
-	"yellow",
-	"fuchsia",
-	"aqua",
-	"maroon",
-	"red",
-	"olive",
-	"purple",
-	"teal",
-}
 var colorValues = map[string]color.NRGBA{
 	"red":      color.NRGBA{0xff, 0x00, 0x00, 0xff},
 	"green":    color.NRGBA{0x00, 0x80, 0x00, 0xff},
@@ -62,10 +51,16 @@ func Max(x, y int) int {
 }
 
 // ProcessColony runs in a loop processing island info from database
-func ProcessColony(tribeDB *redis.Client, territoryDB *redis.Client, gridConfig *atlas.GridConfig, config *Config, islandData *string, islandDataLock *sync.RWMutex) {
+func ProcessColony(tribeDB *redis.Client, territoryDB *redis.Client, gridConfig *atlas.GridConfig, config *Config, store *SnapshotStore, feed *Feed, history *History, events *EventLog, territory *TerritoryRenderer, colors *TribeColors, tribes *TribeFlags, ranker Ranker) {
+	grid := coords.New(gridConfig)
 	previousCrc := uint32(1)
+	previous := history.LatestIslands()
+	var rendering sync.WaitGroup
 
 	for {
+		// flags still rendering for the last round would overwrite the islands
+		rendering.Wait()
+
 		log.Println("Getting island claims")
 		counts, crc, err := fetchIslandClaims(territoryDB, gridConfig)
 		if err != nil {
@@ -75,20 +70,51 @@ func ProcessColony(tribeDB *redis.Client, territoryDB *redis.Client, gridConfig
 		} else {
 			previousCrc = crc
 
-			log.Println("Finding top 5 tribes from claims")
-			top := TopNTribes(5, counts)
-			for i := 0; i < len(top); i++ {
-				tribe := (*counts)[top[i]]
-				color := colorValues[colors[i]]
-				for _, island := range tribe.islands {
-					island.Color = color
-					island.ColorName = colors[i]
-				}
+			log.Println("Assigning tribe colors")
+			if err := colors.Assign(counts); err != nil {
+				log.Println(err)
 			}
 
 			log.Println("Generating island data")
-			virtualPixels := int(gridConfig.GridSize) * Max(gridConfig.TotalGridsX, gridConfig.TotalGridsY)
-			generateIslandData(counts, virtualPixels, islandData, islandDataLock)
+			output := generateIslandData(counts, grid)
+
+			var top []uint64
+			if tribes != nil {
+				log.Printf("Updating top %d tribes by %s", config.LeaderboardSize, ranker.Name())
+				top = Rank(ranker, output, events, config.LeaderboardSize, time.Now()).TopTribes()
+				tribes.Update(top, counts)
+				// again with the names and flags found
+				output = generateIslandData(counts, grid)
+			}
+			if err := store.SetIslands(output); err != nil {
+				log.Println(err)
+			}
+			if tribes != nil && config.TribeWriteBack {
+				// the game renders new flags in the background, then the
+				// islands are set again with them
+				rendering.Add(1)
+				go func(top []uint64, counts *map[uint64]*TribeCount) {
+					defer rendering.Done()
+					tribes.RenderFlags(top)
+					tribes.Update(top, counts)
+					if err := store.SetIslands(generateIslandData(counts, grid)); err != nil {
+						log.Println(err)
+					}
+				}(top, counts)
+			}
+			if territory != nil {
+				territory.Update(crc, counts, grid)
+			}
+			history.RecordIslands(output)
+			if previous != nil {
+				changes := diffIslands(previous, output)
+				events.Add(changes)
+				for _, e := range changes {
+					feed.Publish(e.Type, e)
+				}
+				log.Printf("%d colony events", len(changes))
+			}
+			previous = output
 		}
 
 		log.Println("Done, waiting till next round")
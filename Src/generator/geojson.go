@@ -0,0 +1,42 @@
+package generator
+
+// GeoJSONGeometry is a GeoJSON geometry object.
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// GeoJSONFeature is a GeoJSON feature object.
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id,omitempty"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONFeatureCollection is a GeoJSON feature collection object.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// NewFeature returns a feature with the given geometry and no properties.
+func NewFeature(id interface{}, geometryType string, coordinates interface{}) GeoJSONFeature {
+	return GeoJSONFeature{
+		Type: "Feature",
+		ID:   id,
+		Geometry: GeoJSONGeometry{
+			Type:        geometryType,
+			Coordinates: coordinates,
+		},
+		Properties: make(map[string]interface{}),
+	}
+}
+
+// NewFeatureCollection returns an empty feature collection.
+func NewFeatureCollection() *GeoJSONFeatureCollection {
+	return &GeoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]GeoJSONFeature, 0),
+	}
+}
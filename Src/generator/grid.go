@@ -0,0 +1,174 @@
+package generator
+
+import (
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+// GridServerOutput describes one server cell. Bounds are map coordinates as
+// [minX, minY, maxX, maxY].
+type GridServerOutput struct {
+	ServerID     uint32     `json:"ServerId"`
+	Name         string     `json:"Name"`
+	Cell         string     `json:"Cell"`
+	GridX        int        `json:"GridX"`
+	GridY        int        `json:"GridY"`
+	IsHomeServer bool       `json:"IsHomeServer"`
+	UtcOffset    int        `json:"UtcOffset"`
+	TemplateName string     `json:"TemplateName"`
+	Bounds       [4]float64 `json:"Bounds"`
+}
+
+// GridOutput json for front-end consumption describing the cluster layout.
+type GridOutput struct {
+	MapInfo
+	Servers []GridServerOutput `json:"Servers"`
+}
+
+// GridIslandOutput is the footprint of an island instance in map coordinates.
+// Rotation is in degrees.
+type GridIslandOutput struct {
+	IslandID     int     `json:"IslandID"`
+	Name         string  `json:"Name"`
+	ServerID     uint32  `json:"ServerId"`
+	X            float64 `json:"X"`
+	Y            float64 `json:"Y"`
+	Width        float64 `json:"Width"`
+	Height       float64 `json:"Height"`
+	Rotation     float64 `json:"Rotation"`
+	IslandPoints int     `json:"IslandPoints"`
+}
+
+// GridDiscoZoneOutput is a discovery zone in map coordinates. Rotation is in
+// degrees.
+type GridDiscoZoneOutput struct {
+	ID                int     `json:"ID"`
+	Name              string  `json:"Name"`
+	ServerID          uint32  `json:"ServerId"`
+	X                 float64 `json:"X"`
+	Y                 float64 `json:"Y"`
+	SizeX             float64 `json:"SizeX"`
+	SizeY             float64 `json:"SizeY"`
+	Rotation          float64 `json:"Rotation"`
+	Xp                float64 `json:"Xp"`
+	AllowSea          bool    `json:"AllowSea"`
+	ExplorerNoteIndex int     `json:"ExplorerNoteIndex"`
+}
+
+// GridShipPathNodeOutput is a ship path spline point in map coordinates.
+type GridShipPathNodeOutput struct {
+	X                     float64 `json:"X"`
+	Y                     float64 `json:"Y"`
+	Rotation              float64 `json:"Rotation"`
+	ControlPointsDistance float64 `json:"ControlPointsDistance"`
+}
+
+// GridShipPathOutput is a ship path in map coordinates.
+type GridShipPathOutput struct {
+	PathID                    int                      `json:"PathID"`
+	PathName                  string                   `json:"PathName"`
+	IsLooping                 bool                     `json:"IsLooping"`
+	AutoSpawn                 bool                     `json:"AutoSpawn"`
+	AutoSpawnShipClass        string                   `json:"AutoSpawnShipClass"`
+	AutoSpawnEveryUTCInterval float64                  `json:"AutoSpawnEveryUTCInterval"`
+	Nodes                     []GridShipPathNodeOutput `json:"Nodes"`
+}
+
+// GridData holds everything served under /grid, converted once at startup.
+type GridData struct {
+	Layout     GridOutput
+	Islands    []GridIslandOutput
+	DiscoZones []GridDiscoZoneOutput
+	ShipPaths  []GridShipPathOutput
+}
+
+// NewGridData converts a ServerGrid.json config to map coordinates.
+func NewGridData(gridConfig *atlas.GridConfig) *GridData {
+	grid := coords.New(gridConfig)
+	data := &GridData{
+		Layout: GridOutput{
+			MapInfo: NewMapInfo(grid),
+			Servers: make([]GridServerOutput, 0, len(gridConfig.Servers)),
+		},
+		Islands:    make([]GridIslandOutput, 0, len(gridConfig.Islands)),
+		DiscoZones: make([]GridDiscoZoneOutput, 0),
+		ShipPaths:  make([]GridShipPathOutput, 0, len(gridConfig.ShipPaths)),
+	}
+
+	for i := range gridConfig.Servers {
+		server := &gridConfig.Servers[i]
+		serverID := coords.Pack(uint16(server.GridX), uint16(server.GridY))
+		minX, minY := grid.WorldToMap(grid.ServerToWorld(server.GridX, server.GridY, 0, 0))
+		maxX, maxY := grid.WorldToMap(grid.ServerToWorld(server.GridX, server.GridY, 1, 1))
+		data.Layout.Servers = append(data.Layout.Servers, GridServerOutput{
+			ServerID:     serverID,
+			Name:         server.Name,
+			Cell:         coords.CellName(server.GridX, server.GridY),
+			GridX:        server.GridX,
+			GridY:        server.GridY,
+			IsHomeServer: server.IsHomeServer,
+			UtcOffset:    server.UtcOffset,
+			TemplateName: server.ServerTemplateName,
+			Bounds:       [4]float64{minX, minY, maxX, maxY},
+		})
+
+		for j := range server.IslandInstances {
+			island := &server.IslandInstances[j]
+			x, y := grid.WorldToMap(island.WorldX, island.WorldY)
+			data.Islands = append(data.Islands, GridIslandOutput{
+				IslandID:     island.ID,
+				Name:         island.Name,
+				ServerID:     serverID,
+				X:            x,
+				Y:            y,
+				Width:        grid.WorldToMapDistance(island.IslandWidth),
+				Height:       grid.WorldToMapDistance(island.IslandHeight),
+				Rotation:     island.Rotation,
+				IslandPoints: island.IslandPoints,
+			})
+		}
+
+		for j := range server.DiscoZones {
+			zone := &server.DiscoZones[j]
+			x, y := grid.WorldToMap(zone.WorldX, zone.WorldY)
+			data.DiscoZones = append(data.DiscoZones, GridDiscoZoneOutput{
+				ID:                zone.ID,
+				Name:              zone.Name,
+				ServerID:          serverID,
+				X:                 x,
+				Y:                 y,
+				SizeX:             grid.WorldToMapDistance(zone.SizeX),
+				SizeY:             grid.WorldToMapDistance(zone.SizeY),
+				Rotation:          zone.Rotation,
+				Xp:                zone.Xp,
+				AllowSea:          zone.AllowSea,
+				ExplorerNoteIndex: zone.ExplorerNoteIndex,
+			})
+		}
+	}
+
+	for i := range gridConfig.ShipPaths {
+		path := &gridConfig.ShipPaths[i]
+		pathOut := GridShipPathOutput{
+			PathID:                    path.PathID,
+			PathName:                  path.PathName,
+			IsLooping:                 path.IsLooping,
+			AutoSpawn:                 path.AutoSpawn,
+			AutoSpawnShipClass:        path.AutoSpawnShipClass,
+			AutoSpawnEveryUTCInterval: path.AutoSpawnEveryUTCInterval,
+			Nodes:                     make([]GridShipPathNodeOutput, 0, len(path.Nodes)),
+		}
+		for _, node := range path.Nodes {
+			x, y := grid.WorldToMap(node.WorldX, node.WorldY)
+			pathOut.Nodes = append(pathOut.Nodes, GridShipPathNodeOutput{
+				X:                     x,
+				Y:                     y,
+				Rotation:              node.Rotation,
+				ControlPointsDistance: grid.WorldToMapDistance(node.ControlPointsDistance),
+			})
+		}
+		data.ShipPaths = append(data.ShipPaths, pathOut)
+	}
+
+	return data
+}
@@ -8,9 +8,9 @@ import (
 	"strings"
 	"hash/crc32"
 	"log"
-	"sync"
 
 	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
 
 	"github.com/go-redis/redis"
 )
@@ -28,7 +28,9 @@ type IslandClaim struct {
 	NumSettlers                    int         `json:"numSettlers"`
 	X                              float64     `json:"-"`
 	Y                              float64     `json:"-"`
-	Radius                         float64     `json:"-"`
+	Width                          float64     `json:"-"`
+	Height                         float64     `json:"-"`
+	Rotation                       float64     `json:"-"`
 	Color                          color.NRGBA `json:"-"`
 	ColorName                      string      `json:"-"`
 	IslandPoints                   int         `json:"-"`
@@ -37,6 +39,20 @@ type IslandClaim struct {
 	WarEndUTC                      uint32      `json:"-"`
 }
 
+// Footprint returns the island's rotated rectangle in world units.
+func (c *IslandClaim) Footprint() [][2]float64 {
+	return rotatedRect(c.X, c.Y, c.Width, c.Height, c.Rotation)
+}
+
+// MapFootprint returns the island's rotated rectangle in map coordinates.
+func (c *IslandClaim) MapFootprint(grid coords.Grid) [][2]float64 {
+	polygon := c.Footprint()
+	for i, p := range polygon {
+		polygon[i][0], polygon[i][1] = grid.WorldToMap(p[0], p[1])
+	}
+	return polygon
+}
+
 // WarDeclaration represents json stored in Redis for war declarations
 type WarDeclaration struct {
 	IslandID       int    `json:"islandId"`
@@ -47,50 +63,60 @@ type WarDeclaration struct {
 
 // IslandInfoOutput json for front-end consumption
 type IslandInfoOutput struct {
-	IslandID             int     `json:"IslandID"`
-	X                    float64 `json:"X"`
-	Y                    float64 `json:"Y"`
-	Size                 float64 `json:"Size"`
-	TribeID              uint64  `json:"TribeId"`
-	Color                string  `json:"Color"`
-	IslandPoints         int     `json:"IslandPoints"`
-	SettlementName       string  `json:"SettlementName"`
-	TaxRate              float64 `json:"TaxRate"`
-	CombatPhaseStartTime int     `json:"CombatPhaseStartTime"`
-	WarringTribeID       uint64  `json:"WarringTribeID"`
-	WarStartUTC          uint32  `json:"WarStartUTC"`
-	WarEndUTC            uint32  `json:"WarEndUTC"`
-	NumSettlers          int     `json:"NumSettlers"`
+	IslandID             int          `json:"IslandID"`
+	X                    float64      `json:"X"`
+	Y                    float64      `json:"Y"`
+	Size                 float64      `json:"Size"` // approximate radius, kept for older clients
+	Footprint            [][2]float64 `json:"Footprint"`
+	TribeID              uint64       `json:"TribeId"`
+	Color                string       `json:"Color"`
+	IslandPoints         int          `json:"IslandPoints"`
+	SettlementName       string       `json:"SettlementName"`
+	TaxRate              float64      `json:"TaxRate"`
+	CombatPhaseStartTime int          `json:"CombatPhaseStartTime"`
+	WarringTribeID       uint64       `json:"WarringTribeID"`
+	WarStartUTC          uint32       `json:"WarStartUTC"`
+	WarEndUTC            uint32       `json:"WarEndUTC"`
+	NumSettlers          int          `json:"NumSettlers"`
 }
 
 // CompanyInfoOutput json for front-end consumption
 type CompanyInfoOutput struct {
 	TribeID   uint64  `json:"TribeId"`
 	TribeName string  `json:"TribeName"`
+	Color     string  `json:"Color"`
 	FlagURL   *string `json:"FlagURL"`
 }
 
-// IslandOutput json for front-end consumption
+// IslandOutput json for front-end consumption. Island positions and sizes are
+// in map coordinates, i.e. world units divided by the longest side of the
+// world.
 type IslandOutput struct {
-	Version   int64               `json:"version"`
-	Islands   []IslandInfoOutput  `json:"Islands"`
-	Companies []CompanyInfoOutput `json:"Companies"`
+	Version     int64               `json:"version"`
+	WorldWidth  float64             `json:"WorldWidth"`
+	WorldHeight float64             `json:"WorldHeight"`
+	Islands     []IslandInfoOutput  `json:"Islands"`
+	Companies   []CompanyInfoOutput `json:"Companies"`
 }
 
-func generateIslandData(tribes *map[uint64]*TribeCount, virtualPixels int, islandData *string, islandDataLock *sync.RWMutex) {
+func generateIslandData(tribes *map[uint64]*TribeCount, grid coords.Grid) *IslandOutput {
 	output := IslandOutput{
-		Version:   time.Now().Unix(),
-		Islands:   make([]IslandInfoOutput, 0),
-		Companies: make([]CompanyInfoOutput, 0),
+		Version:     time.Now().Unix(),
+		WorldWidth:  grid.Width(),
+		WorldHeight: grid.Height(),
+		Islands:     make([]IslandInfoOutput, 0),
+		Companies:   make([]CompanyInfoOutput, 0),
 	}
 	for _, tribe := range *tribes {
 		for _, island := range tribe.islands {
+			x, y := grid.WorldToMap(island.X, island.Y)
 			islandOut := IslandInfoOutput{
 				IslandID:             island.IslandID,
-				X:                    island.X / float64(virtualPixels),
-				Y:                    island.Y / float64(virtualPixels),
+				X:                    x,
+				Y:                    y,
 				TribeID:              island.OwnerTribeID,
-				Size:                 island.Radius / float64(virtualPixels),
+				Size:                 grid.WorldToMapDistance((island.Width + island.Height) / 4),
+				Footprint:            island.MapFootprint(grid),
 				Color:                island.ColorName,
 				IslandPoints:         island.IslandPoints,
 				SettlementName:       island.SettlementFlagName,
@@ -109,16 +135,13 @@ func generateIslandData(tribes *map[uint64]*TribeCount, virtualPixels int, islan
 		companyOut := CompanyInfoOutput{
 			TribeID:   tribe.tribeID,
 			TribeName: tribe.name,
+			Color:     tribe.color,
 			FlagURL:   tribe.flagURL,
 		}
 		output.Companies = append(output.Companies, companyOut)
 	}
 
-	// save off the json
-	js, _ := json.Marshal(output)
-	islandDataLock.Lock()
-	*islandData = string(js)
-	islandDataLock.Unlock()
+	return &output
 }
 
 func fixBadString(s string) string {
@@ -213,7 +236,9 @@ func fetchIslandClaims(db *redis.Client, grid *atlas.GridConfig) (*map[uint64]*T
 		// add island position and default color
 		islandClaim.X = island.WorldX
 		islandClaim.Y = island.WorldY
-		islandClaim.Radius = (island.IslandWidth + island.IslandHeight) / 4
+		islandClaim.Width = island.IslandWidth
+		islandClaim.Height = island.IslandHeight
+		islandClaim.Rotation = island.Rotation
 		islandClaim.Color = grey
 		islandClaim.ColorName = "grey"
 		islandClaim.IslandPoints = island.IslandPoints
@@ -0,0 +1,32 @@
+package generator
+
+import (
+	"AtlasMapViewer/atlas/coords"
+)
+
+// MapInfo describes the extent of the world for front-end consumption. Map
+// coordinates are world units divided by the longest side, so on rectangular
+// grids only one of MapWidth and MapHeight is 1.
+type MapInfo struct {
+	ServersX    int     `json:"ServersX"`
+	ServersY    int     `json:"ServersY"`
+	GridSize    float64 `json:"GridSize"`
+	WorldWidth  float64 `json:"WorldWidth"`
+	WorldHeight float64 `json:"WorldHeight"`
+	MapWidth    float64 `json:"MapWidth"`
+	MapHeight   float64 `json:"MapHeight"`
+}
+
+// NewMapInfo returns the extent of the grid.
+func NewMapInfo(grid coords.Grid) MapInfo {
+	mapWidth, mapHeight := grid.WorldToMap(grid.Width(), grid.Height())
+	return MapInfo{
+		ServersX:    grid.CellsX,
+		ServersY:    grid.CellsY,
+		GridSize:    grid.CellSize,
+		WorldWidth:  grid.Width(),
+		WorldHeight: grid.Height(),
+		MapWidth:    mapWidth,
+		MapHeight:   mapHeight,
+	}
+}
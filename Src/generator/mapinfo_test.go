@@ -0,0 +1,200 @@
+package generator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+// gridTests are synthetic clusters of different aspect ratios.
+var gridTests = []struct {
+	name                string
+	cellsX, cellsY      int
+	cellSize            float64
+	mapWidth, mapHeight float64
+}{
+	{"square", 4, 4, 1400000, 1, 1},
+	{"wide", 12, 8, 1400000, 1, 8.0 / 12},
+	{"tall", 8, 12, 1400000, 8.0 / 12, 1},
+	{"strip", 5, 1, 700000, 1, 0.2},
+}
+
+// loadTestGrid writes a ServerGrid.json with one server per cell, each with an
+// island in its middle, and loads it back.
+func loadTestGrid(t *testing.T, cellsX, cellsY int, cellSize float64) *atlas.GridConfig {
+	type island struct {
+		Name         string  `json:"name"`
+		ID           int     `json:"id"`
+		IslandPoints int     `json:"islandPoints"`
+		IslandWidth  float64 `json:"islandWidth"`
+		IslandHeight float64 `json:"islandHeight"`
+		WorldX       float64 `json:"worldX"`
+		WorldY       float64 `json:"worldY"`
+	}
+	type server struct {
+		GridX           int      `json:"gridX"`
+		GridY           int      `json:"gridY"`
+		Name            string   `json:"name"`
+		IslandInstances []island `json:"islandInstances"`
+	}
+	grid := struct {
+		GridSize    float64  `json:"gridSize"`
+		TotalGridsX int      `json:"totalGridsX"`
+		TotalGridsY int      `json:"totalGridsY"`
+		Servers     []server `json:"servers"`
+	}{cellSize, cellsX, cellsY, nil}
+	for x := 0; x < cellsX; x++ {
+		for y := 0; y < cellsY; y++ {
+			grid.Servers = append(grid.Servers, server{
+				GridX: x,
+				GridY: y,
+				Name:  coords.CellName(x, y),
+				IslandInstances: []island{{
+					Name:         coords.CellName(x, y),
+					ID:           testIslandID(x, y),
+					IslandPoints: 10,
+					IslandWidth:  cellSize / 4,
+					IslandHeight: cellSize / 8,
+					WorldX:       (float64(x) + 0.5) * cellSize,
+					WorldY:       (float64(y) + 0.5) * cellSize,
+				}},
+			})
+		}
+	}
+
+	js, err := json.Marshal(grid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "grid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ServerGrid.json")
+	if err := ioutil.WriteFile(path, js, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := atlas.LoadGridConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func testIslandID(x, y int) int {
+	return x*100 + y + 1
+}
+
+func nearlyEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestMapInfo(t *testing.T) {
+	for _, c := range gridTests {
+		cfg := loadTestGrid(t, c.cellsX, c.cellsY, c.cellSize)
+		info := NewMapInfo(coords.New(cfg))
+		if info.ServersX != c.cellsX || info.ServersY != c.cellsY || info.GridSize != c.cellSize {
+			t.Errorf("%s: servers %dx%d of %v, want %dx%d of %v", c.name, info.ServersX, info.ServersY, info.GridSize, c.cellsX, c.cellsY, c.cellSize)
+		}
+		if info.WorldWidth != float64(c.cellsX)*c.cellSize || info.WorldHeight != float64(c.cellsY)*c.cellSize {
+			t.Errorf("%s: world %vx%v", c.name, info.WorldWidth, info.WorldHeight)
+		}
+		if !nearlyEqual(info.MapWidth, c.mapWidth) || !nearlyEqual(info.MapHeight, c.mapHeight) {
+			t.Errorf("%s: map %vx%v, want %vx%v", c.name, info.MapWidth, info.MapHeight, c.mapWidth, c.mapHeight)
+		}
+	}
+}
+
+func TestGridDataPositions(t *testing.T) {
+	for _, c := range gridTests {
+		cfg := loadTestGrid(t, c.cellsX, c.cellsY, c.cellSize)
+		data := NewGridData(cfg)
+		if len(data.Layout.Servers) != c.cellsX*c.cellsY || len(data.Islands) != c.cellsX*c.cellsY {
+			t.Fatalf("%s: %d servers and %d islands", c.name, len(data.Layout.Servers), len(data.Islands))
+		}
+
+		// a map unit is the longest side, so every cell is the same square
+		cell := 1 / math.Max(float64(c.cellsX), float64(c.cellsY))
+		for _, server := range data.Layout.Servers {
+			want := [4]float64{
+				float64(server.GridX) * cell,
+				float64(server.GridY) * cell,
+				float64(server.GridX+1) * cell,
+				float64(server.GridY+1) * cell,
+			}
+			for i := range want {
+				if !nearlyEqual(server.Bounds[i], want[i]) {
+					t.Errorf("%s: server %s bounds %v, want %v", c.name, server.Cell, server.Bounds, want)
+					break
+				}
+			}
+			if server.Bounds[2] > c.mapWidth+1e-9 || server.Bounds[3] > c.mapHeight+1e-9 {
+				t.Errorf("%s: server %s bounds %v outside the map", c.name, server.Cell, server.Bounds)
+			}
+		}
+		for _, island := range data.Islands {
+			x, y := island.IslandID/100, island.IslandID%100-1
+			if !nearlyEqual(island.X, (float64(x)+0.5)*cell) || !nearlyEqual(island.Y, (float64(y)+0.5)*cell) {
+				t.Errorf("%s: island in %s at %v, %v, want the middle of the cell", c.name, island.Name, island.X, island.Y)
+			}
+			if island.ServerID != coords.Pack(uint16(x), uint16(y)) {
+				t.Errorf("%s: island in %s on server %d", c.name, island.Name, island.ServerID)
+			}
+			if !nearlyEqual(island.Width, cell/4) || !nearlyEqual(island.Height, cell/8) {
+				t.Errorf("%s: island in %s is %vx%v", c.name, island.Name, island.Width, island.Height)
+			}
+		}
+	}
+}
+
+func TestIslandDataPositions(t *testing.T) {
+	for _, c := range gridTests {
+		cfg := loadTestGrid(t, c.cellsX, c.cellsY, c.cellSize)
+		// every island claimed by a tribe of its own, as fetchIslandClaims does
+		tribes := make(map[uint64]*TribeCount)
+		for id, island := range cfg.Islands {
+			claim := &IslandClaim{
+				IslandID:     id,
+				OwnerTribeID: uint64(id),
+				OwnerName:    island.Name,
+				X:            island.WorldX,
+				Y:            island.WorldY,
+				Width:        island.IslandWidth,
+				Height:       island.IslandHeight,
+				IslandPoints: island.IslandPoints,
+			}
+			tribes[uint64(id)] = &TribeCount{tribeID: uint64(id), count: island.IslandPoints, islands: []*IslandClaim{claim}}
+		}
+
+		output := generateIslandData(&tribes, coords.New(cfg))
+		if output.WorldWidth != float64(c.cellsX)*c.cellSize || output.WorldHeight != float64(c.cellsY)*c.cellSize {
+			t.Errorf("%s: world %vx%v", c.name, output.WorldWidth, output.WorldHeight)
+		}
+		if len(output.Islands) != c.cellsX*c.cellsY {
+			t.Fatalf("%s: %d islands", c.name, len(output.Islands))
+		}
+		cell := 1 / math.Max(float64(c.cellsX), float64(c.cellsY))
+		for _, island := range output.Islands {
+			x, y := island.IslandID/100, island.IslandID%100-1
+			if !nearlyEqual(island.X, (float64(x)+0.5)*cell) || !nearlyEqual(island.Y, (float64(y)+0.5)*cell) {
+				t.Errorf("%s: island %d at %v, %v, want the middle of cell %s", c.name, island.IslandID, island.X, island.Y, coords.CellName(x, y))
+			}
+			if island.X > c.mapWidth || island.Y > c.mapHeight {
+				t.Errorf("%s: island %d at %v, %v is outside the %vx%v map", c.name, island.IslandID, island.X, island.Y, c.mapWidth, c.mapHeight)
+			}
+			for _, p := range island.Footprint {
+				if p[0] < float64(x)*cell || p[0] > float64(x+1)*cell || p[1] < float64(y)*cell || p[1] > float64(y+1)*cell {
+					t.Errorf("%s: island %d footprint %v leaves its cell", c.name, island.IslandID, island.Footprint)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package generator
+
+import (
+	"math"
+	"sort"
+)
+
+// Mapbox Vector Tile encoding, see
+// https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+
+const (
+	mvtExtent = 4096
+
+	mvtPoint   = 1
+	mvtPolygon = 3
+
+	mvtMoveTo    = 1
+	mvtLineTo    = 2
+	mvtClosePath = 7
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuffer is a minimal protobuf writer for the messages of a vector tile.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) key(field int, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) uint(field int, v uint64) {
+	b.key(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	b.key(field, wireFixed64)
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 64; i += 8 {
+		*b = append(*b, byte(bits>>i))
+	}
+}
+
+func (b *protoBuffer) packed(field int, values []uint32) {
+	if len(values) == 0 {
+		return
+	}
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(uint64(v))
+	}
+	b.bytes(field, packed)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+// mvtLayer collects the features of one layer. Coordinates passed to it are
+// in tile pixels, 0 to mvtExtent.
+type mvtLayer struct {
+	name     string
+	keys     []string
+	keyIndex map[string]uint32
+	values   []protoBuffer
+	valIndex map[interface{}]uint32
+	features []protoBuffer
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{
+		name:     name,
+		keyIndex: make(map[string]uint32),
+		valIndex: make(map[interface{}]uint32),
+	}
+}
+
+// addPoint adds a point feature.
+func (l *mvtLayer) addPoint(id uint64, x, y float64, properties map[string]interface{}) {
+	px, py := int64(math.Round(x)), int64(math.Round(y))
+	geometry := []uint32{mvtMoveTo | 1<<3, uint32(zigzag(px)), uint32(zigzag(py))}
+	l.add(id, mvtPoint, geometry, properties)
+}
+
+// addPolygon adds a polygon with a single ring. The ring is rewound when
+// needed so it has the positive area the spec requires of exterior rings.
+func (l *mvtLayer) addPolygon(id uint64, ring [][2]float64, properties map[string]interface{}) {
+	points := make([][2]int64, 0, len(ring))
+	for _, p := range ring {
+		q := [2]int64{int64(math.Round(p[0])), int64(math.Round(p[1]))}
+		if n := len(points); n > 0 && points[n-1] == q {
+			continue
+		}
+		points = append(points, q)
+	}
+	if len(points) > 1 && points[0] == points[len(points)-1] {
+		points = points[:len(points)-1]
+	}
+	if len(points) < 3 {
+		return
+	}
+	area := int64(0)
+	for i := range points {
+		a, b := points[i], points[(i+1)%len(points)]
+		area += a[0]*b[1] - b[0]*a[1]
+	}
+	if area == 0 {
+		return
+	}
+	if area < 0 {
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+
+	geometry := make([]uint32, 0, 2*len(points)+3)
+	geometry = append(geometry, mvtMoveTo|1<<3, uint32(zigzag(points[0][0])), uint32(zigzag(points[0][1])))
+	geometry = append(geometry, uint32(mvtLineTo|(len(points)-1)<<3))
+	for i := 1; i < len(points); i++ {
+		geometry = append(geometry,
+			uint32(zigzag(points[i][0]-points[i-1][0])),
+			uint32(zigzag(points[i][1]-points[i-1][1])))
+	}
+	geometry = append(geometry, mvtClosePath|1<<3)
+	l.add(id, mvtPolygon, geometry, properties)
+}
+
+func (l *mvtLayer) add(id uint64, geomType uint64, geometry []uint32, properties map[string]interface{}) {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tags := make([]uint32, 0, 2*len(names))
+	for _, name := range names {
+		value, ok := l.value(properties[name])
+		if !ok {
+			continue
+		}
+		tags = append(tags, l.key(name), value)
+	}
+
+	var feature protoBuffer
+	if id != 0 {
+		feature.uint(1, id)
+	}
+	feature.packed(2, tags)
+	feature.uint(3, geomType)
+	feature.packed(4, geometry)
+	l.features = append(l.features, feature)
+}
+
+func (l *mvtLayer) key(name string) uint32 {
+	if i, found := l.keyIndex[name]; found {
+		return i
+	}
+	i := uint32(len(l.keys))
+	l.keys = append(l.keys, name)
+	l.keyIndex[name] = i
+	return i
+}
+
+// value returns the index of a property value, adding it to the layer if
+// needed. Unsupported types are skipped.
+func (l *mvtLayer) value(v interface{}) (uint32, bool) {
+	switch n := v.(type) {
+	case int:
+		v = int64(n)
+	case uint32:
+		v = uint64(n)
+	case float32:
+		v = float64(n)
+	}
+	if i, found := l.valIndex[v]; found {
+		return i, true
+	}
+
+	var value protoBuffer
+	switch v := v.(type) {
+	case string:
+		value.string(1, v)
+	case float64:
+		value.double(3, v)
+	case int64:
+		value.key(6, wireVarint)
+		value.varint(zigzag(v))
+	case uint64:
+		value.uint(5, v)
+	case bool:
+		b := uint64(0)
+		if v {
+			b = 1
+		}
+		value.uint(7, b)
+	default:
+		return 0, false
+	}
+	i := uint32(len(l.values))
+	l.values = append(l.values, value)
+	l.valIndex[v] = i
+	return i, true
+}
+
+func (l *mvtLayer) encode() protoBuffer {
+	var layer protoBuffer
+	layer.uint(15, 2)
+	layer.string(1, l.name)
+	for _, feature := range l.features {
+		layer.bytes(2, feature)
+	}
+	for _, key := range l.keys {
+		layer.string(3, key)
+	}
+	for _, value := range l.values {
+		layer.bytes(4, value)
+	}
+	layer.uint(5, mvtExtent)
+	return layer
+}
+
+// encodeMVT encodes the non empty layers as a tile.
+func encodeMVT(layers ...*mvtLayer) []byte {
+	var tile protoBuffer
+	for _, layer := range layers {
+		if len(layer.features) > 0 {
+			tile.bytes(3, layer.encode())
+		}
+	}
+	return tile
+}
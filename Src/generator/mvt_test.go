@@ -0,0 +1,255 @@
+package generator
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+type protoField struct {
+	field int
+	wire  int
+	value uint64
+	bytes []byte
+}
+
+// decodeProto splits a protobuf message into its fields, just enough of the
+// wire format to read back a vector tile.
+func decodeProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	fields := make([]protoField, 0)
+	for len(b) > 0 {
+		key, n := readVarint(t, b)
+		b = b[n:]
+		f := protoField{field: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.value, n = readVarint(t, b)
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("field %d: short fixed64", f.field)
+			}
+			for i := uint(0); i < 8; i++ {
+				f.value |= uint64(b[i]) << (8 * i)
+			}
+			b = b[8:]
+		case wireBytes:
+			length, n := readVarint(t, b)
+			b = b[n:]
+			if uint64(len(b)) < length {
+				t.Fatalf("field %d: %d bytes, want %d", f.field, len(b), length)
+			}
+			f.bytes = b[:length]
+			b = b[length:]
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", f.field, f.wire)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func readVarint(t *testing.T, b []byte) (uint64, int) {
+	t.Helper()
+	v := uint64(0)
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	t.Fatalf("truncated varint % x", b)
+	return 0, 0
+}
+
+func unpack(t *testing.T, b []byte) []uint32 {
+	values := make([]uint32, 0)
+	for len(b) > 0 {
+		v, n := readVarint(t, b)
+		values = append(values, uint32(v))
+		b = b[n:]
+	}
+	return values
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+type testMVTFeature struct {
+	id         uint64
+	geomType   uint64
+	geometry   []uint32
+	properties map[string]interface{}
+}
+
+type testMVTLayer struct {
+	version  uint64
+	name     string
+	extent   uint64
+	features []testMVTFeature
+}
+
+// decodeMVT reads back a tile, resolving the feature tags to properties.
+func decodeMVT(t *testing.T, tile []byte) []testMVTLayer {
+	layers := make([]testMVTLayer, 0)
+	for _, f := range decodeProto(t, tile) {
+		if f.field != 3 || f.wire != wireBytes {
+			t.Fatalf("tile field %d wire %d, want layers only", f.field, f.wire)
+		}
+		var layer testMVTLayer
+		var keys []string
+		var values []interface{}
+		var tags [][]uint32
+		for _, lf := range decodeProto(t, f.bytes) {
+			switch lf.field {
+			case 15:
+				layer.version = lf.value
+			case 1:
+				layer.name = string(lf.bytes)
+			case 2:
+				feature := testMVTFeature{properties: make(map[string]interface{})}
+				var featureTags []uint32
+				for _, ff := range decodeProto(t, lf.bytes) {
+					switch ff.field {
+					case 1:
+						feature.id = ff.value
+					case 2:
+						featureTags = unpack(t, ff.bytes)
+					case 3:
+						feature.geomType = ff.value
+					case 4:
+						feature.geometry = unpack(t, ff.bytes)
+					}
+				}
+				layer.features = append(layer.features, feature)
+				tags = append(tags, featureTags)
+			case 3:
+				keys = append(keys, string(lf.bytes))
+			case 4:
+				value := decodeProto(t, lf.bytes)
+				if len(value) != 1 {
+					t.Fatalf("layer %s: value with %d fields", layer.name, len(value))
+				}
+				switch v := value[0]; v.field {
+				case 1:
+					values = append(values, string(v.bytes))
+				case 3:
+					values = append(values, math.Float64frombits(v.value))
+				case 5:
+					values = append(values, v.value)
+				case 6:
+					values = append(values, unzigzag(v.value))
+				case 7:
+					values = append(values, v.value != 0)
+				default:
+					t.Fatalf("layer %s: unexpected value field %d", layer.name, v.field)
+				}
+			case 5:
+				layer.extent = lf.value
+			default:
+				t.Fatalf("layer %s: unexpected field %d", layer.name, lf.field)
+			}
+		}
+		for i, featureTags := range tags {
+			if len(featureTags)%2 != 0 {
+				t.Fatalf("layer %s: odd tags %v", layer.name, featureTags)
+			}
+			for j := 0; j < len(featureTags); j += 2 {
+				k, v := featureTags[j], featureTags[j+1]
+				if int(k) >= len(keys) || int(v) >= len(values) {
+					t.Fatalf("layer %s: tag %d=%d out of range", layer.name, k, v)
+				}
+				layer.features[i].properties[keys[k]] = values[v]
+			}
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+func TestEncodeMVT(t *testing.T) {
+	for _, c := range []struct {
+		v    int64
+		want uint64
+	}{{0, 0}, {-1, 1}, {1, 2}, {-2, 3}, {2, 4}, {4096, 8192}, {-4096, 8191}} {
+		if got := zigzag(c.v); got != c.want || unzigzag(got) != c.v {
+			t.Errorf("zigzag(%d) = %d, want %d", c.v, got, c.want)
+		}
+	}
+
+	islands := newMVTLayer("islands")
+	islands.addPoint(7, 100.4, -3.6, map[string]interface{}{
+		"name":    "Isle",
+		"tax":     1.5,
+		"claims":  -2,
+		"claimed": true,
+		"tiles":   uint32(300),
+		"skipped": struct{}{},
+	})
+	islands.addPoint(0, 4095.6, 4096, map[string]interface{}{"name": "Isle"})
+	claims := newMVTLayer("claims")
+	// clockwise on screen, repeating its first point and a corner
+	claims.addPolygon(12, [][2]float64{{0, 0}, {0, 10}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}, nil)
+	// too few distinct points and no area are dropped
+	claims.addPolygon(13, [][2]float64{{0, 0}, {0.2, 0.2}, {5, 5}}, nil)
+	claims.addPolygon(14, [][2]float64{{0, 0}, {5, 5}, {10, 10}}, nil)
+
+	got := decodeMVT(t, encodeMVT(islands, newMVTLayer("discozones"), claims))
+	want := []testMVTLayer{
+		{
+			version: 2,
+			name:    "islands",
+			extent:  mvtExtent,
+			features: []testMVTFeature{
+				{
+					id:       7,
+					geomType: mvtPoint,
+					geometry: []uint32{mvtMoveTo | 1<<3, 200, 7},
+					properties: map[string]interface{}{
+						"name":    "Isle",
+						"tax":     1.5,
+						"claims":  int64(-2),
+						"claimed": true,
+						"tiles":   uint64(300),
+					},
+				},
+				{
+					geomType:   mvtPoint,
+					geometry:   []uint32{mvtMoveTo | 1<<3, 8192, 8192},
+					properties: map[string]interface{}{"name": "Isle"},
+				},
+			},
+		},
+		{
+			version: 2,
+			name:    "claims",
+			extent:  mvtExtent,
+			features: []testMVTFeature{
+				{
+					id:       12,
+					geomType: mvtPolygon,
+					// rewound to start at 10,0, then relative moves
+					geometry: []uint32{
+						mvtMoveTo | 1<<3, 20, 0,
+						mvtLineTo | 3<<3, 0, 20, 19, 0, 0, 19,
+						mvtClosePath | 1<<3,
+					},
+					properties: map[string]interface{}{},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded tile = %+v, want %+v", got, want)
+	}
+
+	// values are shared between the features of a layer
+	if n := len(islands.values); n != 5 {
+		t.Errorf("islands layer has %d values, want 5", n)
+	}
+	if tile := encodeMVT(newMVTLayer("empty")); len(tile) != 0 {
+		t.Errorf("empty tile = % x, want no bytes", tile)
+	}
+}
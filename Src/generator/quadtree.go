@@ -0,0 +1,145 @@
+package generator
+
+import (
+	"math"
+
+	"github.com/zzglitch/goquadtree/quadtree"
+)
+
+// Bounds is an axis aligned rectangle.
+type Bounds struct {
+	MinX float64 `json:"MinX"`
+	MinY float64 `json:"MinY"`
+	MaxX float64 `json:"MaxX"`
+	MaxY float64 `json:"MaxY"`
+}
+
+// PointBounds returns the bounds of a single point.
+func PointBounds(x, y float64) Bounds {
+	return Bounds{x, y, x, y}
+}
+
+// Intersects reports whether two bounds overlap, edges included.
+func (b Bounds) Intersects(o Bounds) bool {
+	return b.MinX <= o.MaxX && o.MinX <= b.MaxX && b.MinY <= o.MaxY && o.MinY <= b.MaxY
+}
+
+// Contains reports whether o lies entirely within b.
+func (b Bounds) Contains(o Bounds) bool {
+	return b.MinX <= o.MinX && o.MaxX <= b.MaxX && b.MinY <= o.MinY && o.MaxY <= b.MaxY
+}
+
+// union returns the bounds covering both b and o.
+func (b Bounds) union(o Bounds) Bounds {
+	return Bounds{math.Min(b.MinX, o.MinX), math.Min(b.MinY, o.MinY), math.Max(b.MaxX, o.MaxX), math.Max(b.MaxY, o.MaxY)}
+}
+
+// boundingBox converts bounds to goquadtree's representation.
+func (b Bounds) boundingBox() quadtree.BoundingBox {
+	return quadtree.NewBoundingBox(b.MinX, b.MaxX, b.MinY, b.MaxY)
+}
+
+// quadItem is a value stored in goquadtree.
+type quadItem struct {
+	bounds Bounds
+	value  interface{}
+}
+
+func (i *quadItem) BoundingBox() quadtree.BoundingBox {
+	return i.bounds.boundingBox()
+}
+
+// QuadTree indexes values by their bounds in a goquadtree. Values outside of
+// the bounds the tree was created with are kept aside and checked on every
+// query.
+type QuadTree struct {
+	bounds  Bounds
+	tree    quadtree.QuadTree
+	outside []*quadItem
+	extent  Bounds // covers every value
+	size    int
+}
+
+// NewQuadTree returns an empty tree covering bounds.
+func NewQuadTree(bounds Bounds) *QuadTree {
+	return &QuadTree{bounds: bounds, tree: quadtree.NewQuadTree(bounds.boundingBox())}
+}
+
+// Len returns the number of values in the tree.
+func (q *QuadTree) Len() int {
+	return q.size
+}
+
+// Insert adds a value with the given bounds.
+func (q *QuadTree) Insert(bounds Bounds, value interface{}) {
+	if q.size == 0 {
+		q.extent = bounds
+	} else {
+		q.extent = q.extent.union(bounds)
+	}
+	q.size++
+	item := &quadItem{bounds, value}
+	if q.bounds.Contains(bounds) {
+		q.tree.Add(item)
+	} else {
+		q.outside = append(q.outside, item)
+	}
+}
+
+// Query calls fn for every value whose bounds intersect b until fn returns
+// false. goquadtree leaves out values that only touch the query box, so the
+// box is widened by the smallest possible step and the results checked with
+// edges included.
+func (q *QuadTree) Query(b Bounds, fn func(value interface{}) bool) bool {
+	widened := Bounds{
+		math.Nextafter(b.MinX, math.Inf(-1)),
+		math.Nextafter(b.MinY, math.Inf(-1)),
+		math.Nextafter(b.MaxX, math.Inf(1)),
+		math.Nextafter(b.MaxY, math.Inf(1)),
+	}
+	for _, v := range q.tree.Query(widened.boundingBox()) {
+		item := v.(*quadItem)
+		if item.bounds.Intersects(b) && !fn(item.value) {
+			return false
+		}
+	}
+	for _, item := range q.outside {
+		if item.bounds.Intersects(b) && !fn(item.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Nearest returns the value closest to a point, or nil if the tree is empty.
+// distance measures a value; it must never be less than the distance to the
+// value's bounds. accept, when not nil, filters values. Boxes around the point
+// doubling in size are queried until the closest value found lies within the
+// box, since nothing outside of it can be closer.
+func (q *QuadTree) Nearest(x, y float64, distance func(value interface{}) float64, accept func(value interface{}) bool) (interface{}, float64) {
+	if q.size == 0 || math.IsNaN(x) || math.IsNaN(y) || math.IsInf(x, 0) || math.IsInf(y, 0) {
+		return nil, math.Inf(1)
+	}
+	r := math.Max(q.extent.MaxX-q.extent.MinX, q.extent.MaxY-q.extent.MinY) / 64
+	if r <= 0 {
+		r = 1
+	}
+	for {
+		box := Bounds{x - r, y - r, x + r, y + r}
+		var best interface{}
+		bestDistance := math.Inf(1)
+		q.Query(box, func(value interface{}) bool {
+			if accept != nil && !accept(value) {
+				return true
+			}
+			if d := distance(value); d < bestDistance {
+				best, bestDistance = value, d
+			}
+			return true
+		})
+		if bestDistance <= r || box.Contains(q.extent) {
+			return best, bestDistance
+		}
+		r *= 2
+	}
+}
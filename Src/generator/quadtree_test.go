@@ -0,0 +1,142 @@
+package generator
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type testQuadValue struct {
+	id     int
+	bounds Bounds
+}
+
+// newTestQuadTree fills a tree covering 0..100 with points and small boxes on
+// whole numbers, so many of them share edges with the queries, and a few
+// values outside of the tree's bounds.
+func newTestQuadTree(r *rand.Rand) (*QuadTree, []*testQuadValue) {
+	tree := NewQuadTree(Bounds{0, 0, 100, 100})
+	values := make([]*testQuadValue, 0)
+	for i := 0; i < 2000; i++ {
+		x, y := float64(r.Intn(101)), float64(r.Intn(101))
+		b := PointBounds(x, y)
+		if i%3 == 0 {
+			b.MaxX += float64(r.Intn(5))
+			b.MaxY += float64(r.Intn(5))
+		}
+		values = append(values, &testQuadValue{i, b})
+	}
+	for _, b := range []Bounds{{-10, -10, -5, -5}, {95, 95, 120, 101}, {150, 50, 150, 50}} {
+		values = append(values, &testQuadValue{len(values), b})
+	}
+	for _, v := range values {
+		tree.Insert(v.bounds, v)
+	}
+	return tree, values
+}
+
+func TestQuadTreeQuery(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree, values := newTestQuadTree(r)
+	if tree.Len() != len(values) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(values))
+	}
+
+	queries := []Bounds{
+		{0, 0, 100, 100},
+		{-1000, -1000, 1000, 1000},
+		{10, 10, 20, 20},
+		{50, 50, 50, 50},
+		{0, 0, 0, 0},
+		{100, 100, 100, 100},
+		{-10, -10, -10, -10},
+		{150, 50, 150, 50},
+		{99.5, 0, 130, 100},
+		{25.5, 25.5, 26.5, 26.5},
+		{200, 200, 300, 300},
+	}
+	for i := 0; i < 200; i++ {
+		x, y := float64(r.Intn(101)), float64(r.Intn(101))
+		queries = append(queries, Bounds{x, y, x + float64(r.Intn(30)), y + float64(r.Intn(30))})
+	}
+
+	for _, q := range queries {
+		want := make([]int, 0)
+		for _, v := range values {
+			if v.bounds.Intersects(q) {
+				want = append(want, v.id)
+			}
+		}
+		got := make([]int, 0)
+		tree.Query(q, func(value interface{}) bool {
+			got = append(got, value.(*testQuadValue).id)
+			return true
+		})
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%v) found %d values, want %d", q, len(got), len(want))
+		}
+	}
+
+	// returning false stops the query
+	n := 0
+	if tree.Query(Bounds{0, 0, 100, 100}, func(value interface{}) bool { n++; return n < 3 }) || n != 3 {
+		t.Errorf("stopped Query visited %d values, want 3", n)
+	}
+}
+
+func TestQuadTreeNearest(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tree, values := newTestQuadTree(r)
+	filters := []struct {
+		name   string
+		accept func(value interface{}) bool
+	}{
+		{"all", nil},
+		{"odd", func(value interface{}) bool { return value.(*testQuadValue).id%2 == 1 }},
+		{"boxes", func(value interface{}) bool { return value.(*testQuadValue).id%3 == 0 }},
+		{"outside", func(value interface{}) bool { return value.(*testQuadValue).id >= 2000 }},
+		{"none", func(value interface{}) bool { return false }},
+	}
+	points := [][2]float64{{0, 0}, {50, 50}, {100, 100}, {-500, 30}, {160, 50}, {33.3, 66.6}}
+	for i := 0; i < 100; i++ {
+		points = append(points, [2]float64{r.Float64()*140 - 20, r.Float64()*140 - 20})
+	}
+
+	for _, f := range filters {
+		for _, p := range points {
+			px, py := p[0], p[1]
+			want := math.Inf(1)
+			for _, v := range values {
+				if f.accept == nil || f.accept(v) {
+					want = math.Min(want, boundsDistance(v.bounds, px, py))
+				}
+			}
+			value, got := tree.Nearest(px, py, func(value interface{}) float64 {
+				return boundsDistance(value.(*testQuadValue).bounds, px, py)
+			}, f.accept)
+			if got != want {
+				t.Errorf("%s: Nearest(%v, %v) distance = %v, want %v", f.name, px, py, got, want)
+			}
+			if value == nil && !math.IsInf(want, 1) || value != nil && f.accept != nil && !f.accept(value) {
+				t.Errorf("%s: Nearest(%v, %v) = %v", f.name, px, py, value)
+			}
+		}
+	}
+
+	if value, _ := NewQuadTree(Bounds{0, 0, 1, 1}).Nearest(0, 0, nil, nil); value != nil {
+		t.Errorf("empty tree Nearest() = %v, want nil", value)
+	}
+	if value, _ := tree.Nearest(math.NaN(), 0, nil, nil); value != nil {
+		t.Errorf("Nearest(NaN) = %v, want nil", value)
+	}
+}
+
+// boundsDistance returns the distance from a point to b, or 0 inside it.
+func boundsDistance(b Bounds, x, y float64) float64 {
+	dx := math.Max(0, math.Max(b.MinX-x, x-b.MaxX))
+	dy := math.Max(0, math.Max(b.MinY-y, y-b.MaxY))
+	return math.Hypot(dx, dy)
+}
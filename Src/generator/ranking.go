@@ -0,0 +1,210 @@
+package generator
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Ranker scores tribes for a leaderboard. Tribes missing from the scores, or
+// scoring zero, are not ranked.
+type Ranker interface {
+	// Name is the strategy name used by /leaderboard?strategy=.
+	Name() string
+	Score(islands *IslandOutput, events *EventLog, now time.Time) map[uint64]float64
+}
+
+// TribeRank is one leaderboard entry.
+type TribeRank struct {
+	Rank      int     `json:"Rank"`
+	TribeID   uint64  `json:"TribeId"`
+	TribeName string  `json:"TribeName"`
+	Score     float64 `json:"Score"`
+}
+
+// Leaderboard is a ranking of the top tribes by one strategy.
+type Leaderboard struct {
+	Strategy string      `json:"Strategy"`
+	Version  int64       `json:"Version"`
+	Tribes   []TribeRank `json:"Tribes"`
+}
+
+// IslandPointsRanker ranks by the summed points of the islands owned.
+type IslandPointsRanker struct{}
+
+// Name implements Ranker.
+func (IslandPointsRanker) Name() string { return "points" }
+
+// Score implements Ranker.
+func (IslandPointsRanker) Score(islands *IslandOutput, events *EventLog, now time.Time) map[uint64]float64 {
+	return sumIslands(islands, func(island *IslandInfoOutput) float64 {
+		return float64(island.IslandPoints)
+	})
+}
+
+// IslandCountRanker ranks by the number of islands owned.
+type IslandCountRanker struct{}
+
+// Name implements Ranker.
+func (IslandCountRanker) Name() string { return "islands" }
+
+// Score implements Ranker.
+func (IslandCountRanker) Score(islands *IslandOutput, events *EventLog, now time.Time) map[uint64]float64 {
+	return sumIslands(islands, func(island *IslandInfoOutput) float64 {
+		return 1
+	})
+}
+
+// SettlersRanker ranks by the total settlers on the islands owned. Islands
+// with an unknown settler count are skipped.
+type SettlersRanker struct{}
+
+// Name implements Ranker.
+func (SettlersRanker) Name() string { return "settlers" }
+
+// Score implements Ranker.
+func (SettlersRanker) Score(islands *IslandOutput, events *EventLog, now time.Time) map[uint64]float64 {
+	return sumIslands(islands, func(island *IslandInfoOutput) float64 {
+		if island.NumSettlers < 0 {
+			return 0
+		}
+		return float64(island.NumSettlers)
+	})
+}
+
+// TaxIncomeRanker ranks by a relative tax income estimate: the tax rate of
+// each island owned weighted by its points and settlers. An island with an
+// unknown settler count is weighted as if it had one.
+type TaxIncomeRanker struct{}
+
+// Name implements Ranker.
+func (TaxIncomeRanker) Name() string { return "tax" }
+
+// Score implements Ranker.
+func (TaxIncomeRanker) Score(islands *IslandOutput, events *EventLog, now time.Time) map[uint64]float64 {
+	return sumIslands(islands, func(island *IslandInfoOutput) float64 {
+		settlers := island.NumSettlers
+		if settlers < 1 {
+			settlers = 1
+		}
+		return island.TaxRate / 100 * float64(island.IslandPoints) * float64(settlers)
+	})
+}
+
+// WarWinsRanker ranks by wars won that ended within Window. The attacker wins
+// a war when it captured the island before the war ended, otherwise the
+// defender does. Only wars in the event log count, so the ranking does not
+// survive a restart.
+type WarWinsRanker struct {
+	Window time.Duration
+}
+
+// Name implements Ranker.
+func (WarWinsRanker) Name() string { return "warwins" }
+
+// Score implements Ranker.
+func (r WarWinsRanker) Score(islands *IslandOutput, events *EventLog, now time.Time) map[uint64]float64 {
+	scores := make(map[uint64]float64)
+	if events == nil {
+		return scores
+	}
+	since := now.Add(-r.Window).Unix()
+
+	// captures may be up to a war's length older than its end
+	captures := make(map[int][]ColonyEvent)
+	for _, e := range events.Query(EventFilter{Type: EventIslandCaptured}) {
+		captures[e.IslandID] = append(captures[e.IslandID], e)
+	}
+	for _, e := range events.Query(EventFilter{Type: EventWarEnded}) {
+		if e.Time < since {
+			continue
+		}
+		winner := e.TribeID
+		for _, capture := range captures[e.IslandID] {
+			if capture.TribeID == e.OtherTribeID && capture.Time >= int64(e.WarStartUTC) && capture.Time <= e.Time {
+				winner = e.OtherTribeID
+				break
+			}
+		}
+		if winner != 0 {
+			scores[winner]++
+		}
+	}
+	return scores
+}
+
+func sumIslands(islands *IslandOutput, score func(island *IslandInfoOutput) float64) map[uint64]float64 {
+	scores := make(map[uint64]float64)
+	for i := range islands.Islands {
+		island := &islands.Islands[i]
+		if island.TribeID != 0 {
+			scores[island.TribeID] += score(island)
+		}
+	}
+	return scores
+}
+
+// NewRankers returns the built-in strategies by name.
+func NewRankers(config *Config) map[string]Ranker {
+	rankers := make(map[string]Ranker)
+	for _, r := range []Ranker{
+		IslandPointsRanker{},
+		IslandCountRanker{},
+		SettlersRanker{},
+		TaxIncomeRanker{},
+		WarWinsRanker{Window: time.Duration(config.WarWinWindowInSeconds) * time.Second},
+	} {
+		rankers[r.Name()] = r
+	}
+	return rankers
+}
+
+// LookupRanker returns the named strategy.
+func LookupRanker(rankers map[string]Ranker, name string) (Ranker, error) {
+	if r, found := rankers[name]; found {
+		return r, nil
+	}
+	return nil, fmt.Errorf("unknown ranking strategy %q", name)
+}
+
+// Rank returns the top n tribes by score, ties broken by tribe ID.
+func Rank(ranker Ranker, islands *IslandOutput, events *EventLog, n int, now time.Time) *Leaderboard {
+	names := make(map[uint64]string, len(islands.Companies))
+	for _, company := range islands.Companies {
+		names[company.TribeID] = company.TribeName
+	}
+
+	board := &Leaderboard{
+		Strategy: ranker.Name(),
+		Version:  now.Unix(),
+		Tribes:   make([]TribeRank, 0),
+	}
+	for tribe, score := range ranker.Score(islands, events, now) {
+		if score > 0 {
+			board.Tribes = append(board.Tribes, TribeRank{TribeID: tribe, TribeName: names[tribe], Score: score})
+		}
+	}
+	sort.Slice(board.Tribes, func(i, j int) bool {
+		a, b := &board.Tribes[i], &board.Tribes[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.TribeID < b.TribeID
+	})
+	if n > 0 && len(board.Tribes) > n {
+		board.Tribes = board.Tribes[:n]
+	}
+	for i := range board.Tribes {
+		board.Tribes[i].Rank = i + 1
+	}
+	return board
+}
+
+// TopTribes returns the tribe IDs of a leaderboard in rank order.
+func (b *Leaderboard) TopTribes() []uint64 {
+	top := make([]uint64, len(b.Tribes))
+	for i := range b.Tribes {
+		top[i] = b.Tribes[i].TribeID
+	}
+	return top
+}
@@ -0,0 +1,32 @@
+package generator
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/llgcode/draw2d"
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+// newTileContext returns a draw2d graphic context drawing on a new transparent
+// tile.
+func newTileContext() (*image.RGBA, *draw2dimg.GraphicContext) {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	return img, draw2dimg.NewGraphicContext(img)
+}
+
+// fillPolygon fills a polygon given in pixel coordinates, blending c over the
+// image with anti-aliased edges. Parts outside of the image are clipped.
+func fillPolygon(gc *draw2dimg.GraphicContext, polygon [][2]float64, c color.NRGBA) {
+	if len(polygon) < 3 {
+		return
+	}
+	path := &draw2d.Path{}
+	path.MoveTo(polygon[0][0], polygon[0][1])
+	for _, p := range polygon[1:] {
+		path.LineTo(p[0], p[1])
+	}
+	path.Close()
+	gc.SetFillColor(c)
+	gc.Fill(path)
+}
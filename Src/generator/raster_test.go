@@ -0,0 +1,95 @@
+package generator
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestFillPolygonRotated(t *testing.T) {
+	img, gc := newTileContext()
+	// 8 by 4 pixels around 8, 8, turned 30 degrees clockwise
+	fillPolygon(gc, rotatedRect(8, 8, 8, 4, 30), color.NRGBA{255, 0, 0, 0x80})
+
+	// alpha of the pixels from 0, 4 to 15, 11, everything else is untouched
+	golden := [][16]uint8{
+		{0, 0, 0, 0, 0, 56, 24, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 26, 127, 127, 77, 10, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 99, 128, 128, 128, 120, 57, 2, 0, 0, 0, 0, 0},
+		{0, 0, 0, 32, 128, 128, 128, 128, 128, 128, 108, 36, 0, 0, 0, 0},
+		{0, 0, 0, 0, 35, 107, 128, 128, 128, 128, 128, 128, 29, 0, 0, 0},
+		{0, 0, 0, 0, 0, 2, 55, 120, 128, 128, 128, 92, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 10, 75, 126, 126, 21, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0, 0, 23, 52, 0, 0, 0, 0, 0},
+	}
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			want := uint8(0)
+			if y >= 4 && y < 4+len(golden) && x < 16 {
+				want = golden[y-4][x]
+			}
+			// premultiplied, so pure red has R equal to alpha
+			if got := img.RGBAAt(x, y); got != (color.RGBA{want, 0, 0, want}) {
+				t.Errorf("pixel %d,%d = %v, want alpha %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestRenderTileClip(t *testing.T) {
+	// a footprint from 250.88 to 261.12 and 102.4 to 153.6 pixels at zoom 1,
+	// straddling the edge between tiles 1/0/0 and 1/1/0
+	shapes := []territoryShape{newTerritoryShape(rotatedRect(0.5, 0.25, 0.02, 0.1, 0), color.NRGBA{0, 0, 255, 0x80})}
+	tiles := make([]*image.NRGBA, 2)
+	for x := range tiles {
+		js, err := renderTile(shapes, 1, x, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(js))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles[x] = image.NewNRGBA(img.Bounds())
+		draw.Draw(tiles[x], img.Bounds(), img, image.Point{}, draw.Src)
+	}
+
+	for _, c := range []struct {
+		tile, x, y int
+		alpha      uint8
+	}{
+		{0, 249, 120, 0},
+		{0, 250, 120, 16},
+		{0, 251, 120, 128},
+		{0, 255, 101, 0},
+		{0, 255, 102, 78},
+		{0, 255, 120, 128},
+		{0, 255, 153, 76},
+		{0, 255, 154, 0},
+		{1, 0, 102, 78},
+		{1, 0, 120, 128},
+		{1, 4, 120, 128},
+		{1, 5, 120, 14},
+		{1, 6, 120, 0},
+		{1, 0, 154, 0},
+	} {
+		want := color.NRGBA{}
+		if c.alpha > 0 {
+			want = color.NRGBA{0, 0, 255, c.alpha}
+		}
+		if got := tiles[c.tile].NRGBAAt(c.x, c.y); got != want {
+			t.Errorf("tile 1/%d/0 pixel %d,%d = %v, want %v", c.tile, c.x, c.y, got, want)
+		}
+	}
+
+	// nothing of the footprint reaches the tiles below
+	empty := []byte("empty")
+	for x := 0; x < 2; x++ {
+		if js, err := renderTile(shapes, 1, x, 1, empty); err != nil || !bytes.Equal(js, empty) {
+			t.Errorf("tile 1/%d/1 = %d bytes %v, want the empty tile", x, len(js), err)
+		}
+	}
+}
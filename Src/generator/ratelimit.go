@@ -0,0 +1,133 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitError is returned for commands over a rate limit.
+type RateLimitError struct {
+	Wait time.Duration // until the command would be allowed
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many commands, retry in %v", e.Wait.Round(time.Second))
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the commands sent per user and by everyone together
+// with token buckets.
+type RateLimiter struct {
+	userRate, userBurst     float64
+	globalRate, globalBurst float64
+	lock                    sync.Mutex
+	global                  tokenBucket
+	users                   map[string]*tokenBucket
+	swept                   time.Time // when full buckets were last dropped
+}
+
+// sweepInterval is how often the buckets that filled up again are dropped. A
+// full bucket is the same as a new one, so only users limited within the
+// last few minutes are kept in memory.
+const sweepInterval = time.Minute
+
+// NewRateLimiter returns a limiter allowing each user ratePerMinute commands
+// after a burst of burst, and everyone together globalRatePerMinute after
+// globalBurst. A rate of zero or less disables that limit.
+func NewRateLimiter(ratePerMinute float64, burst int, globalRatePerMinute float64, globalBurst int) *RateLimiter {
+	return &RateLimiter{
+		userRate:    ratePerMinute / 60,
+		userBurst:   math.Max(float64(burst), 1),
+		globalRate:  globalRatePerMinute / 60,
+		globalBurst: math.Max(float64(globalBurst), 1),
+		global:      tokenBucket{tokens: math.Max(float64(globalBurst), 1), last: time.Now()},
+		users:       make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the user's and the global bucket, or returns how
+// long to wait when either is empty. A nil RateLimiter allows everything.
+func (l *RateLimiter) Allow(user string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	bucket, found := l.users[user]
+	if !found {
+		bucket = &tokenBucket{tokens: l.userBurst, last: now}
+		if l.userRate > 0 {
+			l.users[user] = bucket
+		}
+	}
+	userWait := refill(bucket, now, l.userRate, l.userBurst)
+	globalWait := refill(&l.global, now, l.globalRate, l.globalBurst)
+	if wait := time.Duration(math.Max(float64(userWait), float64(globalWait))); wait > 0 {
+		return false, wait
+	}
+	if l.userRate > 0 {
+		bucket.tokens--
+	}
+	if l.globalRate > 0 {
+		l.global.tokens--
+	}
+	return true, 0
+}
+
+// Wait returns how long until Allow would let the user through, without
+// taking a token.
+func (l *RateLimiter) Wait(user string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	wait := refill(&l.global, now, l.globalRate, l.globalBurst)
+	if bucket, found := l.users[user]; found {
+		if userWait := refill(bucket, now, l.userRate, l.userBurst); userWait > wait {
+			wait = userWait
+		}
+	}
+	return wait
+}
+
+// sweep drops the user buckets that are full again, at most once per
+// sweepInterval. Callers hold the lock.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	for user, bucket := range l.users {
+		if refill(bucket, now, l.userRate, l.userBurst); bucket.tokens >= l.userBurst {
+			delete(l.users, user)
+		}
+	}
+	l.swept = now
+}
+
+// refill adds the tokens earned since the bucket was last used and returns
+// how long until it holds a whole token.
+func refill(bucket *tokenBucket, now time.Time, rate, burst float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
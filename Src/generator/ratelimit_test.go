@@ -0,0 +1,174 @@
+package generator
+
+import (
+	"testing"
+	"time"
+)
+
+// age moves a bucket's last refill back, as if d had passed.
+func age(bucket *tokenBucket, d time.Duration) {
+	bucket.last = bucket.last.Add(-d)
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	// one command a second after a burst of three
+	l := NewRateLimiter(60, 3, 0, 0)
+	for i := 0; i < 3; i++ {
+		if ok, wait := l.Allow("u"); !ok {
+			t.Fatalf("command %d of the burst refused, wait %v", i, wait)
+		}
+	}
+	ok, wait := l.Allow("u")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("Allow() after the burst = %v, %v, want a wait of up to a second", ok, wait)
+	}
+	if got := l.Wait("u"); got <= 0 || got > wait {
+		t.Errorf("Wait() = %v, want up to %v", got, wait)
+	}
+
+	// half a second earns half a token, a second a whole one
+	age(l.users["u"], 500*time.Millisecond)
+	if ok, wait := l.Allow("u"); ok || wait > 500*time.Millisecond {
+		t.Errorf("Allow() after half a second = %v, %v", ok, wait)
+	}
+	age(l.users["u"], 500*time.Millisecond)
+	if ok, _ := l.Allow("u"); !ok {
+		t.Errorf("Allow() after a second refused")
+	}
+	if ok, _ := l.Allow("u"); ok {
+		t.Errorf("second Allow() after a second allowed")
+	}
+
+	// the bucket never holds more than the burst
+	age(l.users["u"], time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("u"); !ok {
+			t.Fatalf("command %d after an hour refused", i)
+		}
+	}
+	if ok, _ := l.Allow("u"); ok {
+		t.Errorf("Allow() beyond the burst after an hour allowed")
+	}
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	// users may send two at once, everyone together three
+	l := NewRateLimiter(60, 2, 60, 3)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("u1"); !ok {
+			t.Fatalf("u1 command %d refused", i)
+		}
+	}
+	if ok, _ := l.Allow("u1"); ok {
+		t.Errorf("u1 allowed past the user burst")
+	}
+	if ok, _ := l.Allow("u2"); !ok {
+		t.Errorf("u2 refused with the global bucket not empty")
+	}
+	ok, wait := l.Allow("u2")
+	if ok || wait <= 0 {
+		t.Errorf("u2 Allow() with the global bucket empty = %v, %v", ok, wait)
+	}
+	if got := l.Wait("u3"); got <= 0 {
+		t.Errorf("Wait() of a new user with the global bucket empty = %v", got)
+	}
+
+	// a refused command takes no tokens, so the global refill lets u2 through
+	age(&l.global, time.Second)
+	if ok, _ := l.Allow("u2"); !ok {
+		t.Errorf("u2 refused after the global refill")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	for _, l := range []*RateLimiter{
+		NewRateLimiter(0, 1, 0, 1),
+		NewRateLimiter(-1, 1, -5, 1),
+		nil,
+	} {
+		for i := 0; i < 100; i++ {
+			if ok, wait := l.Allow("u"); !ok {
+				t.Fatalf("%+v: command %d refused, wait %v", l, i, wait)
+			}
+		}
+		if wait := l.Wait("u"); wait != 0 {
+			t.Errorf("%+v: Wait() = %v", l, wait)
+		}
+	}
+
+	// only the global limit
+	l := NewRateLimiter(0, 1, 60, 5)
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("u"); !ok {
+			t.Fatalf("command %d refused", i)
+		}
+	}
+	if ok, _ := l.Allow("other"); ok {
+		t.Errorf("allowed past the global burst")
+	}
+
+	// only the user limit
+	l = NewRateLimiter(60, 1, 0, 1)
+	for _, user := range []string{"a", "b", "c", "d"} {
+		if ok, _ := l.Allow(user); !ok {
+			t.Errorf("%s refused", user)
+		}
+		if ok, _ := l.Allow(user); ok {
+			t.Errorf("%s allowed past the user burst", user)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := NewRateLimiter(60, 1, 0, 0)
+	// waiting takes no token
+	for i := 0; i < 3; i++ {
+		if wait := l.Wait("u"); wait != 0 {
+			t.Fatalf("Wait() = %v", wait)
+		}
+	}
+	if ok, _ := l.Allow("u"); !ok {
+		t.Errorf("Allow() after Wait() refused")
+	}
+	if wait := l.Wait("u"); wait <= 0 || wait > time.Second {
+		t.Errorf("Wait() after the burst = %v", wait)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := NewRateLimiter(60, 2, 0, 0)
+	for _, user := range []string{"a", "b", "c"} {
+		l.Allow(user)
+	}
+	l.Allow("c")
+	if n := len(l.users); n != 3 {
+		t.Fatalf("%d buckets, want 3", n)
+	}
+
+	// a and b filled up again, c is still short a token
+	age(l.users["a"], time.Second)
+	age(l.users["b"], time.Hour)
+	l.swept = l.swept.Add(-sweepInterval)
+	l.Wait("d")
+	if _, found := l.users["c"]; !found || len(l.users) != 1 {
+		t.Errorf("buckets after a sweep = %v, want only c", l.users)
+	}
+
+	// sweeps are spread out, and users are limited as before
+	age(l.users["c"], time.Hour)
+	l.Allow("e")
+	if _, found := l.users["c"]; !found {
+		t.Errorf("bucket of c dropped before the next sweep")
+	}
+	l.Allow("e")
+	if ok, _ := l.Allow("e"); ok {
+		t.Errorf("e allowed past the burst")
+	}
+
+	// without a user limit no buckets are kept
+	unlimited := NewRateLimiter(0, 1, 60, 5)
+	unlimited.Allow("a")
+	if n := len(unlimited.users); n != 0 {
+		t.Errorf("%d buckets without a user limit", n)
+	}
+}
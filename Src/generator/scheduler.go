@@ -0,0 +1,377 @@
+package generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job statuses besides the audit statuses of a run
+const (
+	JobInvalid = "invalid" // the command or its owner no longer checks out
+	JobMissed  = "missed"  // a one-off job was due while the service was down
+)
+
+// Scheduler errors
+var (
+	ErrNoJob       = errors.New("no such job")
+	ErrNotJobOwner = errors.New("job belongs to another user")
+)
+
+// Job is a command sent at a one-off unix time At or whenever its Cron
+// expression matches, in UTC. It runs with the current role of its Owner.
+type Job struct {
+	ID              uint64 `json:"ID"`
+	Owner           string `json:"Owner"`
+	Command         string `json:"Command"`
+	Cron            string `json:"Cron,omitempty"`
+	At              int64  `json:"At,omitempty"`
+	Enabled         bool   `json:"Enabled"`
+	Confirmed       bool   `json:"Confirmed,omitempty"` // a dangerous command confirmed when it was scheduled
+	Created         int64  `json:"Created"`
+	NextRun         int64  `json:"NextRun,omitempty"`
+	LastRun         int64  `json:"LastRun,omitempty"`
+	LastStatus      string `json:"LastStatus,omitempty"`
+	LastSubscribers int64  `json:"LastSubscribers"`
+	LastError       string `json:"LastError,omitempty"`
+}
+
+// JobRequest is the JSON body creating or replacing a job. Command is written
+// as for /command. Exactly one of Cron and At must be given.
+type JobRequest struct {
+	Command string `json:"Command"`
+	Cron    string `json:"Cron"`
+	At      int64  `json:"At"`
+	Enabled *bool  `json:"Enabled"` // defaults to true
+}
+
+// Scheduler keeps the scheduled jobs, persisted to a file, and publishes them
+// through the commander when due.
+type Scheduler struct {
+	path      string
+	auth      *Auth
+	commands  *CommandRegistry
+	commander *Commander
+	lock      sync.Mutex
+	jobs      map[uint64]*Job
+	nextID    uint64
+	wake      chan struct{}
+}
+
+// OpenScheduler loads the jobs from path. A blank path keeps them in memory
+// only. One-off jobs that came due while the service was down are not run
+// late but marked missed; the file is only written when there were any.
+func OpenScheduler(path string, auth *Auth, commands *CommandRegistry, commander *Commander) (*Scheduler, error) {
+	s := &Scheduler{
+		path:      path,
+		auth:      auth,
+		commands:  commands,
+		commander: commander,
+		jobs:      make(map[uint64]*Job),
+		nextID:    1,
+		wake:      make(chan struct{}, 1),
+	}
+	if len(path) > 0 {
+		js, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var jobs []*Job
+			if err := json.Unmarshal(js, &jobs); err != nil {
+				return nil, err
+			}
+			for _, job := range jobs {
+				s.jobs[job.ID] = job
+				if job.ID >= s.nextID {
+					s.nextID = job.ID + 1
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	missed := false
+	for _, job := range s.jobs {
+		if job.Enabled && job.At > 0 && job.At < now.Unix() {
+			job.Enabled = false
+			job.LastStatus = JobMissed
+			missed = true
+		}
+		s.schedule(job, now)
+	}
+	if missed {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Jobs returns all jobs ordered by ID.
+func (s *Scheduler) Jobs() []Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// Job returns a job by ID.
+func (s *Scheduler) Job(id uint64) (Job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, found := s.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Add creates a job owned by user. Confirmed tells whether the user confirmed
+// the command, which dangerous commands need.
+func (s *Scheduler) Add(user *Session, req *JobRequest, confirmed bool) (Job, error) {
+	job := &Job{Owner: user.Name, Created: time.Now().Unix()}
+	if err := s.apply(user, job, req, confirmed); err != nil {
+		return Job{}, err
+	}
+
+	s.lock.Lock()
+	job.ID = s.nextID
+	s.nextID++
+	s.jobs[job.ID] = job
+	added := *job
+	s.saveOrLog()
+	s.lock.Unlock()
+	s.poke()
+	return added, nil
+}
+
+// Update replaces a job's command and schedule. Users may change their own
+// jobs, roles allowed every command anyone's. The job then belongs to user.
+// Confirmed is as for Add.
+func (s *Scheduler) Update(user *Session, id uint64, req *JobRequest, confirmed bool) (Job, error) {
+	s.lock.Lock()
+	job, found := s.jobs[id]
+	if !found {
+		s.lock.Unlock()
+		return Job{}, ErrNoJob
+	}
+	if job.Owner != user.Name && !s.auth.Allowed(user.Role, "*") {
+		s.lock.Unlock()
+		return Job{}, ErrNotJobOwner
+	}
+	updated := *job
+	s.lock.Unlock()
+
+	updated.Owner = user.Name
+	if err := s.apply(user, &updated, req, confirmed); err != nil {
+		return Job{}, err
+	}
+
+	s.lock.Lock()
+	if _, found := s.jobs[id]; !found {
+		s.lock.Unlock()
+		return Job{}, ErrNoJob
+	}
+	s.jobs[id] = &updated
+	s.saveOrLog()
+	s.lock.Unlock()
+	s.poke()
+	return updated, nil
+}
+
+// Delete removes a job. Users may delete their own jobs, roles allowed every
+// command anyone's.
+func (s *Scheduler) Delete(user *Session, id uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, found := s.jobs[id]
+	if !found {
+		return ErrNoJob
+	}
+	if job.Owner != user.Name && !s.auth.Allowed(user.Role, "*") {
+		return ErrNotJobOwner
+	}
+	delete(s.jobs, id)
+	s.saveOrLog()
+	return nil
+}
+
+// apply checks a request the way /command checks a command and sets it on
+// the job.
+func (s *Scheduler) apply(user *Session, job *Job, req *JobRequest, confirmed bool) error {
+	command, err := s.commands.Parse(req.Command)
+	if err != nil {
+		return err
+	}
+	if !s.auth.Allowed(user.Role, command.Name) {
+		return ErrCommandDenied
+	}
+	dangerous := s.commander.Dangerous(command.Name)
+	if dangerous && !confirmed {
+		return ErrNotConfirmed
+	}
+	now := time.Now()
+	if (len(req.Cron) > 0) == (req.At > 0) {
+		return fmt.Errorf("expected either Cron or At")
+	}
+	if len(req.Cron) > 0 {
+		cron, err := ParseCron(req.Cron)
+		if err != nil {
+			return err
+		}
+		if cron.Next(now.UTC()).IsZero() {
+			return fmt.Errorf("cron %q never matches", req.Cron)
+		}
+	} else if req.At <= now.Unix() {
+		return fmt.Errorf("At is in the past")
+	}
+
+	job.Command = strings.TrimSpace(req.Command)
+	job.Cron = strings.TrimSpace(req.Cron)
+	job.At = req.At
+	job.Enabled = req.Enabled == nil || *req.Enabled
+	job.Confirmed = dangerous
+	s.schedule(job, now)
+	return nil
+}
+
+// schedule sets the next run of a job after now.
+func (s *Scheduler) schedule(job *Job, now time.Time) {
+	job.NextRun = 0
+	if !job.Enabled {
+		return
+	}
+	if job.At > 0 {
+		job.NextRun = job.At
+	} else if cron, err := ParseCron(job.Cron); err == nil {
+		if next := cron.Next(now.UTC()); !next.IsZero() {
+			job.NextRun = next.Unix()
+		}
+	}
+}
+
+// poke wakes Run to pick up changed jobs.
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes jobs as they come due. It never returns.
+func (s *Scheduler) Run() {
+	for {
+		s.lock.Lock()
+		now := time.Now()
+		due := make([]Job, 0)
+		next := now.Add(time.Hour)
+		for _, job := range s.jobs {
+			if job.NextRun == 0 {
+				continue
+			}
+			if job.NextRun <= now.Unix() {
+				due = append(due, *job)
+			} else if t := time.Unix(job.NextRun, 0); t.Before(next) {
+				next = t
+			}
+		}
+		s.lock.Unlock()
+
+		sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+		for i := range due {
+			s.run(&due[i])
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// run publishes a due job as its owner and records the outcome.
+func (s *Scheduler) run(job *Job) {
+	status, subscribers, errText := AuditPublished, int64(0), ""
+	user, found := s.auth.User(job.Owner)
+	command, err := s.commands.Parse(job.Command)
+	if !found {
+		status, errText = JobInvalid, fmt.Sprintf("user %q no longer exists", job.Owner)
+	} else if err != nil {
+		status, errText = JobInvalid, err.Error()
+	} else if subscribers, err = s.commander.Publish(user, "scheduler", command, job.Command, job.Confirmed); err != nil {
+		// a command that became dangerous after it was scheduled is refused
+		// until the job is confirmed again with an update
+		status, errText = AuditFailed, err.Error()
+		if err == ErrCommandDenied || err == ErrNotConfirmed {
+			status = AuditDenied
+		} else if _, throttled := err.(*RateLimitError); throttled {
+			status = AuditThrottled
+		}
+	}
+	if len(errText) > 0 {
+		log.Printf("Scheduled job %d: %s\n", job.ID, errText)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, found := s.jobs[job.ID]
+	if !found || current.NextRun != job.NextRun {
+		// deleted or rescheduled while running
+		return
+	}
+	now := time.Now()
+	current.LastRun = now.Unix()
+	current.LastStatus = status
+	current.LastSubscribers = subscribers
+	current.LastError = errText
+	if current.At > 0 {
+		current.Enabled = false
+	}
+	s.schedule(current, now)
+	s.saveOrLog()
+}
+
+// saveOrLog saves the jobs, logging failures. The jobs in memory stay
+// current either way.
+func (s *Scheduler) saveOrLog() {
+	if err := s.save(); err != nil {
+		log.Printf("Error saving schedule! %v\n", err)
+	}
+}
+
+func (s *Scheduler) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	js, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,223 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestScheduler returns a scheduler keeping its jobs in dir, publishing
+// through newTestCommander with an audit log in dir.
+func newTestScheduler(t *testing.T, dir string) (*Scheduler, *AuditLog) {
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commander := newTestCommander(t, audit, nil)
+	s, err := OpenScheduler(filepath.Join(dir, "schedule.json"), commander.auth, newTestRegistry(t), commander)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, audit
+}
+
+func TestSchedulerAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := newTestScheduler(t, dir)
+	bob, _ := s.auth.User("bob")
+	alice, _ := s.auth.User("alice")
+
+	before := time.Now()
+	job, err := s.Add(bob, &JobRequest{Command: " 1::0.5,0.5::spawnbed Bed ", Cron: "0 * * * *"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := before.UTC().Truncate(time.Hour).Add(time.Hour)
+	if job.ID != 1 || job.Owner != "bob" || job.Command != "1::0.5,0.5::spawnbed Bed" || !job.Enabled || job.Confirmed || job.NextRun != next.Unix() {
+		t.Errorf("Add() = %+v, want job 1 of bob next running at %v", job, next)
+	}
+
+	at := time.Now().Add(time.Hour).Unix()
+	disabled := false
+	for _, c := range []struct {
+		user *Session
+		req  JobRequest
+		want error
+	}{
+		{bob, JobRequest{Command: "broadcast hi", At: at}, ErrCommandDenied},
+		{alice, JobRequest{Command: "Server::1::destroyall", At: at}, ErrNotConfirmed},
+		{alice, JobRequest{Command: "Server::9::destroywilddinos", At: at}, nil},
+		{alice, JobRequest{Command: "broadcast hi"}, nil},
+		{alice, JobRequest{Command: "broadcast hi", Cron: "@daily", At: at}, nil},
+		{alice, JobRequest{Command: "broadcast hi", At: time.Now().Add(-time.Minute).Unix()}, nil},
+		{alice, JobRequest{Command: "broadcast hi", Cron: "61 * * * *"}, nil},
+		{alice, JobRequest{Command: "broadcast hi", Cron: "0 0 30 2 *"}, nil},
+	} {
+		if _, err := s.Add(c.user, &c.req, false); err == nil || (c.want != nil && err != c.want) {
+			t.Errorf("Add(%s, %+v) = %v, want %v", c.user.Name, c.req, err, c.want)
+		}
+	}
+
+	// a confirmed dangerous command is remembered as such
+	job, err = s.Add(alice, &JobRequest{Command: "Server::1::destroyall", At: at, Enabled: &disabled}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != 2 || !job.Confirmed || job.Enabled || job.NextRun != 0 {
+		t.Errorf("Add() = %+v, want a confirmed disabled job 2", job)
+	}
+	// but a command that is not dangerous is not
+	job, err = s.Add(alice, &JobRequest{Command: "broadcast hi", At: at}, true)
+	if err != nil || job.Confirmed || job.NextRun != at {
+		t.Errorf("Add() = %+v, %v, want an unconfirmed job at %d", job, err, at)
+	}
+
+	// the jobs are kept across restarts
+	reopened, _ := newTestScheduler(t, dir)
+	if got := reopened.Jobs(); len(got) != 3 || got[0].ID != 1 || got[1] != s.Jobs()[1] {
+		t.Errorf("Jobs() after a restart = %+v, want %+v", got, s.Jobs())
+	}
+	if job, err := reopened.Add(bob, &JobRequest{Command: "1::0.5,0.5::spawnbed Bed", At: at}, false); err != nil || job.ID != 4 {
+		t.Errorf("Add() after a restart = %+v, %v, want job 4", job, err)
+	}
+}
+
+func TestSchedulerUpdateDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := newTestScheduler(t, dir)
+	bob, _ := s.auth.User("bob")
+	alice, _ := s.auth.User("alice")
+
+	at := time.Now().Add(time.Hour).Unix()
+	bobs, err := s.Add(bob, &JobRequest{Command: "1::0.5,0.5::spawnbed Bed", At: at}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alices, err := s.Add(alice, &JobRequest{Command: "broadcast hi", Cron: "@hourly"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only owners and roles allowed every command change jobs
+	disabled := false
+	if _, err := s.Update(bob, alices.ID, &JobRequest{Command: "1::0.5,0.5::spawnbed Bed", At: at}, false); err != ErrNotJobOwner {
+		t.Errorf("Update() of another's job = %v, want %v", err, ErrNotJobOwner)
+	}
+	if _, err := s.Update(bob, 99, &JobRequest{Command: "1::0.5,0.5::spawnbed Bed", At: at}, false); err != ErrNoJob {
+		t.Errorf("Update() of a missing job = %v, want %v", err, ErrNoJob)
+	}
+	job, err := s.Update(bob, bobs.ID, &JobRequest{Command: "1::0.5,0.5::spawnshipfast Ship", At: at, Enabled: &disabled}, false)
+	if err != nil || job.Command != "1::0.5,0.5::spawnshipfast Ship" || job.Enabled || job.NextRun != 0 || job.Created != bobs.Created {
+		t.Errorf("Update() = %+v, %v, want the new disabled command", job, err)
+	}
+	// a failed update leaves the job as it was
+	if _, err := s.Update(bob, bobs.ID, &JobRequest{Command: "broadcast hi", At: at}, false); err != ErrCommandDenied {
+		t.Errorf("Update() to a denied command = %v, want %v", err, ErrCommandDenied)
+	}
+	if got, _ := s.Job(bobs.ID); got != job {
+		t.Errorf("Job() after a failed update = %+v, want %+v", got, job)
+	}
+	job, err = s.Update(alice, bobs.ID, &JobRequest{Command: "Server::1::destroyall", At: at}, true)
+	if err != nil || job.Owner != "alice" || !job.Confirmed || job.NextRun != at {
+		t.Errorf("Update() by an admin = %+v, %v, want alice's confirmed job", job, err)
+	}
+
+	if err := s.Delete(bob, bobs.ID); err != ErrNotJobOwner {
+		t.Errorf("Delete() of another's job = %v, want %v", err, ErrNotJobOwner)
+	}
+	if err := s.Delete(alice, bobs.ID); err != nil {
+		t.Errorf("Delete() = %v", err)
+	}
+	if err := s.Delete(alice, bobs.ID); err != ErrNoJob {
+		t.Errorf("second Delete() = %v, want %v", err, ErrNoJob)
+	}
+	if _, found := s.Job(bobs.ID); found {
+		t.Errorf("Job() found a deleted job")
+	}
+	if got := s.Jobs(); len(got) != 1 || got[0].ID != alices.ID {
+		t.Errorf("Jobs() = %+v, want only job %d", got, alices.ID)
+	}
+}
+
+func TestSchedulerMissed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	past := time.Now().Add(-time.Hour).Unix()
+	js := `[{"ID": 3, "Owner": "alice", "Command": "broadcast hi", "At": ` + strconv.FormatInt(past, 10) + `, "Enabled": true}]`
+	if err := ioutil.WriteFile(filepath.Join(dir, "schedule.json"), []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestScheduler(t, dir)
+	job, found := s.Job(3)
+	if !found || job.Enabled || job.LastStatus != JobMissed || job.NextRun != 0 {
+		t.Errorf("Job(3) = %+v, want it missed", job)
+	}
+	if reopened, _ := newTestScheduler(t, dir); reopened.Jobs()[0] != job {
+		t.Errorf("missed job not saved")
+	}
+}
+
+func TestSchedulerRunConfirmation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, audit := newTestScheduler(t, dir)
+	alice, _ := s.auth.User("alice")
+
+	at := time.Now().Add(time.Hour).Unix()
+	confirmed, err := s.Add(alice, &JobRequest{Command: "Server::1::destroyall", At: at}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := s.Add(alice, &JobRequest{Command: "broadcast hi", Cron: "@hourly"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// broadcast became dangerous after it was scheduled
+	s.commander.dangerous["broadcast"] = true
+
+	for _, job := range []Job{confirmed, plain} {
+		s.run(&job)
+	}
+	job, _ := s.Job(plain.ID)
+	if job.LastStatus != AuditDenied || job.LastError != ErrNotConfirmed.Error() || !job.Enabled || job.NextRun == 0 {
+		t.Errorf("unconfirmed job after a run = %+v, want it denied and still scheduled", job)
+	}
+	// the confirmed job got as far as publishing, with no redis to publish to
+	job, _ = s.Job(confirmed.ID)
+	if job.LastStatus != AuditFailed || job.Enabled || job.NextRun != 0 || job.LastRun == 0 {
+		t.Errorf("confirmed job after a run = %+v, want it failed and done", job)
+	}
+
+	entries, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, entry := range entries {
+		if entry.RemoteAddr != "scheduler" || entry.User != "alice" {
+			t.Errorf("audit entry %+v, want alice from the scheduler", entry)
+		}
+		statuses[entry.Command] += entry.Status + " "
+	}
+	if statuses["destroyall"] != "attempt failed " || statuses["broadcast"] != "denied " {
+		t.Errorf("audit statuses = %q", statuses)
+	}
+}
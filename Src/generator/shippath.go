@@ -0,0 +1,181 @@
+package generator
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+// samplesPerSegment is the number of line segments each spline segment is
+// flattened into.
+const samplesPerSegment = 32
+
+// ShipPathSpline is a ship path evaluated the way the game does: every pair of
+// nodes is joined by a cubic Bezier whose control points lie along each
+// node's rotation at ControlPointsDistance. Looping paths join the last node
+// back to the first.
+type ShipPathSpline struct {
+	Path     *atlas.ShipPath
+	Points   [][2]float64 // flattened spline in world units
+	Distance []float64    // distance along the path to each point
+}
+
+// NewShipPathSpline evaluates a ship path.
+func NewShipPathSpline(path *atlas.ShipPath) *ShipPathSpline {
+	s := &ShipPathSpline{Path: path}
+	nodes := path.Nodes
+	if len(nodes) == 0 {
+		return s
+	}
+
+	segments := len(nodes) - 1
+	if path.IsLooping && len(nodes) > 1 {
+		segments = len(nodes)
+	}
+	s.add(nodes[0].WorldX, nodes[0].WorldY)
+	for i := 0; i < segments; i++ {
+		from := &nodes[i]
+		to := &nodes[(i+1)%len(nodes)]
+		fromDX, fromDY := direction(from.Rotation)
+		toDX, toDY := direction(to.Rotation)
+		p0 := [2]float64{from.WorldX, from.WorldY}
+		p1 := [2]float64{from.WorldX + fromDX*from.ControlPointsDistance, from.WorldY + fromDY*from.ControlPointsDistance}
+		p2 := [2]float64{to.WorldX - toDX*to.ControlPointsDistance, to.WorldY - toDY*to.ControlPointsDistance}
+		p3 := [2]float64{to.WorldX, to.WorldY}
+		for j := 1; j <= samplesPerSegment; j++ {
+			x, y := bezier(p0, p1, p2, p3, float64(j)/samplesPerSegment)
+			s.add(x, y)
+		}
+	}
+	return s
+}
+
+// direction returns the unit vector of a rotation in degrees.
+func direction(rotation float64) (float64, float64) {
+	rad := rotation * math.Pi / 180
+	return math.Cos(rad), math.Sin(rad)
+}
+
+func bezier(p0, p1, p2, p3 [2]float64, t float64) (float64, float64) {
+	u := 1 - t
+	a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+	return a*p0[0] + b*p1[0] + c*p2[0] + d*p3[0], a*p0[1] + b*p1[1] + c*p2[1] + d*p3[1]
+}
+
+func (s *ShipPathSpline) add(x, y float64) {
+	distance := 0.0
+	if n := len(s.Points); n > 0 {
+		last := s.Points[n-1]
+		distance = s.Distance[n-1] + math.Hypot(x-last[0], y-last[1])
+	}
+	s.Points = append(s.Points, [2]float64{x, y})
+	s.Distance = append(s.Distance, distance)
+}
+
+// Length returns the length of the path in world units.
+func (s *ShipPathSpline) Length() float64 {
+	if len(s.Distance) == 0 {
+		return 0
+	}
+	return s.Distance[len(s.Distance)-1]
+}
+
+// At returns the world location and heading in degrees at a distance along
+// the path. Distances past either end are clamped.
+func (s *ShipPathSpline) At(distance float64) (x, y, heading float64) {
+	if len(s.Points) == 0 {
+		return
+	}
+	if len(s.Points) == 1 || distance <= 0 {
+		x, y = s.Points[0][0], s.Points[0][1]
+		if len(s.Points) > 1 {
+			heading = headingBetween(s.Points[0], s.Points[1])
+		}
+		return
+	}
+
+	i := sort.SearchFloat64s(s.Distance, distance)
+	if i >= len(s.Points) {
+		i = len(s.Points) - 1
+		distance = s.Distance[i]
+	}
+	from, to := s.Points[i-1], s.Points[i]
+	t := 0.0
+	if span := s.Distance[i] - s.Distance[i-1]; span > 0 {
+		t = (distance - s.Distance[i-1]) / span
+	}
+	return from[0] + (to[0]-from[0])*t, from[1] + (to[1]-from[1])*t, headingBetween(from, to)
+}
+
+func headingBetween(from, to [2]float64) float64 {
+	return math.Atan2(to[1]-from[1], to[0]-from[0]) * 180 / math.Pi
+}
+
+// NPCPosition estimates where the most recently auto-spawned NPC ship is.
+// Ships are assumed to spawn at the start of the path on every multiple of
+// AutoSpawnEveryUTCInterval seconds since the UTC epoch and sail at a constant
+// speed in world units per second. ok is false when the path does not auto
+// spawn or the ship has already reached the end of a non looping path.
+func (s *ShipPathSpline) NPCPosition(now time.Time, speed float64) (x, y, heading float64, ok bool) {
+	interval := s.Path.AutoSpawnEveryUTCInterval
+	length := s.Length()
+	if !s.Path.AutoSpawn || interval <= 0 || speed <= 0 || length <= 0 {
+		return
+	}
+
+	elapsed := math.Mod(float64(now.UnixNano())/float64(time.Second), interval)
+	distance := elapsed * speed
+	if distance > length {
+		if !s.Path.IsLooping {
+			return
+		}
+		distance = math.Mod(distance, length)
+	}
+	x, y, heading = s.At(distance)
+	ok = true
+	return
+}
+
+// ShipPathsGeoJSON returns every ship path as a LineString in map coordinates.
+// When speed is positive the estimated NPC ship positions at now are added as
+// Points.
+func ShipPathsGeoJSON(splines []*ShipPathSpline, grid coords.Grid, now time.Time, speed float64) *GeoJSONFeatureCollection {
+	collection := NewFeatureCollection()
+	for _, spline := range splines {
+		if len(spline.Points) < 2 {
+			continue
+		}
+		line := make([][2]float64, len(spline.Points))
+		for i, p := range spline.Points {
+			line[i][0], line[i][1] = grid.WorldToMap(p[0], p[1])
+		}
+		feature := NewFeature(spline.Path.PathID, "LineString", line)
+		feature.Properties["kind"] = "shippath"
+		feature.Properties["PathName"] = spline.Path.PathName
+		feature.Properties["IsLooping"] = spline.Path.IsLooping
+		feature.Properties["AutoSpawn"] = spline.Path.AutoSpawn
+		feature.Properties["AutoSpawnShipClass"] = spline.Path.AutoSpawnShipClass
+		feature.Properties["AutoSpawnEveryUTCInterval"] = spline.Path.AutoSpawnEveryUTCInterval
+		feature.Properties["Length"] = grid.WorldToMapDistance(spline.Length())
+		collection.Features = append(collection.Features, feature)
+
+		if speed <= 0 {
+			continue
+		}
+		if x, y, heading, ok := spline.NPCPosition(now, speed); ok {
+			var point [2]float64
+			point[0], point[1] = grid.WorldToMap(x, y)
+			ship := NewFeature(nil, "Point", point)
+			ship.Properties["kind"] = "npcship"
+			ship.Properties["PathID"] = spline.Path.PathID
+			ship.Properties["ShipClass"] = spline.Path.AutoSpawnShipClass
+			ship.Properties["Heading"] = heading
+			ship.Properties["GPS"] = grid.FormatGPS(x, y)
+			collection.Features = append(collection.Features, ship)
+		}
+	}
+	return collection
+}
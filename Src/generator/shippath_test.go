@@ -0,0 +1,147 @@
+package generator
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"AtlasMapViewer/atlas"
+)
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestShipPathSplineEndpoints(t *testing.T) {
+	straight := NewShipPathSpline(&atlas.ShipPath{Nodes: []atlas.ShipPathNode{
+		{WorldX: 0, WorldY: 0, Rotation: 0, ControlPointsDistance: 100},
+		{WorldX: 1000, WorldY: 0, Rotation: 0, ControlPointsDistance: 100},
+	}})
+	if got := straight.Length(); !near(got, 1000, 1e-6) {
+		t.Errorf("straight Length() = %v, want 1000", got)
+	}
+	for _, c := range []struct {
+		distance      float64
+		x, y, heading float64
+	}{
+		{-50, 0, 0, 0},
+		{0, 0, 0, 0},
+		{300, 300, 0, 0},
+		{1000, 1000, 0, 0},
+		{5000, 1000, 0, 0},
+	} {
+		x, y, heading := straight.At(c.distance)
+		if !near(x, c.x, 1e-6) || !near(y, c.y, 1e-6) || !near(heading, c.heading, 1e-6) {
+			t.Errorf("straight At(%v) = %v %v %v, want %v %v %v", c.distance, x, y, heading, c.x, c.y, c.heading)
+		}
+	}
+
+	// a quarter turn from heading east to heading south
+	curve := NewShipPathSpline(&atlas.ShipPath{Nodes: []atlas.ShipPathNode{
+		{WorldX: 0, WorldY: 0, Rotation: 0, ControlPointsDistance: 500},
+		{WorldX: 1000, WorldY: 1000, Rotation: 90, ControlPointsDistance: 500},
+	}})
+	// headings follow the flattened segments, so they are off by a degree or two
+	if x, y, heading := curve.At(0); x != 0 || y != 0 || !near(heading, 0, 2) {
+		t.Errorf("curve start = %v %v %v, want 0 0 0", x, y, heading)
+	}
+	if x, y, heading := curve.At(curve.Length()); !near(x, 1000, 1e-6) || !near(y, 1000, 1e-6) || !near(heading, 90, 2) {
+		t.Errorf("curve end = %v %v %v, want 1000 1000 90", x, y, heading)
+	}
+
+	// the flattened length is close to the exact arc length
+	p0, p1, p2, p3 := [2]float64{0, 0}, [2]float64{500, 0}, [2]float64{1000, 500}, [2]float64{1000, 1000}
+	exact := 0.0
+	lastX, lastY := bezier(p0, p1, p2, p3, 0)
+	for i := 1; i <= 100000; i++ {
+		x, y := bezier(p0, p1, p2, p3, float64(i)/100000)
+		exact += math.Hypot(x-lastX, y-lastY)
+		lastX, lastY = x, y
+	}
+	if got := curve.Length(); got > exact || got < exact*0.999 {
+		t.Errorf("curve Length() = %v, want just under %v", got, exact)
+	}
+}
+
+func TestShipPathSplineMonotonic(t *testing.T) {
+	s := NewShipPathSpline(&atlas.ShipPath{IsLooping: true, Nodes: []atlas.ShipPathNode{
+		{WorldX: 0, WorldY: 0, Rotation: 0, ControlPointsDistance: 300},
+		{WorldX: 1000, WorldY: 500, Rotation: 90, ControlPointsDistance: 300},
+		{WorldX: 0, WorldY: 1000, Rotation: 180, ControlPointsDistance: 300},
+	}})
+	if got, want := len(s.Points), 3*samplesPerSegment+1; got != want {
+		t.Fatalf("looping path has %d points, want %d", got, want)
+	}
+	if last := s.Points[len(s.Points)-1]; !near(last[0], 0, 1e-6) || !near(last[1], 0, 1e-6) {
+		t.Errorf("looping path ends at %v, want the first node", last)
+	}
+	for i := 1; i < len(s.Distance); i++ {
+		if s.Distance[i] <= s.Distance[i-1] {
+			t.Fatalf("Distance[%d] = %v after %v, want increasing", i, s.Distance[i], s.Distance[i-1])
+		}
+	}
+
+	// walking the path in small steps never covers more than the step
+	step := s.Length() / 1000
+	lastX, lastY, _ := s.At(0)
+	walked := 0.0
+	for d := step; d <= s.Length(); d += step {
+		x, y, _ := s.At(d)
+		moved := math.Hypot(x-lastX, y-lastY)
+		if moved > step+1e-6 {
+			t.Fatalf("At(%v) moved %v, more than the step %v", d, moved, step)
+		}
+		walked += moved
+		lastX, lastY = x, y
+	}
+	if walked < s.Length()*0.99 {
+		t.Errorf("walked %v of %v", walked, s.Length())
+	}
+}
+
+func TestShipPathNPCPosition(t *testing.T) {
+	path := &atlas.ShipPath{
+		AutoSpawn:                 true,
+		AutoSpawnEveryUTCInterval: 200,
+		Nodes: []atlas.ShipPathNode{
+			{WorldX: 0, WorldY: 0, Rotation: 0, ControlPointsDistance: 100},
+			{WorldX: 1000, WorldY: 0, Rotation: 0, ControlPointsDistance: 100},
+		},
+	}
+	s := NewShipPathSpline(path)
+	const speed = 10
+	// a multiple of the interval, when a ship spawns
+	spawn := time.Unix(200*7000000, 0)
+
+	for _, c := range []struct {
+		name    string
+		looping bool
+		since   time.Duration
+		x       float64
+		ok      bool
+	}{
+		{"spawn", false, 0, 0, true},
+		{"sailing", false, 30 * time.Second, 300, true},
+		{"half seconds", false, 30500 * time.Millisecond, 305, true},
+		{"end of path", false, 100 * time.Second, 1000, true},
+		{"past the end", false, 150 * time.Second, 0, false},
+		{"past the end looping", true, 150 * time.Second, 500, true},
+		{"next interval", false, 230 * time.Second, 300, true},
+		{"before the epoch interval", false, -170 * time.Second, 300, true},
+	} {
+		path.IsLooping = c.looping
+		x, y, heading, ok := s.NPCPosition(spawn.Add(c.since), speed)
+		if ok != c.ok || (ok && (!near(x, c.x, 1e-3) || !near(y, 0, 1e-6) || !near(heading, 0, 1e-6))) {
+			t.Errorf("%s: NPCPosition() = %v %v %v %v, want %v 0 0 %v", c.name, x, y, heading, ok, c.x, c.ok)
+		}
+	}
+
+	path.AutoSpawn = false
+	if _, _, _, ok := s.NPCPosition(spawn, speed); ok {
+		t.Errorf("NPCPosition() ok without AutoSpawn")
+	}
+	path.AutoSpawn = true
+	if _, _, _, ok := s.NPCPosition(spawn, 0); ok {
+		t.Errorf("NPCPosition() ok without a speed")
+	}
+}
@@ -0,0 +1,188 @@
+package generator
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Snapshot is an encoded, immutable view of one data set.
+type Snapshot struct {
+	Name    string
+	Version uint64
+	JSON    []byte
+	epoch   int64
+}
+
+// ETag returns the entity tag for the snapshot. The store epoch is included so
+// versions from a previous run never match.
+func (s *Snapshot) ETag() string {
+	return "\"" + strconv.FormatInt(s.epoch, 36) + "-" + s.Name + "-" + strconv.FormatUint(s.Version, 10) + "\""
+}
+
+// SnapshotStore holds the typed data served to the front end. Every update
+// bumps a monotonically increasing version shared by all data sets.
+type SnapshotStore struct {
+	lock     sync.RWMutex
+	epoch    int64
+	version  uint64
+	islands  *IslandOutput
+	entities map[string]EntityInfo
+	orphans  map[string]string
+	tribes   map[string]string
+	encoded  map[string]Snapshot
+}
+
+// NewSnapshotStore returns a store with every data set empty.
+func NewSnapshotStore() *SnapshotStore {
+	s := &SnapshotStore{
+		epoch: time.Now().UnixNano(),
+		islands: &IslandOutput{
+			Islands:   make([]IslandInfoOutput, 0),
+			Companies: make([]CompanyInfoOutput, 0),
+		},
+		entities: make(map[string]EntityInfo),
+		orphans:  make(map[string]string),
+		tribes:   make(map[string]string),
+		encoded:  make(map[string]Snapshot),
+	}
+	for _, name := range []string{"islands", "entities", "orphans", "tribes", "toptribes"} {
+		s.encoded[name] = Snapshot{Name: name, JSON: []byte("{}"), epoch: s.epoch}
+	}
+	return s
+}
+
+// Version returns the version of the most recent update.
+func (s *SnapshotStore) Version() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.version
+}
+
+// Tag returns an entity tag for data derived from the whole store, valid until
+// the next update.
+func (s *SnapshotStore) Tag(name string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	snapshot := Snapshot{Name: name, Version: s.version, epoch: s.epoch}
+	return snapshot.ETag()
+}
+
+// Get returns the encoded data set with the given name.
+func (s *SnapshotStore) Get(name string) Snapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.encoded[name]
+}
+
+// Static wraps data that never changes for the life of the process so it can
+// be served with the same conditional request handling.
+func (s *SnapshotStore) Static(name string, v interface{}) (Snapshot, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Name: name, JSON: js, epoch: s.epoch}, nil
+}
+
+// Islands returns the current island output. It must not be modified.
+func (s *SnapshotStore) Islands() *IslandOutput {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.islands
+}
+
+// SetIslands replaces the island output.
+func (s *SnapshotStore) SetIslands(islands *IslandOutput) error {
+	js, err := json.Marshal(islands)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.islands = islands
+	s.set("islands", js)
+	s.lock.Unlock()
+	return nil
+}
+
+// Entities returns the visible entities keyed by EntityID. The map must not be
+// modified.
+func (s *SnapshotStore) Entities() map[string]EntityInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.entities
+}
+
+// SetEntities replaces the visible entities along with their already encoded
+// json.
+func (s *SnapshotStore) SetEntities(entities map[string]EntityInfo, js []byte) {
+	s.lock.Lock()
+	s.entities = entities
+	s.set("entities", js)
+	s.lock.Unlock()
+}
+
+// Orphans returns entities hidden because their parent does not exist, mapped
+// to the missing parent ID. The map must not be modified.
+func (s *SnapshotStore) Orphans() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.orphans
+}
+
+// SetOrphans replaces the orphaned entities.
+func (s *SnapshotStore) SetOrphans(orphans map[string]string) error {
+	js, err := json.Marshal(orphans)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.orphans = orphans
+	s.set("orphans", js)
+	s.lock.Unlock()
+	return nil
+}
+
+// Tribes returns tribe names keyed by tribe ID. The map must not be modified.
+func (s *SnapshotStore) Tribes() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tribes
+}
+
+// SetTribes replaces the tribe names.
+func (s *SnapshotStore) SetTribes(tribes map[string]string) error {
+	js, err := json.Marshal(tribes)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.tribes = tribes
+	s.set("tribes", js)
+	s.lock.Unlock()
+	return nil
+}
+
+// SetTopTribes replaces the top tribes served as tribes.json.
+func (s *SnapshotStore) SetTopTribes(top *TribeOutput) error {
+	js, err := json.Marshal(top)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.set("toptribes", js)
+	s.lock.Unlock()
+	return nil
+}
+
+// set bumps the version and stores the encoded data set. Callers hold the lock.
+func (s *SnapshotStore) set(name string, js []byte) {
+	s.version++
+	s.encoded[name] = Snapshot{
+		Name:    name,
+		Version: s.version,
+		JSON:    js,
+		epoch:   s.epoch,
+	}
+}
@@ -0,0 +1,48 @@
+package generator
+
+import "testing"
+
+func TestSnapshotStore(t *testing.T) {
+	store := NewSnapshotStore()
+	empty := store.Get("tribes")
+	if string(empty.JSON) != "{}" || empty.Version != 0 {
+		t.Errorf("Get() before an update = %q version %d", empty.JSON, empty.Version)
+	}
+
+	tag := store.Tag("leaderboard")
+	if err := store.SetTribes(map[string]string{"1": "Tribe"}); err != nil {
+		t.Fatal(err)
+	}
+	tribes := store.Get("tribes")
+	if string(tribes.JSON) != `{"1":"Tribe"}` || tribes.Version != 1 || store.Version() != 1 {
+		t.Errorf("Get() = %q version %d, store version %d", tribes.JSON, tribes.Version, store.Version())
+	}
+	if tribes.ETag() == empty.ETag() {
+		t.Errorf("ETag() did not change with the update")
+	}
+	if store.Tag("leaderboard") == tag {
+		t.Errorf("Tag() did not change with the update")
+	}
+	// other data sets keep their version
+	if orphans := store.Get("orphans"); orphans.Version != 0 || orphans.ETag() == tribes.ETag() {
+		t.Errorf("orphans = version %d, ETag %s", orphans.Version, orphans.ETag())
+	}
+
+	// a new store never reuses the tags of another one
+	other := NewSnapshotStore()
+	other.epoch++
+	if err := other.SetTribes(map[string]string{"1": "Tribe"}); err != nil {
+		t.Fatal(err)
+	}
+	if otherTribes := other.Get("tribes"); otherTribes.ETag() == tribes.ETag() {
+		t.Errorf("ETag() matched across stores")
+	}
+
+	static, err := store.Static("config", []int{1})
+	if err != nil || string(static.JSON) != "[1]" {
+		t.Errorf("Static() = %q, %v", static.JSON, err)
+	}
+	if again, _ := store.Static("config", []int{1}); again.ETag() != static.ETag() {
+		t.Errorf("Static() tags differ: %s and %s", again.ETag(), static.ETag())
+	}
+}
@@ -0,0 +1,208 @@
+package generator
+
+import (
+	"math"
+	"sync"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+// spatialEntity is an indexed entity with its world location.
+type spatialEntity struct {
+	info   *EntityInfo
+	x, y   float64
+	server uint32
+}
+
+// spatialIsland is an indexed island with its footprint in world units.
+type spatialIsland struct {
+	island    *atlas.IslandInstance
+	server    uint32
+	footprint [][2]float64
+}
+
+// NearestIsland is the answer to a nearest island lookup. Distance is in map
+// coordinates, measured to the edge of the island's footprint and zero when
+// the point is on the island.
+type NearestIsland struct {
+	IslandID int     `json:"IslandID"`
+	Name     string  `json:"Name"`
+	ServerID uint32  `json:"ServerId"`
+	X        float64 `json:"X"`
+	Y        float64 `json:"Y"`
+	Distance float64 `json:"Distance"`
+}
+
+// SpatialIndex answers location queries over the static islands and the live
+// entities. Queries take and return map coordinates.
+type SpatialIndex struct {
+	grid    coords.Grid
+	islands *QuadTree
+
+	lock      sync.RWMutex
+	version   uint64
+	entities  *QuadTree
+	locations map[string]*spatialEntity
+}
+
+// NewSpatialIndex indexes the islands of every server in the grid.
+func NewSpatialIndex(gridConfig *atlas.GridConfig) *SpatialIndex {
+	grid := coords.New(gridConfig)
+	s := &SpatialIndex{
+		grid:      grid,
+		islands:   NewQuadTree(worldBounds(grid)),
+		entities:  NewQuadTree(worldBounds(grid)),
+		locations: make(map[string]*spatialEntity),
+	}
+	for i := range gridConfig.Servers {
+		server := &gridConfig.Servers[i]
+		for j := range server.IslandInstances {
+			island := &server.IslandInstances[j]
+			footprint := rotatedRect(island.WorldX, island.WorldY, island.IslandWidth, island.IslandHeight, island.Rotation)
+			s.islands.Insert(polygonBounds(footprint), &spatialIsland{island, coords.Pack(uint16(server.GridX), uint16(server.GridY)), footprint})
+		}
+	}
+	return s
+}
+
+// worldBounds returns the bounds of a grid in world units.
+func worldBounds(grid coords.Grid) Bounds {
+	return Bounds{0, 0, grid.Width(), grid.Height()}
+}
+
+// UpdateEntities rebuilds the entity index from a snapshot of the visible
+// entities. Kids are placed relative to their parent the same way the viewer
+// draws them.
+func (s *SpatialIndex) UpdateEntities(entities map[string]EntityInfo) {
+	tree := NewQuadTree(worldBounds(s.grid))
+	locations := make(map[string]*spatialEntity, len(entities))
+	for id := range entities {
+		info := entities[id]
+		location := info
+		if parent, found := entities[info.ParentEntityID]; found && hasParent(&info) {
+			location.ServerXRelativeLocation += parent.ServerXRelativeLocation
+			location.ServerYRelativeLocation += parent.ServerYRelativeLocation
+		}
+		x, y := worldLocation(&location, s.grid)
+		entity := &spatialEntity{&info, x, y, coords.Pack(info.ServerID[1], info.ServerID[0])}
+		tree.Insert(PointBounds(x, y), entity)
+		locations[id] = entity
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version++
+	s.entities = tree
+	s.locations = locations
+}
+
+// Version returns the number of entity updates applied.
+func (s *SpatialIndex) Version() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.version
+}
+
+// EntitiesIn returns the entities inside a bounding box.
+func (s *SpatialIndex) EntitiesIn(minX, minY, maxX, maxY float64) map[string]EntityInfo {
+	x0, y0 := s.grid.MapToWorld(math.Min(minX, maxX), math.Min(minY, maxY))
+	x1, y1 := s.grid.MapToWorld(math.Max(minX, maxX), math.Max(minY, maxY))
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	found := make(map[string]EntityInfo)
+	s.entities.Query(Bounds{x0, y0, x1, y1}, func(value interface{}) bool {
+		entity := value.(*spatialEntity)
+		found[entity.info.EntityID] = *entity.info
+		return true
+	})
+	s.addParents(found)
+	return found
+}
+
+// EachEntityIn calls fn with every entity inside a bounding box and its
+// location in map coordinates.
+func (s *SpatialIndex) EachEntityIn(minX, minY, maxX, maxY float64, fn func(info *EntityInfo, x, y float64)) {
+	x0, y0 := s.grid.MapToWorld(math.Min(minX, maxX), math.Min(minY, maxY))
+	x1, y1 := s.grid.MapToWorld(math.Max(minX, maxX), math.Max(minY, maxY))
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.entities.Query(Bounds{x0, y0, x1, y1}, func(value interface{}) bool {
+		entity := value.(*spatialEntity)
+		x, y := s.grid.WorldToMap(entity.x, entity.y)
+		fn(entity.info, x, y)
+		return true
+	})
+}
+
+// EntitiesNear returns the entities within radius of a point.
+func (s *SpatialIndex) EntitiesNear(x, y, radius float64) map[string]EntityInfo {
+	wx, wy := s.grid.MapToWorld(x, y)
+	wr := radius * s.grid.Extent()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	found := make(map[string]EntityInfo)
+	s.entities.Query(Bounds{wx - wr, wy - wr, wx + wr, wy + wr}, func(value interface{}) bool {
+		entity := value.(*spatialEntity)
+		if math.Hypot(entity.x-wx, entity.y-wy) <= wr {
+			found[entity.info.EntityID] = *entity.info
+		}
+		return true
+	})
+	s.addParents(found)
+	return found
+}
+
+// addParents adds the parent of every kid found, since kids are located
+// relative to their parent. The caller must hold the lock.
+func (s *SpatialIndex) addParents(found map[string]EntityInfo) {
+	missing := make([]string, 0)
+	for _, info := range found {
+		if hasParent(&info) {
+			if _, present := found[info.ParentEntityID]; !present {
+				missing = append(missing, info.ParentEntityID)
+			}
+		}
+	}
+	for _, id := range missing {
+		if parent, ok := s.locations[id]; ok {
+			found[id] = *parent.info
+		}
+	}
+}
+
+// EntityLocation returns the map location of an indexed entity.
+func (s *SpatialIndex) EntityLocation(id string) (x, y float64, ok bool) {
+	s.lock.RLock()
+	entity, ok := s.locations[id]
+	s.lock.RUnlock()
+	if !ok {
+		return
+	}
+	x, y = s.grid.WorldToMap(entity.x, entity.y)
+	return
+}
+
+// NearestIsland returns the island whose footprint is closest to a point, or
+// nil if the grid has no islands.
+func (s *SpatialIndex) NearestIsland(x, y float64) *NearestIsland {
+	wx, wy := s.grid.MapToWorld(x, y)
+	value, distance := s.islands.Nearest(wx, wy, func(value interface{}) float64 {
+		return polygonDistance(value.(*spatialIsland).footprint, wx, wy)
+	}, nil)
+	if value == nil {
+		return nil
+	}
+	found := value.(*spatialIsland)
+	nearest := &NearestIsland{
+		IslandID: found.island.ID,
+		Name:     found.island.Name,
+		ServerID: found.server,
+		Distance: s.grid.WorldToMapDistance(distance),
+	}
+	nearest.X, nearest.Y = s.grid.WorldToMap(found.island.WorldX, found.island.WorldY)
+	return nearest
+}
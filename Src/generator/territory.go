@@ -0,0 +1,169 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+
+	"AtlasMapViewer/atlas/coords"
+
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+const (
+	tileSize          = 256
+	maxTerritoryZoom  = 8
+	territoryAlpha    = 0x80
+	maxTerritoryTiles = 4096
+)
+
+// territoryShape is an island footprint in map coordinates.
+type territoryShape struct {
+	polygon [][2]float64
+	color   color.NRGBA
+	min     [2]float64
+	max     [2]float64
+}
+
+// TerritoryRenderer renders slippy map overlay tiles coloring claimed islands
+// by their owning tribe. Rendered tiles are cached until the claims change.
+type TerritoryRenderer struct {
+	lock    sync.RWMutex
+	crc     uint32
+	shapes  []territoryShape
+	cache   map[string][]byte
+	pending map[string]*sync.WaitGroup
+	empty   []byte
+}
+
+// NewTerritoryRenderer returns a renderer with no claims.
+func NewTerritoryRenderer() *TerritoryRenderer {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, tileSize, tileSize)))
+	return &TerritoryRenderer{
+		cache:   make(map[string][]byte),
+		pending: make(map[string]*sync.WaitGroup),
+		empty:   buf.Bytes(),
+	}
+}
+
+// Update replaces the claims and drops every cached tile when the claim CRC
+// changed.
+func (t *TerritoryRenderer) Update(crc uint32, tribes *map[uint64]*TribeCount, grid coords.Grid) {
+	shapes := make([]territoryShape, 0)
+	for _, tribe := range *tribes {
+		for _, island := range tribe.islands {
+			c := island.Color
+			c.A = territoryAlpha
+			shapes = append(shapes, newTerritoryShape(island.MapFootprint(grid), c))
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if crc == t.crc && t.shapes != nil {
+		return
+	}
+	t.crc = crc
+	t.shapes = shapes
+	t.cache = make(map[string][]byte)
+}
+
+func newTerritoryShape(polygon [][2]float64, c color.NRGBA) territoryShape {
+	b := polygonBounds(polygon)
+	return territoryShape{
+		polygon: polygon,
+		color:   c,
+		min:     [2]float64{b.MinX, b.MinY},
+		max:     [2]float64{b.MaxX, b.MaxY},
+	}
+}
+
+// Version returns the CRC of the claims currently rendered.
+func (t *TerritoryRenderer) Version() uint32 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.crc
+}
+
+// Tile returns the PNG for a tile in the viewer's CRS.Simple layout, where
+// zoom 0 is a single tile covering the longest side of the world. The second
+// value is the claim CRC the tile was rendered from.
+func (t *TerritoryRenderer) Tile(z, x, y int) ([]byte, uint32, error) {
+	if z < 0 || z > maxTerritoryZoom || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, 0, fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+	}
+	key := fmt.Sprintf("%d/%d/%d", z, x, y)
+
+	for {
+		t.lock.Lock()
+		crc := t.crc
+		if tile, found := t.cache[key]; found {
+			t.lock.Unlock()
+			return tile, crc, nil
+		}
+		if wait, busy := t.pending[key]; busy {
+			// another request is rendering the same tile
+			t.lock.Unlock()
+			wait.Wait()
+			continue
+		}
+		wait := &sync.WaitGroup{}
+		wait.Add(1)
+		t.pending[key] = wait
+		shapes := t.shapes
+		t.lock.Unlock()
+
+		tile, err := renderTile(shapes, z, x, y, t.empty)
+
+		t.lock.Lock()
+		delete(t.pending, key)
+		if err == nil && crc == t.crc {
+			if len(t.cache) >= maxTerritoryTiles {
+				for k := range t.cache {
+					delete(t.cache, k)
+					break
+				}
+			}
+			t.cache[key] = tile
+		}
+		t.lock.Unlock()
+		wait.Done()
+		return tile, crc, err
+	}
+}
+
+func renderTile(shapes []territoryShape, z, x, y int, empty []byte) ([]byte, error) {
+	scale := float64(int(1)<<uint(z)) * tileSize
+	minX, minY := float64(x*tileSize)/scale, float64(y*tileSize)/scale
+	maxX, maxY := float64((x+1)*tileSize)/scale, float64((y+1)*tileSize)/scale
+
+	var img *image.RGBA
+	var gc *draw2dimg.GraphicContext
+	for i := range shapes {
+		shape := &shapes[i]
+		if shape.max[0] < minX || shape.min[0] > maxX || shape.max[1] < minY || shape.min[1] > maxY {
+			continue
+		}
+		if img == nil {
+			img, gc = newTileContext()
+		}
+		pixels := make([][2]float64, len(shape.polygon))
+		for j, p := range shape.polygon {
+			pixels[j] = [2]float64{p[0]*scale - float64(x*tileSize), p[1]*scale - float64(y*tileSize)}
+		}
+		fillPolygon(gc, pixels, shape.color)
+	}
+	if img == nil {
+		return empty, nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
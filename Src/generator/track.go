@@ -0,0 +1,133 @@
+package generator
+
+import (
+	"sync"
+	"time"
+
+	"AtlasMapViewer/atlas/coords"
+)
+
+// TrackPoint is one recorded world position of an entity.
+type TrackPoint struct {
+	Time int64   `json:"Time"`
+	X    float64 `json:"X"`
+	Y    float64 `json:"Y"`
+}
+
+// TrackStore keeps the most recent positions of every top level entity, e.g.
+// ships, in world units. Tracks outlive the entity until pruned by age so
+// destroyed ships can still be reviewed.
+type TrackStore struct {
+	lock   sync.RWMutex
+	size   int
+	maxAge time.Duration
+	tracks map[string][]TrackPoint
+}
+
+// NewTrackStore returns a store keeping up to size points per entity for at
+// most maxAgeInSeconds. A maxAgeInSeconds of zero or less keeps points until
+// they are pushed out by newer ones.
+func NewTrackStore(size int, maxAgeInSeconds int) *TrackStore {
+	return &TrackStore{
+		size:   size,
+		maxAge: time.Duration(maxAgeInSeconds) * time.Second,
+		tracks: make(map[string][]TrackPoint),
+	}
+}
+
+// Record appends the new positions of added and updated entities, stamped
+// with the time the game last wrote them or now when it is unknown. Entities
+// with a parent are positioned relative to it and are not tracked.
+func (s *TrackStore) Record(delta *EntityDelta, grid coords.Grid, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := func(infos []EntityInfo) {
+		for i := range infos {
+			info := &infos[i]
+			if hasParent(info) {
+				continue
+			}
+			x, y := worldLocation(info, grid)
+			track := s.tracks[info.EntityID]
+			if n := len(track); n > 0 && track[n-1].X == x && track[n-1].Y == y {
+				continue
+			}
+			t := now.Unix()
+			if info.LastUpdatedDBAt > 0 {
+				t = int64(info.LastUpdatedDBAt)
+			}
+			// keep the track in time order
+			if n := len(track); n > 0 && track[n-1].Time > t {
+				t = track[n-1].Time
+			}
+			if len(track) >= s.size {
+				track = append(track[:0], track[len(track)-s.size+1:]...)
+			}
+			s.tracks[info.EntityID] = append(track, TrackPoint{Time: t, X: x, Y: y})
+		}
+	}
+	record(delta.Added)
+	record(delta.Updated)
+}
+
+// Prune drops every point older than the maximum age, if there is one.
+func (s *TrackStore) Prune(now time.Time) {
+	if s.maxAge <= 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldest := now.Add(-s.maxAge).Unix()
+	for id, track := range s.tracks {
+		i := 0
+		for i < len(track) && track[i].Time < oldest {
+			i++
+		}
+		if i == len(track) {
+			delete(s.tracks, id)
+		} else if i > 0 {
+			s.tracks[id] = append(track[:0], track[i:]...)
+		}
+	}
+}
+
+// Track returns a copy of the recorded positions of an entity, oldest first.
+func (s *TrackStore) Track(id string) []TrackPoint {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	track := s.tracks[id]
+	if track == nil {
+		return nil
+	}
+	return append([]TrackPoint(nil), track...)
+}
+
+// TrackFeature returns the track of an entity as a GeoJSON LineString in world
+// units, or a Point when only one position is known. The timestamp of every
+// position is in the "times" property.
+func (s *TrackStore) TrackFeature(id string) *GeoJSONFeature {
+	track := s.Track(id)
+	if len(track) == 0 {
+		return nil
+	}
+
+	coords := make([][2]float64, len(track))
+	times := make([]int64, len(track))
+	for i, p := range track {
+		coords[i] = [2]float64{p.X, p.Y}
+		times[i] = p.Time
+	}
+
+	var feature GeoJSONFeature
+	if len(coords) == 1 {
+		feature = NewFeature(id, "Point", coords[0])
+	} else {
+		feature = NewFeature(id, "LineString", coords)
+	}
+	feature.Properties["EntityID"] = id
+	feature.Properties["times"] = times
+	return &feature
+}
@@ -0,0 +1,112 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+)
+
+func testTrackGrid() coords.Grid {
+	return coords.New(&atlas.GridConfig{GridSize: 1000, TotalGridsX: 2, TotalGridsY: 2})
+}
+
+// trackShip is a ship on the first server last written by the game at
+// updated.
+func trackShip(id string, x, y float64, updated uint64) EntityInfo {
+	return EntityInfo{EntityID: id, ParentEntityID: "0", EntityType: "Ship", ServerXRelativeLocation: x, ServerYRelativeLocation: y, LastUpdatedDBAt: updated}
+}
+
+func TestTrackStoreRecord(t *testing.T) {
+	grid := testTrackGrid()
+	tracks := NewTrackStore(3, 0)
+	now := time.Unix(1000, 0)
+	point := func(t int64, x, y float64) TrackPoint {
+		wx, wy := grid.ServerToWorld(0, 0, x, y)
+		return TrackPoint{Time: t, X: wx, Y: wy}
+	}
+
+	bed := EntityInfo{EntityID: "2", ParentEntityID: "1", EntityType: "Bed", ServerXRelativeLocation: 0.1}
+	tracks.Record(&EntityDelta{Added: []EntityInfo{trackShip("1", 0.1, 0.1, 900), bed}}, grid, now)
+	// an unchanged position is not recorded again
+	tracks.Record(&EntityDelta{Updated: []EntityInfo{trackShip("1", 0.1, 0.1, 950)}}, grid, now)
+	// without a database time the poll time is used
+	tracks.Record(&EntityDelta{Updated: []EntityInfo{trackShip("1", 0.2, 0.1, 0)}}, grid, now)
+	// a database time going backwards keeps the track in order
+	tracks.Record(&EntityDelta{Updated: []EntityInfo{trackShip("1", 0.3, 0.1, 990)}}, grid, now)
+
+	want := []TrackPoint{point(900, 0.1, 0.1), point(1000, 0.2, 0.1), point(1000, 0.3, 0.1)}
+	if got := tracks.Track("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Track(1) = %v, want %v", got, want)
+	}
+	if got := tracks.Track("2"); got != nil {
+		t.Errorf("Track(2) = %v, want entities with a parent untracked", got)
+	}
+
+	// the oldest point makes room for a new one
+	tracks.Record(&EntityDelta{Updated: []EntityInfo{trackShip("1", 0.4, 0.1, 1100)}}, grid, now)
+	want = append(want[1:], point(1100, 0.4, 0.1))
+	if got := tracks.Track("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Track(1) = %v, want %v", got, want)
+	}
+
+	// the returned track is a copy
+	tracks.Track("1")[0].X = -1
+	if got := tracks.Track("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Track(1) changed through a copy: %v", got)
+	}
+}
+
+func TestTrackStorePrune(t *testing.T) {
+	grid := testTrackGrid()
+	tracks := NewTrackStore(10, 100)
+	tracks.Record(&EntityDelta{Added: []EntityInfo{trackShip("1", 0.1, 0.1, 800), trackShip("2", 0.1, 0.1, 800)}}, grid, time.Unix(800, 0))
+	tracks.Record(&EntityDelta{Updated: []EntityInfo{trackShip("1", 0.2, 0.1, 950)}}, grid, time.Unix(950, 0))
+
+	// ages go by the database time, not when the point was recorded
+	tracks.Prune(time.Unix(1000, 0))
+	if got := tracks.Track("1"); len(got) != 1 || got[0].Time != 950 {
+		t.Errorf("Track(1) after Prune() = %v, want the point at 950", got)
+	}
+	if got := tracks.Track("2"); got != nil {
+		t.Errorf("Track(2) after Prune() = %v, want it dropped", got)
+	}
+
+	// without a maximum age nothing is pruned
+	forever := NewTrackStore(10, 0)
+	forever.Record(&EntityDelta{Added: []EntityInfo{trackShip("1", 0.1, 0.1, 1)}}, grid, time.Unix(1, 0))
+	forever.Prune(time.Unix(1e9, 0))
+	if got := forever.Track("1"); len(got) != 1 {
+		t.Errorf("Track(1) without a maximum age = %v, want it kept", got)
+	}
+}
+
+func TestTrackFeature(t *testing.T) {
+	grid := testTrackGrid()
+	tracks := NewTrackStore(10, 0)
+	if f := tracks.TrackFeature("1"); f != nil {
+		t.Errorf("TrackFeature() of an unknown entity = %+v", f)
+	}
+
+	tracks.Record(&EntityDelta{Added: []EntityInfo{trackShip("1", 0.1, 0.1, 100)}}, grid, time.Unix(100, 0))
+	f := tracks.TrackFeature("1")
+	x, y := grid.ServerToWorld(0, 0, 0.1, 0.1)
+	if f == nil || f.Geometry.Type != "Point" || f.Geometry.Coordinates != [2]float64{x, y} {
+		t.Fatalf("TrackFeature() of one position = %+v, want a Point", f)
+	}
+
+	tracks.Record(&EntityDelta{Updated: []EntityInfo{trackShip("1", 0.2, 0.3, 200)}}, grid, time.Unix(200, 0))
+	f = tracks.TrackFeature("1")
+	x2, y2 := grid.ServerToWorld(0, 0, 0.2, 0.3)
+	if f == nil || f.Type != "Feature" || f.ID != "1" || f.Geometry.Type != "LineString" {
+		t.Fatalf("TrackFeature() = %+v, want a LineString feature", f)
+	}
+	if got := f.Geometry.Coordinates; !reflect.DeepEqual(got, [][2]float64{{x, y}, {x2, y2}}) {
+		t.Errorf("TrackFeature() coordinates = %v", got)
+	}
+	if got := f.Properties["times"]; !reflect.DeepEqual(got, []int64{100, 200}) || f.Properties["EntityID"] != "1" {
+		t.Errorf("TrackFeature() properties = %v", f.Properties)
+	}
+}
@@ -0,0 +1,227 @@
+package generator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// tribePalette holds the colors there are ship and bed icons for. Grey and
+// black are reserved for unclaimed and unknown owners.
+var tribePalette = [...]string{
+	"red",
+	"green",
+	"yellow",
+	"blue",
+	"orange",
+	"purple",
+	"cyan",
+	"magenta",
+	"lime",
+	"pink",
+	"teal",
+	"lavender",
+	"brown",
+	"beige",
+	"maroon",
+	"olive",
+	"coral",
+	"navy",
+}
+
+// TribeColors gives every tribe a palette color of its own. Colors are kept
+// across restarts and only change when a tribe's territory comes to neighbour
+// a larger tribe of the same color while another color is free.
+type TribeColors struct {
+	path     string
+	distance float64
+	lock     sync.Mutex
+	colors   map[uint64]string
+}
+
+// OpenTribeColors loads the colors assigned so far from path. A blank path
+// keeps them in memory only. Tribes with islands closer than distance world
+// units are neighbours.
+func OpenTribeColors(path string, distance float64) (*TribeColors, error) {
+	t := &TribeColors{
+		path:     path,
+		distance: distance,
+		colors:   make(map[uint64]string),
+	}
+	if len(path) == 0 {
+		return t, nil
+	}
+	js, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(js, &t.colors); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadTribeColors loads the colors like OpenTribeColors but never saves
+// them, so one-off tools like the export do not change the colors the web
+// service keeps.
+func LoadTribeColors(path string, distance float64) (*TribeColors, error) {
+	t, err := OpenTribeColors(path, distance)
+	if err != nil {
+		return nil, err
+	}
+	t.path = ""
+	return t, nil
+}
+
+// Assign colors the tribes and their island claims, assigning colors to new
+// tribes, and saves the assignment when it changed. Larger tribes keep their
+// color when neighbours collide.
+func (t *TribeColors) Assign(tribes *map[uint64]*TribeCount) error {
+	order := make([]*TribeCount, 0, len(*tribes))
+	for _, tribe := range *tribes {
+		order = append(order, tribe)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].count != order[j].count {
+			return order[i].count > order[j].count
+		}
+		return order[i].tribeID < order[j].tribeID
+	})
+	neighbours := tribeNeighbours(tribes, t.distance)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	usage := make(map[string]int)
+	for _, tribe := range order {
+		if name, found := t.colors[tribe.tribeID]; found {
+			usage[name]++
+		}
+	}
+
+	changed := false
+	settled := make(map[uint64]bool, len(order))
+	for _, tribe := range order {
+		name, found := t.colors[tribe.tribeID]
+		if !found || t.collides(name, neighbours[tribe.tribeID], settled) {
+			if found {
+				usage[name]--
+			}
+			if next := t.pick(tribe.tribeID, neighbours[tribe.tribeID], usage); next != name {
+				name = next
+				t.colors[tribe.tribeID] = name
+				changed = true
+			}
+			usage[name]++
+		}
+		settled[tribe.tribeID] = true
+
+		tribe.color = name
+		for _, island := range tribe.islands {
+			island.Color = colorValues[name]
+			island.ColorName = name
+		}
+	}
+
+	if changed {
+		return t.save()
+	}
+	return nil
+}
+
+// collides reports whether a settled neighbour already has the color.
+func (t *TribeColors) collides(name string, neighbours map[uint64]bool, settled map[uint64]bool) bool {
+	for neighbour := range neighbours {
+		if settled[neighbour] && t.colors[neighbour] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the color least used by the neighbours and, among those, the
+// least used overall. Ties start at the tribe ID so equal tribes spread over
+// the palette.
+func (t *TribeColors) pick(tribeID uint64, neighbours map[uint64]bool, usage map[string]int) string {
+	near := make(map[string]int)
+	for neighbour := range neighbours {
+		if name, found := t.colors[neighbour]; found {
+			near[name]++
+		}
+	}
+	best := ""
+	start := int(tribeID % uint64(len(tribePalette)))
+	for i := range tribePalette {
+		name := tribePalette[(start+i)%len(tribePalette)]
+		if len(best) == 0 || near[name] < near[best] || (near[name] == near[best] && usage[name] < usage[best]) {
+			best = name
+		}
+	}
+	return best
+}
+
+func (t *TribeColors) save() error {
+	if len(t.path) == 0 {
+		return nil
+	}
+	js, err := json.Marshal(t.colors)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// tribeNeighbours returns for each tribe the other tribes with an island
+// within distance world units of one of its islands.
+func tribeNeighbours(tribes *map[uint64]*TribeCount, distance float64) map[uint64]map[uint64]bool {
+	type claim struct {
+		tribeID uint64
+		bounds  Bounds
+	}
+	claims := make([]claim, 0)
+	world := Bounds{}
+	for _, tribe := range *tribes {
+		for _, island := range tribe.islands {
+			b := polygonBounds(island.Footprint())
+			claims = append(claims, claim{tribe.tribeID, b})
+			if len(claims) == 1 {
+				world = b
+			}
+			world = Bounds{
+				MinX: math.Min(world.MinX, b.MinX),
+				MinY: math.Min(world.MinY, b.MinY),
+				MaxX: math.Max(world.MaxX, b.MaxX),
+				MaxY: math.Max(world.MaxY, b.MaxY),
+			}
+		}
+	}
+
+	tree := NewQuadTree(world)
+	for i := range claims {
+		tree.Insert(claims[i].bounds, &claims[i])
+	}
+	neighbours := make(map[uint64]map[uint64]bool)
+	for _, c := range claims {
+		near := Bounds{c.bounds.MinX - distance, c.bounds.MinY - distance, c.bounds.MaxX + distance, c.bounds.MaxY + distance}
+		tree.Query(near, func(value interface{}) bool {
+			other := value.(*claim)
+			if other.tribeID != c.tribeID {
+				if neighbours[c.tribeID] == nil {
+					neighbours[c.tribeID] = make(map[uint64]bool)
+				}
+				neighbours[c.tribeID][other.tribeID] = true
+			}
+			return true
+		})
+	}
+	return neighbours
+}
@@ -0,0 +1,202 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testColorTribe owns a single 100 by 100 island centred on x, y.
+func testColorTribe(id uint64, count int, x, y float64) *TribeCount {
+	claim := &IslandClaim{IslandID: int(id), OwnerTribeID: id, X: x, Y: y, Width: 100, Height: 100}
+	return &TribeCount{tribeID: id, count: count, islands: []*IslandClaim{claim}}
+}
+
+// tribeColorNames returns the color of each tribe, checking its islands got
+// the same color.
+func tribeColorNames(t *testing.T, tribes map[uint64]*TribeCount) map[uint64]string {
+	names := make(map[uint64]string)
+	for id, tribe := range tribes {
+		names[id] = tribe.color
+		for _, island := range tribe.islands {
+			if island.ColorName != tribe.color || island.Color != colorValues[tribe.color] {
+				t.Errorf("tribe %d is %s, its island %d is %s %v", id, tribe.color, island.IslandID, island.ColorName, island.Color)
+			}
+		}
+	}
+	return names
+}
+
+func TestTribeNeighbours(t *testing.T) {
+	tribes := map[uint64]*TribeCount{
+		1: testColorTribe(1, 10, 0, 0),
+		// 150 apart from tribe 1
+		2: testColorTribe(2, 10, 250, 0),
+		// 250 apart from tribe 2, but with a second island next to it
+		3: testColorTribe(3, 10, 600, 0),
+		4: testColorTribe(4, 10, 10000, 10000),
+	}
+	tribes[3].islands = append(tribes[3].islands, &IslandClaim{X: 500, Y: 200, Width: 100, Height: 100})
+
+	got := tribeNeighbours(&tribes, 200)
+	want := map[uint64]map[uint64]bool{
+		1: {2: true},
+		2: {1: true, 3: true},
+		3: {2: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tribeNeighbours() = %v, want %v", got, want)
+	}
+	if got := tribeNeighbours(&map[uint64]*TribeCount{}, 200); len(got) != 0 {
+		t.Errorf("tribeNeighbours() of no tribes = %v", got)
+	}
+}
+
+func TestTribeColorsPick(t *testing.T) {
+	colors := &TribeColors{colors: map[uint64]string{1: "red", 2: "green"}}
+	neighbours := map[uint64]bool{1: true, 2: true}
+	for _, c := range []struct {
+		tribeID    uint64
+		neighbours map[uint64]bool
+		usage      map[string]int
+		want       string
+	}{
+		{0, nil, nil, "red"},
+		{3, nil, nil, "blue"},
+		{uint64(len(tribePalette)) + 1, nil, nil, "green"},
+		// the neighbours' colors are avoided
+		{0, neighbours, nil, "yellow"},
+		// then the least used color overall
+		{0, neighbours, map[string]int{"yellow": 3, "blue": 1}, "orange"},
+		{0, nil, map[string]int{"red": 1}, "green"},
+	} {
+		if got := colors.pick(c.tribeID, c.neighbours, c.usage); got != c.want {
+			t.Errorf("pick(%d, %v, %v) = %s, want %s", c.tribeID, c.neighbours, c.usage, got, c.want)
+		}
+	}
+
+	// with the palette used up by neighbours, the least used one is shared
+	many := &TribeColors{colors: make(map[uint64]string)}
+	manyNeighbours := make(map[uint64]bool)
+	for i, name := range tribePalette {
+		many.colors[uint64(100+i)] = name
+		manyNeighbours[uint64(100+i)] = true
+	}
+	many.colors[200] = "red"
+	manyNeighbours[200] = true
+	if got := many.pick(0, manyNeighbours, nil); got != "green" {
+		t.Errorf("pick() with every color taken = %s, want green", got)
+	}
+}
+
+func TestTribeColorsAssign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tribecolors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tribecolors.json")
+
+	// a row of neighbouring tribes and one far away
+	tribes := make(map[uint64]*TribeCount)
+	for i := uint64(0); i < 6; i++ {
+		tribes[i+1] = testColorTribe(i+1, int(10+i), float64(i)*200, 0)
+	}
+	tribes[7] = testColorTribe(7, 5, 100000, 100000)
+
+	colors, err := OpenTribeColors(path, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := colors.Assign(&tribes); err != nil {
+		t.Fatal(err)
+	}
+	first := tribeColorNames(t, tribes)
+	neighbours := tribeNeighbours(&tribes, 500)
+	for id, near := range neighbours {
+		for other := range near {
+			if first[id] == first[other] {
+				t.Errorf("neighbours %d and %d are both %s", id, other, first[id])
+			}
+		}
+	}
+	for id, name := range first {
+		if _, found := colorValues[name]; !found {
+			t.Errorf("tribe %d has color %q", id, name)
+		}
+	}
+
+	// the colors are the same on the next update and after a restart
+	if err := colors.Assign(&tribes); err != nil {
+		t.Fatal(err)
+	}
+	if got := tribeColorNames(t, tribes); !reflect.DeepEqual(got, first) {
+		t.Errorf("second Assign() = %v, want %v", got, first)
+	}
+	reopened, err := OpenTribeColors(path, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Assign(&tribes); err != nil {
+		t.Fatal(err)
+	}
+	if got := tribeColorNames(t, tribes); !reflect.DeepEqual(got, first) {
+		t.Errorf("Assign() after a restart = %v, want %v", got, first)
+	}
+
+	// tribe 7 moves next to tribe 6, which is larger and keeps its color
+	tribes[7].islands[0].X, tribes[7].islands[0].Y = 1200, 0
+	colors.colors[7] = first[6]
+	if err := colors.Assign(&tribes); err != nil {
+		t.Fatal(err)
+	}
+	got := tribeColorNames(t, tribes)
+	if got[6] != first[6] || got[7] == first[6] {
+		t.Errorf("colliding tribes 6 and 7 are %s and %s, want 6 to keep %s", got[6], got[7], first[6])
+	}
+
+	// now tribe 7 is the larger one
+	tribes[7].count = 100
+	colors.colors[6] = got[7]
+	if err := colors.Assign(&tribes); err != nil {
+		t.Fatal(err)
+	}
+	if again := tribeColorNames(t, tribes); again[7] != got[7] || again[6] == got[7] {
+		t.Errorf("colliding tribes 6 and 7 are %s and %s, want 7 to keep %s", again[6], again[7], got[7])
+	}
+}
+
+func TestLoadTribeColors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tribecolors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tribecolors.json")
+	if err := ioutil.WriteFile(path, []byte(`{"1":"navy"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	colors, err := LoadTribeColors(path, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tribes := map[uint64]*TribeCount{
+		1: testColorTribe(1, 10, 0, 0),
+		2: testColorTribe(2, 10, 100000, 0),
+	}
+	if err := colors.Assign(&tribes); err != nil {
+		t.Fatal(err)
+	}
+	if tribes[1].color != "navy" || len(tribes[2].color) == 0 {
+		t.Errorf("LoadTribeColors() colors = %s, %s, want navy and a new color", tribes[1].color, tribes[2].color)
+	}
+	if js, err := ioutil.ReadFile(path); err != nil || string(js) != `{"1":"navy"}` {
+		t.Errorf("colors file = %s, %v, want it unchanged", js, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("LoadTribeColors() wrote %s.tmp", path)
+	}
+}
@@ -1,17 +1,15 @@
 package generator
 
 import (
-	"container/heap"
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"math/rand"
-	"os"
-	"path"
 	"strconv"
-	"sync"
 	"time"
 
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+
 	"github.com/go-redis/redis"
 )
 
@@ -20,66 +18,10 @@ type TribeCount struct {
 	name    string
 	count   int
 	flagURL *string
+	color   string
 	islands []*IslandClaim
 }
 
-// TribeCountHeap heap wrapper
-type TribeCountHeap []*TribeCount
-
-func (h TribeCountHeap) Len() int { return len(h) }
-func (h TribeCountHeap) Less(i, j int) bool {
-	if h[i].count < h[j].count {
-		return true
-	} else if h[i].count == h[j].count {
-		return h[i].tribeID < h[j].tribeID
-	} else {
-		return false
-	}
-}
-func (h TribeCountHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
-func (h *TribeCountHeap) Push(x interface{}) { *h = append(*h, x.(*TribeCount)) }
-func (h *TribeCountHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
-}
-
-func TopNTribes(n int, counts *map[uint64]*TribeCount) []uint64 {
-	pq := make(TribeCountHeap, 0)
-	i := 0
-	for _, v := range *counts {
-		// prime heap with n-items
-		if i < n {
-			pq = append(pq, v)
-			i++
-			continue
-		} else if i == n {
-			heap.Init(&pq)
-		}
-
-		// add n+1 items and fix up heap
-		heap.Push(&pq, v)
-		if pq.Len() > n {
-			heap.Pop(&pq)
-		}
-		i++
-	}
-	if i <= n {
-		heap.Init(&pq)
-	}
-	results := make([]uint64, 0)
-	for ; pq.Len() > 0; heap.Pop(&pq) {
-		results = append(results, pq[0].tribeID)
-	}
-	for i := len(results)/2 - 1; i >= 0; i-- {
-		opp := len(results) - 1 - i
-		results[i], results[opp] = results[opp], results[i]
-	}
-	return results
-}
-
 type TribeInfoOutput struct {
 	Rank  int    `json:"rank"`
 	Name  string `json:"name"`
@@ -99,30 +41,100 @@ type GameTribeOutput struct {
 	Index     int    `json:"index"`
 }
 
-func serverIDfromXY(x int, y int) int {
-	return (x << 16) | y
+// TribeFlags is the top tribes stage of ProcessColony. It fetches the names
+// and flags of the top tribes into the flag store, sets them as tribes.json in
+// the snapshot store and, with TribeWriteBack, pushes the top tribes back to
+// redis for the game. RenderFlags asks the game servers for new flags.
+type TribeFlags struct {
+	client   *redis.Client
+	config   *Config
+	flags    *FlagStore
+	store    *SnapshotStore
+	serversX int
+	serversY int
 }
 
-func generateTribes(client *redis.Client, top []uint64, tribes *map[uint64]*TribeCount, wwwDir string, clusterPrefix string, serversX int, serversY int, wg *sync.WaitGroup) {
-	defer wg.Done()
+// NewTribeFlags returns the stage storing flags in flags and the top tribes
+// in store.
+func NewTribeFlags(client *redis.Client, gridConfig *atlas.GridConfig, config *Config, flags *FlagStore, store *SnapshotStore) *TribeFlags {
+	return &TribeFlags{
+		client:   client,
+		config:   config,
+		flags:    flags,
+		store:    store,
+		serversX: gridConfig.TotalGridsX,
+		serversY: gridConfig.TotalGridsY,
+	}
+}
 
-	// fill list of top tribes
-	tribeOutput := TribeOutput{
-		Version: time.Now().Unix(),
-		Top:     make([]string, 0),
-		Info:    make(map[string]TribeInfoOutput),
+// flagClient is the part of the redis client requesting flag renders.
+type flagClient interface {
+	Publish(channel string, message interface{}) *redis.IntCmd
+	Exists(keys ...string) *redis.IntCmd
+}
+
+// RenderFlags asks random game servers to render the flags of the top tribes,
+// then polls until every flag that did not exist yet is in redis or the wait
+// times out. It may take TribeFlagWaitInSeconds, so it is meant to run in its
+// own goroutine, followed by another Update to pick up the new flags.
+func (t *TribeFlags) RenderFlags(top []uint64) {
+	wait := time.Duration(t.config.TribeFlagWaitInSeconds) * time.Second
+	if missing := renderFlags(t.client, top, t.serversX, t.serversY, wait, time.Second); missing > 0 {
+		log.Printf("%d of %d tribe flags missing", missing, len(top))
 	}
+}
 
-	// start PNG generation and wait a little bit
+// renderFlags publishes GenerateTribePNG for each tribe to a random server
+// and returns how many flags were still missing when the wait ran out. Flags
+// of an earlier render are left in place for the game to overwrite, so only
+// the tribes without one are waited for.
+func renderFlags(client flagClient, top []uint64, serversX, serversY int, wait, poll time.Duration) int {
+	keys := make([]string, 0, len(top))
+	for _, tribe := range top {
+		key := "tribeflag:" + strconv.FormatUint(tribe, 10)
+		n, err := client.Exists(key).Result()
+		if err != nil {
+			log.Println(err)
+			return len(top)
+		}
+		if n == 0 {
+			keys = append(keys, key)
+		}
+	}
 	for _, tribe := range top {
 		randomX := rand.Intn(serversX)
 		randomY := rand.Intn(serversY)
-		serverID := serverIDfromXY(randomX, randomY)
-		client.Publish("GeneralNotifications:GlobalCommands", "Server::"+strconv.Itoa(serverID)+"::GenerateTribePNG "+strconv.FormatUint(tribe, 10))
+		serverID := coords.Pack(uint16(randomX), uint16(randomY))
+		client.Publish("GeneralNotifications:GlobalCommands", "Server::"+strconv.FormatUint(uint64(serverID), 10)+"::GenerateTribePNG "+strconv.FormatUint(tribe, 10))
 	}
-	time.Sleep(15 * time.Second)
 
-	// fill in tribe info
+	if len(keys) == 0 {
+		return 0
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		n, err := client.Exists(keys...).Result()
+		if err != nil {
+			log.Println(err)
+			return len(keys)
+		}
+		if int(n) == len(keys) || time.Now().After(deadline) {
+			return len(keys) - int(n)
+		}
+		time.Sleep(poll)
+	}
+}
+
+// Update runs the stage for the top tribes, in rank order, with the flags
+// currently in redis. The names and flag URLs found are set on the tribe
+// counts.
+func (t *TribeFlags) Update(top []uint64, tribes *map[uint64]*TribeCount) {
+	// fill list of top tribes
+	tribeOutput := TribeOutput{
+		Version: time.Now().Unix(),
+		Top:     make([]string, 0),
+		Info:    make(map[string]TribeInfoOutput),
+	}
 	var gameTribeOutput []string
 	for i := range top {
 		strTribeID := strconv.FormatUint(top[i], 10)
@@ -130,8 +142,7 @@ func generateTribes(client *redis.Client, top []uint64, tribes *map[uint64]*Trib
 		tribeOutput.Top = append(tribeOutput.Top, strTribeID)
 
 		tribeName := "<unknown>"
-		img := clusterPrefix + "tribes/na.png"
-		tribe, err := client.HMGet("tribedata:"+strTribeID, "TribeName").Result()
+		tribe, err := t.client.HMGet("tribedata:"+strTribeID, "TribeName").Result()
 		if err != nil {
 			log.Println(err)
 			continue
@@ -141,16 +152,37 @@ func generateTribes(client *redis.Client, top []uint64, tribes *map[uint64]*Trib
 		if !ok {
 			tribeName = "<abandoned>"
 		}
-		tribeOutput.Info[strTribeID] = TribeInfoOutput{
-			Rank:  i + 1,
-			Name:  tribeName,
-			Color: colors[i],
-			Img:   img,
+		info := TribeInfoOutput{
+			Rank: i + 1,
+			Name: tribeName,
+			Img:  t.config.ClusterPrefix + "tribes/na.png",
+		}
+
+		// try to get the image, the hash makes browsers refetch changed flags.
+		// A flag that did not render in time keeps its last stored version.
+		var flagURL *string
+		hash, _, found := t.flags.Get(top[i])
+		img, err := t.client.Get("tribeflag:" + strTribeID).Bytes()
+		if err == nil && len(img) > 0 {
+			// a flag rejected before was logged then
+			if stored, err := t.flags.Put(top[i], img); err == nil {
+				hash, found = stored, true
+			} else if err != ErrBadFlag {
+				log.Println(err)
+			}
+		}
+		if found {
+			url := "flags/" + strTribeID + ".png?" + hash[:8]
+			info.Img = url
+			flagURL = &url
 		}
 
 		if tribe, found := (*tribes)[top[i]]; found {
 			tribe.name = tribeName
+			tribe.flagURL = flagURL
+			info.Color = tribe.color
 		}
+		tribeOutput.Info[strTribeID] = info
 
 		game := GameTribeOutput{
 			TribeID:   top[i],
@@ -161,48 +193,24 @@ func generateTribes(client *redis.Client, top []uint64, tribes *map[uint64]*Trib
 		gameTribeOutput = append(gameTribeOutput, string(js))
 	}
 
-	// try to get the images
-	var simpleTribeOutput []TribeInfoOutput
-	for i := range top {
-		strTribeID := strconv.FormatUint(top[i], 10)
-		img, err := client.Get("tribeflag:" + strTribeID).Result()
-		if err != nil || len(img) <= 0 {
-			simpleTribeOutput = append(simpleTribeOutput, tribeOutput.Info[strTribeID])
-			continue
-		}
-		tribePath := path.Join(wwwDir, clusterPrefix, "tribes", strTribeID+".png")
-		os.MkdirAll(path.Dir(tribePath), os.ModePerm)
-		ioutil.WriteFile(tribePath, []byte(img), 0644)
-
-		info := tribeOutput.Info[strTribeID]
-		info.Img = clusterPrefix + "tribes/" + strTribeID + ".png"
-		tribeOutput.Info[strTribeID] = info
-
-		// add flag URL to main tribe data
-		if tribe, found := (*tribes)[top[i]]; found {
-			tmp := info.Img
-			tribe.flagURL = &tmp
-		}
-
-		simpleTribeOutput = append(simpleTribeOutput, info)
+	if err := t.store.SetTopTribes(&tribeOutput); err != nil {
+		log.Println(err)
 	}
 
-	// write the json
-	js, _ := json.Marshal(tribeOutput)
-	tribePath := path.Join(wwwDir, clusterPrefix, "tribes", "tribes.json")
-	os.MkdirAll(path.Dir(tribePath), os.ModePerm)
-	ioutil.WriteFile(tribePath, []byte(js), 0644)
+	if !t.config.TribeWriteBack {
+		return
+	}
 
 	// write list back to redis for game
-	_, err := client.Del("toptribes").Result()
+	_, err := t.client.Del("toptribes").Result()
 	if err != nil {
 		log.Println(err)
 	}
 	if len(gameTribeOutput) > 0 {
-		_, err = client.RPush("toptribes", gameTribeOutput).Result()
+		_, err = t.client.RPush("toptribes", gameTribeOutput).Result()
 		if err != nil {
 			log.Println(err)
 		}
 	}
-	client.Publish("GeneralNotifications:GlobalCommands", "ReloadTopTribes")
+	t.client.Publish("GeneralNotifications:GlobalCommands", "ReloadTopTribes")
 }
@@ -0,0 +1,109 @@
+package generator
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeFlagClient keeps keys in memory. Every published GenerateTribePNG
+// renders its flag, unless the tribe is in broken, after delay.
+type fakeFlagClient struct {
+	lock      sync.Mutex
+	keys      map[string]bool
+	broken    map[string]bool
+	delay     time.Duration
+	published []string
+}
+
+func newFakeFlagClient(existing ...string) *fakeFlagClient {
+	f := &fakeFlagClient{keys: make(map[string]bool), broken: make(map[string]bool)}
+	for _, key := range existing {
+		f.keys[key] = true
+	}
+	return f
+}
+
+func (f *fakeFlagClient) Publish(channel string, message interface{}) *redis.IntCmd {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msg := message.(string)
+	f.published = append(f.published, msg)
+	tribe := msg[strings.LastIndex(msg, " ")+1:]
+	if !f.broken[tribe] {
+		time.AfterFunc(f.delay, func() {
+			f.lock.Lock()
+			f.keys["tribeflag:"+tribe] = true
+			f.lock.Unlock()
+		})
+	}
+	return redis.NewIntResult(1, nil)
+}
+
+func (f *fakeFlagClient) Exists(keys ...string) *redis.IntCmd {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := int64(0)
+	for _, key := range keys {
+		if f.keys[key] {
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func TestRenderFlags(t *testing.T) {
+	client := newFakeFlagClient()
+	client.delay = 20 * time.Millisecond
+	start := time.Now()
+	if missing := renderFlags(client, []uint64{1, 2, 3}, 12, 8, time.Second, 5*time.Millisecond); missing != 0 {
+		t.Errorf("%d flags missing", missing)
+	}
+	if elapsed := time.Since(start); elapsed < client.delay || elapsed > 500*time.Millisecond {
+		t.Errorf("returned after %v, want soon after the flags rendered", elapsed)
+	}
+	if len(client.published) != 3 || !strings.HasSuffix(client.published[0], "::GenerateTribePNG 1") {
+		t.Errorf("published %q", client.published)
+	}
+}
+
+func TestRenderFlagsKeepsExistingFlags(t *testing.T) {
+	// the flags of the last render stay for the game to overwrite, and only
+	// the new tribe is waited for even though tribe 2 never renders again
+	client := newFakeFlagClient("tribeflag:1", "tribeflag:2")
+	client.broken["2"] = true
+	client.delay = 20 * time.Millisecond
+	if missing := renderFlags(client, []uint64{1, 2, 3}, 4, 4, time.Second, 5*time.Millisecond); missing != 0 {
+		t.Errorf("%d flags missing, want 0", missing)
+	}
+	client.lock.Lock()
+	if !client.keys["tribeflag:2"] || !client.keys["tribeflag:3"] {
+		t.Errorf("flags = %v, want the old flag of 2 and the new one of 3", client.keys)
+	}
+	if len(client.published) != 3 {
+		t.Errorf("published %q, want every flag rendered again", client.published)
+	}
+
+	// with every flag there already nothing is waited for
+	client.delay = time.Hour
+	client.lock.Unlock()
+	start := time.Now()
+	if missing := renderFlags(client, []uint64{1, 2}, 4, 4, time.Second, 5*time.Millisecond); missing != 0 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("%d flags missing after %v, want none right away", missing, time.Since(start))
+	}
+}
+
+func TestRenderFlagsTimeout(t *testing.T) {
+	client := newFakeFlagClient()
+	client.delay = time.Hour
+	start := time.Now()
+	if missing := renderFlags(client, []uint64{1, 2, 3}, 1, 1, 50*time.Millisecond, 5*time.Millisecond); missing != 3 {
+		t.Errorf("%d flags missing, want 3", missing)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("gave up after %v, want about 50ms", elapsed)
+	}
+}
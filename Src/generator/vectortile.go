@@ -0,0 +1,169 @@
+package generator
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	maxVectorTileZoom = 12
+	// features are kept when they come this close to a tile, in tile pixels,
+	// so clients can clip them without seams
+	vectorTileBuffer = 64
+)
+
+// vectorShape is a static polygon indexed in map coordinates.
+type vectorShape struct {
+	id         uint64
+	polygon    [][2]float64
+	properties map[string]interface{}
+}
+
+// VectorTiles builds Mapbox Vector Tiles in the same tile layout as the
+// territory overlay. Tiles carry the layers islands, claims, discozones and
+// either entities or, below the cluster zoom, per server clusters.
+type VectorTiles struct {
+	store       *SnapshotStore
+	index       *SpatialIndex
+	clusterZoom int
+	islands     *QuadTree
+	footprints  map[int][][2]float64
+	discoZones  *QuadTree
+}
+
+// NewVectorTiles indexes the static island and discovery zone footprints.
+func NewVectorTiles(data *GridData, store *SnapshotStore, index *SpatialIndex, clusterZoom int) *VectorTiles {
+	world := Bounds{0, 0, 1, 1}
+	v := &VectorTiles{
+		store:       store,
+		index:       index,
+		clusterZoom: clusterZoom,
+		islands:     NewQuadTree(world),
+		footprints:  make(map[int][][2]float64, len(data.Islands)),
+		discoZones:  NewQuadTree(world),
+	}
+	for i := range data.Islands {
+		island := &data.Islands[i]
+		polygon := island.Footprint()
+		v.footprints[island.IslandID] = polygon
+		v.islands.Insert(polygonBounds(polygon), &vectorShape{
+			id:      uint64(island.IslandID),
+			polygon: polygon,
+			properties: map[string]interface{}{
+				"IslandID":     island.IslandID,
+				"Name":         island.Name,
+				"ServerId":     island.ServerID,
+				"IslandPoints": island.IslandPoints,
+			},
+		})
+	}
+	for i := range data.DiscoZones {
+		zone := &data.DiscoZones[i]
+		polygon := zone.Footprint()
+		v.discoZones.Insert(polygonBounds(polygon), &vectorShape{
+			id:      uint64(zone.ID),
+			polygon: polygon,
+			properties: map[string]interface{}{
+				"ID":                zone.ID,
+				"Name":              zone.Name,
+				"ServerId":          zone.ServerID,
+				"Xp":                zone.Xp,
+				"AllowSea":          zone.AllowSea,
+				"ExplorerNoteIndex": zone.ExplorerNoteIndex,
+			},
+		})
+	}
+	return v
+}
+
+// Tile encodes the tile z/x/y.
+func (v *VectorTiles) Tile(z, x, y int) ([]byte, error) {
+	if z < 0 || z > maxVectorTileZoom || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+	}
+	tiles := float64(int(1) << uint(z))
+	scale := tiles * mvtExtent
+	toTile := func(p [2]float64) [2]float64 {
+		return [2]float64{p[0]*scale - float64(x*mvtExtent), p[1]*scale - float64(y*mvtExtent)}
+	}
+	tile := Bounds{float64(x) / tiles, float64(y) / tiles, float64(x+1) / tiles, float64(y+1) / tiles}
+	buffer := vectorTileBuffer / scale
+	buffered := Bounds{tile.MinX - buffer, tile.MinY - buffer, tile.MaxX + buffer, tile.MaxY + buffer}
+
+	addShapes := func(layer *mvtLayer, tree *QuadTree) {
+		tree.Query(buffered, func(value interface{}) bool {
+			shape := value.(*vectorShape)
+			layer.addPolygon(shape.id, transform(shape.polygon, toTile), shape.properties)
+			return true
+		})
+	}
+	islands := newMVTLayer("islands")
+	addShapes(islands, v.islands)
+	discoZones := newMVTLayer("discozones")
+	addShapes(discoZones, v.discoZones)
+
+	claims := newMVTLayer("claims")
+	colony := v.store.Islands()
+	tribeNames := make(map[uint64]string, len(colony.Companies))
+	for _, company := range colony.Companies {
+		tribeNames[company.TribeID] = company.TribeName
+	}
+	for i := range colony.Islands {
+		island := &colony.Islands[i]
+		polygon, found := v.footprints[island.IslandID]
+		if !found || !polygonBounds(polygon).Intersects(buffered) {
+			continue
+		}
+		claims.addPolygon(uint64(island.IslandID), transform(polygon, toTile), map[string]interface{}{
+			"IslandID":             island.IslandID,
+			"TribeId":              island.TribeID,
+			"TribeName":            tribeNames[island.TribeID],
+			"Color":                island.Color,
+			"SettlementName":       island.SettlementName,
+			"IslandPoints":         island.IslandPoints,
+			"TaxRate":              island.TaxRate,
+			"NumSettlers":          island.NumSettlers,
+			"CombatPhaseStartTime": island.CombatPhaseStartTime,
+			"WarringTribeID":       island.WarringTribeID,
+			"WarStartUTC":          island.WarStartUTC,
+			"WarEndUTC":            island.WarEndUTC,
+		})
+	}
+
+	var entities *mvtLayer
+	if z < v.clusterZoom {
+		entities = newMVTLayer("clusters")
+		for _, cluster := range v.index.Clusters(tile.MinX, tile.MinY, tile.MaxX, tile.MaxY) {
+			p := toTile([2]float64{cluster.X, cluster.Y})
+			entities.addPoint(uint64(cluster.ServerID), p[0], p[1], map[string]interface{}{
+				"ServerId": cluster.ServerID,
+				"Cell":     cluster.Cell,
+				"Count":    cluster.Count,
+			})
+		}
+	} else {
+		entities = newMVTLayer("entities")
+		v.index.EachEntityIn(tile.MinX, tile.MinY, tile.MaxX, tile.MaxY, func(info *EntityInfo, mx, my float64) {
+			id, _ := strconv.ParseUint(info.EntityID, 10, 64)
+			p := toTile([2]float64{mx, my})
+			entities.addPoint(id, p[0], p[1], map[string]interface{}{
+				"EntityID":       info.EntityID,
+				"ParentEntityID": info.ParentEntityID,
+				"EntityType":     info.EntityType,
+				"EntitySubType":  info.EntitySubType,
+				"EntityName":     info.EntityName,
+				"TribeID":        info.TribeID,
+			})
+		})
+	}
+
+	return encodeMVT(islands, claims, discoZones, entities), nil
+}
+
+func transform(polygon [][2]float64, fn func([2]float64) [2]float64) [][2]float64 {
+	out := make([][2]float64, len(polygon))
+	for i, p := range polygon {
+		out[i] = fn(p)
+	}
+	return out
+}
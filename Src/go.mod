@@ -9,4 +9,5 @@ require (
 	github.com/onsi/ginkgo v1.8.0 // indirect
 	github.com/onsi/gomega v1.5.0 // indirect
 	github.com/zzglitch/goquadtree v0.0.0-20180712072645-8f0ee94aafc0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
@@ -3,43 +3,47 @@ package main
 import (
 	"flag"
 	"log"
+	"math"
+	"path"
 	"path/filepath"
 	"strconv"
+	"net"
 	"net/http"
+	"io"
 	"io/ioutil"
+	"os"
 	"fmt"
 	"encoding/json"
-	"sync"
+	"encoding/hex"
+	"crypto/sha1"
+	"strings"
+	"time"
 
 	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
 	"AtlasMapViewer/generator"
 
 	"github.com/go-redis/redis"
 )
 
-var islandData string
-var islandDataLock sync.RWMutex
-
-var entityData string
-var entityDataLock sync.RWMutex
-
-var tribeData string
-var tribeDataLock sync.RWMutex
-
-
 // sendCommand publishes an event to the GeneralNotifications:GlobalCommands
 // redis PubSub channel. To send a server command, prepend "ID::X,Y::" where
 // ID is the packed server ID; X and Y are the relative lng and lat locations.
-func sendCommand(w http.ResponseWriter, r *http.Request, client *redis.Client, config *generator.Config) {
+// The target must exist and known commands must have valid arguments.
+func sendCommand(w http.ResponseWriter, r *http.Request, auth *generator.Auth, commander *generator.Commander, commands *generator.CommandRegistry, config *generator.Config) {
 	log.Println(r.Method, r.URL.Path)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if r.Method != "POST" || config.DisableCommands {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	user, status := authenticate(r, auth)
+	if user == nil {
+		w.WriteHeader(status)
+		return
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 65536+1))
 	if err != nil {
 		log.Println(err)
 	}
@@ -49,67 +53,991 @@ func sendCommand(w http.ResponseWriter, r *http.Request, client *redis.Client, c
 		return
 	}
 
+	// a cut off command could mean something else, so it is refused
+	if len(body) > 65536 {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	if len(body) == 0 {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
 	encoded := fmt.Sprintf("%s", body)
+	command, err := commands.Parse(encoded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, published := publishCommand(w, r, commander, user, command, encoded)
+	if !published {
+		return
+	}
+
+	w.Write([]byte(strconv.FormatInt(result, 10)))
+}
+
+// commandPreview answers a dry run, or a dangerous command with the token
+// confirming it.
+type commandPreview struct {
+	Command      string                  `json:"Command"`
+	Target       generator.CommandTarget `json:"Target"`
+	DryRun       bool                    `json:"DryRun,omitempty"`
+	NeedsConfirm bool                    `json:"NeedsConfirm"`
+	ConfirmToken string                  `json:"ConfirmToken,omitempty"`
+	Expires      int64                   `json:"Expires,omitempty"`
+}
+
+// publishCommand publishes a command through the commander and returns the
+// number of game servers that received it. Otherwise it answers the request
+// itself: with ?dryrun=1 the command is only shown as it would be published,
+// dangerous commands have to be confirmed, see confirmCommand, and users over
+// the rate limits are told when to retry.
+func publishCommand(w http.ResponseWriter, r *http.Request, commander *generator.Commander, user *generator.Session, command *generator.Command, encoded string) (int64, bool) {
+	confirmed := false
+	if commander.Allowed(user, command) {
+		dangerous := commander.Dangerous(command.Name)
+		if v := r.URL.Query().Get("dryrun"); v == "1" || v == "true" {
+			writePrivateJSON(w, commandPreview{Command: encoded, Target: command.Target, DryRun: true, NeedsConfirm: dangerous})
+			return 0, false
+		}
+		if dangerous {
+			if !confirmCommand(w, r, commander, user, command, encoded) {
+				return 0, false
+			}
+			confirmed = true
+		}
+	}
+
+	result, err := commander.Publish(user, remoteAddr(r), command, encoded, confirmed)
+	if limited, ok := err.(*generator.RateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.Wait.Seconds()))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return 0, false
+	} else if err == generator.ErrCommandDenied || err == generator.ErrNotConfirmed {
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, false
+	}
+	return result, true
+}
 
-	log.Println("publish:", encoded)
-	result, err := client.Publish("GeneralNotifications:GlobalCommands", encoded).Result()
+// confirmCommand reports whether a dangerous command came with a valid
+// X-Confirm-Token. Without one it answers 202 Accepted with a token to send
+// the same command again with.
+func confirmCommand(w http.ResponseWriter, r *http.Request, commander *generator.Commander, user *generator.Session, command *generator.Command, encoded string) bool {
+	if token := r.Header.Get("X-Confirm-Token"); len(token) > 0 {
+		if commander.Confirm(user, encoded, token) {
+			return true
+		}
+		http.Error(w, "Confirmation expired or was for another command", http.StatusConflict)
+		return false
+	}
+
+	token, expires, err := commander.Confirmation(user, encoded)
 	if err != nil {
-		log.Println("redis error for: ", encoded, "; ", err)
+		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	log.Println("confirm:", user.Name, encoded)
+	writePrivateJSONStatus(w, http.StatusAccepted, commandPreview{
+		Command:      encoded,
+		Target:       command.Target,
+		NeedsConfirm: true,
+		ConfirmToken: token,
+		Expires:      expires.Unix(),
+	})
+	return false
+}
+
+// getJobs lists the scheduled commands on GET and schedules a new one from a
+// JSON generator.JobRequest body on POST.
+func getJobs(w http.ResponseWriter, r *http.Request, auth *generator.Auth, commander *generator.Commander, commands *generator.CommandRegistry, scheduler *generator.Scheduler, config *generator.Config) {
+	log.Println(r.Method, r.URL.Path)
+	if config.DisableCommands {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, status := authenticate(r, auth)
+	if user == nil {
+		w.WriteHeader(status)
 		return
 	}
 
-	w.Write([]byte(strconv.FormatInt(result, 10)))
+	switch r.Method {
+	case "GET":
+		writePrivateJSON(w, scheduler.Jobs())
+	case "POST":
+		var req generator.JobRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// past this dangerous commands are confirmed
+		if !confirmJob(w, r, commander, commands, user, &req) {
+			return
+		}
+		job, err := scheduler.Add(user, &req, true)
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		log.Println("scheduled:", user.Name, job.ID, job.Command)
+		writePrivateJSONStatus(w, http.StatusCreated, job)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
 }
 
+// getJob returns, replaces (PUT with a JSON generator.JobRequest body) or
+// deletes a scheduled command by ID, e.g. /schedule/3.
+func getJob(w http.ResponseWriter, r *http.Request, auth *generator.Auth, commander *generator.Commander, commands *generator.CommandRegistry, scheduler *generator.Scheduler, config *generator.Config) {
+	log.Println(r.Method, r.URL.Path)
+	if config.DisableCommands {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, status := authenticate(r, auth)
+	if user == nil {
+		w.WriteHeader(status)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/schedule/"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		job, found := scheduler.Job(id)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writePrivateJSON(w, job)
+	case "PUT":
+		var req generator.JobRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !confirmJob(w, r, commander, commands, user, &req) {
+			return
+		}
+		job, err := scheduler.Update(user, id, &req, true)
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		log.Println("rescheduled:", user.Name, job.ID, job.Command)
+		writePrivateJSON(w, job)
+	case "DELETE":
+		if err := scheduler.Delete(user, id); err != nil {
+			writeJobError(w, err)
+			return
+		}
+		log.Println("unscheduled:", user.Name, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// confirmJob makes scheduling a dangerous command need confirming like
+// sending it does.
+func confirmJob(w http.ResponseWriter, r *http.Request, commander *generator.Commander, commands *generator.CommandRegistry, user *generator.Session, req *generator.JobRequest) bool {
+	command, err := commands.Parse(req.Command)
+	if err != nil || !commander.Allowed(user, command) || !commander.Dangerous(command.Name) {
+		// the scheduler rejects what is wrong with it
+		return true
+	}
+	return confirmCommand(w, r, commander, user, command, req.Command)
+}
 
-func getTerritoryURL(w http.ResponseWriter, r *http.Request, config *generator.Config) {
+// writeJobError answers a scheduler error with its status.
+func writeJobError(w http.ResponseWriter, err error) {
+	switch err {
+	case generator.ErrNoJob:
+		w.WriteHeader(http.StatusNotFound)
+	case generator.ErrNotJobOwner, generator.ErrCommandDenied, generator.ErrNotConfirmed:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// remoteAddr returns the IP address a request came from.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getAudit serves the audit log to roles allowed to read it, optionally
+// filtered by ?user=, ?command=, ?server=<packed ID>, ?status=, ?since= and
+// ?until= (unix times) and ?limit=.
+func getAudit(w http.ResponseWriter, r *http.Request, auth *generator.Auth, audit *generator.AuditLog, config *generator.Config) {
+	if audit == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user, status := authenticate(r, auth)
+	if user == nil {
+		w.WriteHeader(status)
+		return
+	}
+	allowed := false
+	for _, role := range config.AuditRoles {
+		allowed = allowed || role == user.Role
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := generator.AuditFilter{
+		User:    query.Get("user"),
+		Command: query.Get("command"),
+		Status:  query.Get("status"),
+	}
+	if v := query.Get("server"); len(v) > 0 {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		filter.ServerID = uint32(id)
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(name); len(v) > 0 {
+			unix, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			*t = time.Unix(unix, 0)
+		}
+	}
+	if v := query.Get("limit"); len(v) > 0 {
+		var err error
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := audit.Query(filter)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writePrivateJSON(w, entries)
+}
+
+// getCommands lists the known commands with their parameters and targets.
+func getCommands(w http.ResponseWriter, r *http.Request, commands *generator.CommandRegistry) {
+	writeJSON(w, r, commands.Specs())
+}
+
+// postCommand builds a command from its name, e.g. /commands/spawnbed, and a
+// JSON generator.CommandRequest body, then publishes it like sendCommand.
+func postCommand(w http.ResponseWriter, r *http.Request, auth *generator.Auth, commander *generator.Commander, commands *generator.CommandRegistry, config *generator.Config) {
 	log.Println(r.Method, r.URL.Path)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "application/json")
 
-	wrapper := make(map[string]string)
-	wrapper["url"] = config.TerritoryURL
+	if r.Method != "POST" || config.DisableCommands {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, status := authenticate(r, auth)
+	if user == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	var req generator.CommandRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command, err := commands.Build(strings.TrimPrefix(r.URL.Path, "/commands/"), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoded := command.String()
+	result, published := publishCommand(w, r, commander, user, command, encoded)
+	if !published {
+		return
+	}
+
+	writePrivateJSON(w, struct {
+		Command     string `json:"Command"`
+		Subscribers int64  `json:"Subscribers"`
+	}{encoded, result})
+}
 
-	js, err := json.Marshal(wrapper)
+const sessionCookie = "session"
+
+// authenticate returns the user of a request from an API key, sent as
+// "Authorization: Bearer <key>" or "X-API-Key: <key>", or from the session
+// cookie. Requests other than GET using the cookie must send the session's
+// CSRF token as X-CSRF-Token. Without a user the status to answer is returned.
+func authenticate(r *http.Request, auth *generator.Auth) (*generator.Session, int) {
+	key := r.Header.Get("X-API-Key")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		key = strings.TrimPrefix(header, "Bearer ")
+	}
+	if len(key) > 0 {
+		if user, ok := auth.Key(key); ok {
+			return user, http.StatusOK
+		}
+		return nil, http.StatusUnauthorized
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
 	if err != nil {
+		return nil, http.StatusUnauthorized
+	}
+	user, ok := auth.Session(cookie.Value)
+	if !ok {
+		return nil, http.StatusUnauthorized
+	}
+	if r.Method != "GET" && !user.CheckCSRF(r.Header.Get("X-CSRF-Token")) {
+		return nil, http.StatusForbidden
+	}
+	return user, http.StatusOK
+}
+
+// writePrivateJSON answers with data for the logged in user only. Unlike the
+// map data it is never shared with other origins or cached.
+func writePrivateJSON(w http.ResponseWriter, v interface{}) {
+	writePrivateJSONStatus(w, http.StatusOK, v)
+}
+
+// writePrivateJSONStatus is writePrivateJSON with a status other than 200 OK.
+func writePrivateJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// login starts a session from a JSON {"Name": ..., "Password": ...} body and
+// sets the session cookie. Failed logins take a token from the address's
+// bucket in failures, an address with none left is answered with 429.
+func login(w http.ResponseWriter, r *http.Request, auth *generator.Auth, failures *generator.RateLimiter, config *generator.Config) {
+	log.Println(r.Method, r.URL.Path)
+	if r.Method != "POST" || config.DisableCommands {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	addr := remoteAddr(r)
+	if wait := failures.Wait(addr); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many failed logins", http.StatusTooManyRequests)
+		return
+	}
+
+	var credentials struct {
+		Name     string
+		Password string
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&credentials); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, user, err := auth.Login(credentials.Name, credentials.Password)
+	if err == generator.ErrBadLogin {
+		log.Println("failed login:", credentials.Name, r.RemoteAddr)
+		failures.Allow(addr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  user.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writePrivateJSON(w, user)
+}
+
+// logout ends the session of the session cookie.
+func logout(w http.ResponseWriter, r *http.Request, auth *generator.Auth) {
+	log.Println(r.Method, r.URL.Path)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if user, status := authenticate(r, auth); user == nil {
+		w.WriteHeader(status)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		auth.Logout(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusOK)
+}
+
+// getSession serves the logged in user with the CSRF token and the command
+// verbs they may send. 405 means commands are disabled.
+func getSession(w http.ResponseWriter, r *http.Request, auth *generator.Auth, config *generator.Config) {
+	if config.DisableCommands {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, status := authenticate(r, auth)
+	if user == nil {
+		w.WriteHeader(status)
+		return
+	}
+	writePrivateJSON(w, user)
+}
+
+// writeSnapshot serves an encoded snapshot, answering 304 Not Modified when
+// the client already holds the current version.
+func writeSnapshot(w http.ResponseWriter, r *http.Request, snapshot generator.Snapshot) {
+	writeTagged(w, r, snapshot.ETag(), snapshot.JSON)
+}
+
+// writeTagged answers with js and its entity tag, or with 304 Not Modified
+// when the client already has it. Clients have to revalidate unless the
+// handler set its own Cache-Control.
+func writeTagged(w http.ResponseWriter, r *http.Request, etag string, js []byte) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if len(w.Header().Get("Cache-Control")) == 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Write(js)
 }
 
-func getIslands(w http.ResponseWriter, r *http.Request) {
+// etagMatches checks an If-None-Match header against an entity tag.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// getTerritoryURL serves the base URL of the territory tiles. When the tiles
+// are rendered here the claim CRC is added as "version", so the viewer only
+// reloads them after the claims changed.
+func getTerritoryURL(w http.ResponseWriter, r *http.Request, url string, territory *generator.TerritoryRenderer) {
+	log.Println(r.Method, r.URL.Path)
+	response := map[string]string{"url": url}
+	if territory != nil {
+		response["version"] = fmt.Sprintf("%08x", territory.Version())
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, r, response)
+}
+
+// getIslands serves the current island data, or the archived state at a unix
+// time given by ?at=.
+func getIslands(w http.ResponseWriter, r *http.Request, store *generator.SnapshotStore, history *generator.History) {
+	at := r.URL.Query().Get("at")
+	if len(at) == 0 {
+		writeSnapshot(w, r, store.Get("islands"))
+		return
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "application/json")
+	if history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	t, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	output, err := history.IslandsAt(t)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if output == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, output)
+}
 
-	islandDataLock.RLock()
-	w.Write([]byte(islandData))
-	islandDataLock.RUnlock()
+// getIslandHistory serves the ownership timeline of the island in the path,
+// e.g. /history/island/42.
+func getIslandHistory(w http.ResponseWriter, r *http.Request, history *generator.History) {
+	log.Println(r.Method, r.URL.Path)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	islandID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/history/island/"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, r, history.IslandTimeline(islandID))
 }
 
-func getEntities(w http.ResponseWriter, r *http.Request) {
+// getEvents serves colony events, optionally filtered by ?tribe=, ?island=,
+// ?type=, ?since=<event id> and ?limit=.
+func getEvents(w http.ResponseWriter, r *http.Request, events *generator.EventLog) {
+	query := r.URL.Query()
+	var filter generator.EventFilter
+	var err error
+	if v := query.Get("tribe"); len(v) > 0 {
+		if filter.TribeID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("island"); len(v) > 0 {
+		if filter.IslandID, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("since"); len(v) > 0 {
+		if filter.SinceID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); len(v) > 0 {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	filter.Type = query.Get("type")
+
+	writeJSON(w, r, events.Query(filter))
+}
+
+// getLeaderboard ranks the top tribes by ?strategy= (points, islands,
+// settlers, tax or warwins, defaulting to the configured strategy). ?n=
+// overrides the number of tribes, up to generator.MaxLeaderboardSize.
+func getLeaderboard(w http.ResponseWriter, r *http.Request, store *generator.SnapshotStore, events *generator.EventLog, rankers map[string]generator.Ranker, config *generator.Config) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	strategy := query.Get("strategy")
+	if len(strategy) == 0 {
+		strategy = config.RankingStrategy
+	}
+	ranker, err := generator.LookupRanker(rankers, strategy)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n := config.LeaderboardSize
+	if v := query.Get("n"); len(v) > 0 {
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if n > generator.MaxLeaderboardSize {
+			n = generator.MaxLeaderboardSize
+		}
+	}
+	writeJSON(w, r, generator.Rank(ranker, store.Islands(), events, n, time.Now()))
+}
 
-	entityDataLock.RLock()
-	w.Write([]byte(entityData))
-	entityDataLock.RUnlock()
+// getEntityTrack serves the recorded positions of the entity in the path as
+// GeoJSON, e.g. /entity/12345/track.
+func getEntityTrack(w http.ResponseWriter, r *http.Request, tracks *generator.TrackStore) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/entity/"), "/")
+	if len(parts) != 2 || parts[1] != "track" || len(parts[0]) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if tracks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	feature := tracks.TrackFeature(parts[0])
+	if feature == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeJSON(w, r, feature)
 }
 
-func getTribes(w http.ResponseWriter, r *http.Request) {
+// getShipPaths serves the ship paths as GeoJSON. With ?npc=1 the estimated
+// positions of auto-spawned NPC ships are included.
+func getShipPaths(w http.ResponseWriter, r *http.Request, paths generator.Snapshot, splines []*generator.ShipPathSpline, grid coords.Grid, config *generator.Config) {
+	w.Header().Set("Content-Type", "application/geo+json")
+	if len(r.URL.Query().Get("npc")) == 0 {
+		writeSnapshot(w, r, paths)
+		return
+	}
+	writeJSON(w, r, generator.ShipPathsGeoJSON(splines, grid, time.Now(), config.NPCShipSpeed))
+}
+
+// getTerritoryTile serves a territory overlay tile, e.g.
+// /territoryTiles/2/1/3.png.
+func getTerritoryTile(w http.ResponseWriter, r *http.Request, territory *generator.TerritoryRenderer) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "application/json")
 
-	tribeDataLock.RLock()
-	w.Write([]byte(tribeData))
-	tribeDataLock.RUnlock()
+	var z, x, y int
+	if n, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/territoryTiles/"), "%d/%d/%d.png", &z, &x, &y); err != nil || n != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tile, crc, err := territory.Tile(z, x, y)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	etag := fmt.Sprintf("\"%08x-%d-%d-%d\"", crc, z, x, y)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(tile)
+}
+
+// getFlag serves a tribe flag from the flag store, e.g. /flags/1234567890.png.
+// Flags missing from the store are loaded from redis, tribes without a valid
+// flag get a 404.
+func getFlag(w http.ResponseWriter, r *http.Request, flags *generator.FlagStore, client *redis.Client) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var tribeID uint64
+	if n, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/flags/"), "%d.png", &tribeID); err != nil || n != 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hash, data, err := flags.Fetch(client, tribeID)
+	if err == generator.ErrNoFlag {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etag := "\"" + hash + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// getVectorTile serves a Mapbox Vector Tile, e.g. /vt/2/1/3.mvt.
+func getVectorTile(w http.ResponseWriter, r *http.Request, tiles *generator.VectorTiles, store *generator.SnapshotStore, index *generator.SpatialIndex) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var z, x, y int
+	if n, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/vt/"), "%d/%d/%d.mvt", &z, &x, &y); err != nil || n != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// taken before the tile is built so a concurrent update is never masked
+	etag := store.Tag(fmt.Sprintf("vt%d-%d-%d-%d", index.Version(), z, x, y))
+	tile, err := tiles.Tile(z, x, y)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(tile)
+}
+
+// getExport serves the whole world state as GeoJSON. ?units= selects map
+// (default), world or gps coordinates.
+func getExport(w http.ResponseWriter, r *http.Request, data *generator.GridData, splines []*generator.ShipPathSpline, grid coords.Grid, store *generator.SnapshotStore, index *generator.SpatialIndex) {
+	log.Println(r.Method, r.URL.Path)
+	project, err := generator.NewProjection(grid, r.URL.Query().Get("units"))
+	if err != nil {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeJSON(w, r, generator.ExportGeoJSON(data, splines, grid, store.Islands(), index, project))
+}
+
+// exportGeoJSON runs the export subcommand: the world state is fetched from
+// redis once and written as GeoJSON, e.g.
+// AtlasMapViewer export -units gps -o world.geojson
+func exportGeoJSON(args []string, gridConfig *atlas.GridConfig, config *generator.Config, tribeDB *redis.Client, territoryDB *redis.Client) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	units := flags.String("units", "map", "Coordinates to write: map, world or gps")
+	output := flags.String("o", "-", "Output file, - for stdout")
+	flags.Parse(args)
+
+	grid := coords.New(gridConfig)
+	project, err := generator.NewProjection(grid, *units)
+	if err != nil {
+		return err
+	}
+	colors, err := generator.LoadTribeColors(config.TribeColorsFile, config.TribeColorDistance)
+	if err != nil {
+		return err
+	}
+	store := generator.NewSnapshotStore()
+	index := generator.NewSpatialIndex(gridConfig)
+	if err := generator.LoadWorld(tribeDB, territoryDB, gridConfig, colors, store, index); err != nil {
+		return err
+	}
+	collection := generator.ExportGeoJSON(generator.NewGridData(gridConfig), newShipPathSplines(gridConfig), grid, store.Islands(), index, project)
+	return writeExport(*output, collection)
+}
+
+// writeExport writes an export to a file, or to stdout for "-".
+func writeExport(output string, collection *generator.GeoJSONFeatureCollection) error {
+	js, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	if output == "-" {
+		_, err = os.Stdout.Write(js)
+		return err
+	}
+	return ioutil.WriteFile(output, js, 0644)
+}
+
+func newShipPathSplines(gridConfig *atlas.GridConfig) []*generator.ShipPathSpline {
+	splines := make([]*generator.ShipPathSpline, len(gridConfig.ShipPaths))
+	for i := range gridConfig.ShipPaths {
+		splines[i] = generator.NewShipPathSpline(&gridConfig.ShipPaths[i])
+	}
+	return splines
+}
+
+// writeJSON encodes and serves a value that is not part of the snapshot store.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sum := sha1.Sum(js)
+	writeTagged(w, r, "\""+hex.EncodeToString(sum[:])+"\"", js)
+}
+
+// getEntities serves the visible entities. ?bbox=minX,minY,maxX,maxY or
+// ?x=&y=&radius= (map coordinates) limit the answer to part of the map. With
+// ?zoom= the answer is an EntityView holding per server clusters below the
+// configured ClusterZoom and the entities otherwise.
+func getEntities(w http.ResponseWriter, r *http.Request, store *generator.SnapshotStore, index *generator.SpatialIndex, config *generator.Config) {
+	query := r.URL.Query()
+	bounds := []float64{0, 0, 1, 1}
+	if bbox := query.Get("bbox"); len(bbox) > 0 {
+		var err error
+		if bounds, err = parseFloats(strings.Split(bbox, ","), 4); err != nil {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if zoom := query.Get("zoom"); len(zoom) > 0 {
+		z, err := strconv.Atoi(zoom)
+		if err != nil {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		view := generator.EntityView{Zoom: z}
+		if z < config.ClusterZoom {
+			view.Clusters = index.Clusters(bounds[0], bounds[1], bounds[2], bounds[3])
+		} else {
+			view.Entities = index.EntitiesIn(bounds[0], bounds[1], bounds[2], bounds[3])
+		}
+		writeJSON(w, r, view)
+		return
+	}
+	if len(query.Get("bbox")) > 0 {
+		writeJSON(w, r, index.EntitiesIn(bounds[0], bounds[1], bounds[2], bounds[3]))
+		return
+	}
+	if radius := query.Get("radius"); len(radius) > 0 {
+		v, err := parseFloats([]string{query.Get("x"), query.Get("y"), radius}, 3)
+		if err != nil {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, r, index.EntitiesNear(v[0], v[1], v[2]))
+		return
+	}
+	writeSnapshot(w, r, store.Get("entities"))
+}
+
+// getNearestIsland serves the island closest to ?entity=<id> or to the map
+// coordinates ?x=&y=.
+func getNearestIsland(w http.ResponseWriter, r *http.Request, index *generator.SpatialIndex) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	query := r.URL.Query()
+	var x, y float64
+	if id := query.Get("entity"); len(id) > 0 {
+		var found bool
+		if x, y, found = index.EntityLocation(id); !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		v, err := parseFloats([]string{query.Get("x"), query.Get("y")}, 2)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		x, y = v[0], v[1]
+	}
+	island := index.NearestIsland(x, y)
+	if island == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, island)
+}
+
+// parseFloats parses exactly n numbers.
+func parseFloats(values []string, n int) ([]float64, error) {
+	if len(values) != n {
+		return nil, fmt.Errorf("expected %d numbers, got %d", n, len(values))
+	}
+	v := make([]float64, n)
+	for i := range values {
+		var err error
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(values[i]), 64); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// getOrphans lists entities hidden from /getdata because their parent entity
+// does not exist.
+func getOrphans(w http.ResponseWriter, r *http.Request, store *generator.SnapshotStore) {
+	writeSnapshot(w, r, store.Get("orphans"))
+}
+
+func getTribes(w http.ResponseWriter, r *http.Request, store *generator.SnapshotStore) {
+	writeSnapshot(w, r, store.Get("tribes"))
+}
+
+// getTopTribes serves the ranks, names, colors and flags of the top tribes as
+// tribes.json.
+func getTopTribes(w http.ResponseWriter, r *http.Request, store *generator.SnapshotStore) {
+	writeSnapshot(w, r, store.Get("toptribes"))
+}
+
+// streamChanges pushes live map changes as Server-Sent Events. Each event ID
+// is a resume token: a reconnecting client sends it back via Last-Event-ID (or
+// ?since=) and receives everything it missed. A "resync" event tells the
+// client its token is too old and it must refetch the full snapshots.
+func streamChanges(w http.ResponseWriter, r *http.Request, feed *generator.Feed) {
+	log.Println(r.Method, r.URL.Path)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	token := r.Header.Get("Last-Event-ID")
+	if len(token) == 0 {
+		token = r.URL.Query().Get("since")
+	}
+	lastID := feed.LastID()
+	if len(token) > 0 {
+		var err error
+		lastID, err = strconv.ParseUint(token, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	notify, unsubscribe := feed.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		changes, ok := feed.Since(lastID)
+		if !ok {
+			lastID = feed.LastID()
+			fmt.Fprintf(w, "id: %d\nevent: resync\ndata: {}\n\n", lastID)
+		}
+		for _, change := range changes {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.ID, change.Type, change.JSON())
+			lastID = change.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+		}
+	}
 }
 
 func main() {
@@ -117,6 +1045,27 @@ func main() {
 	genConfigFilePtr := flag.String("config", "./config.json", "Generator config file")
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "passwd":
+		if len(flag.Arg(1)) == 0 {
+			log.Fatal("usage: passwd <password>")
+		}
+		hash, err := generator.HashPassword(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	case "apikey":
+		key, hash, err := generator.NewAPIKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("key:", key)
+		fmt.Println("hash:", hash)
+		return
+	}
+
 	serverOnlyConfig, err := atlas.LoadSeverOnlyConfig(filepath.Join(*atlasDirPtr, "ServerGrid.ServerOnly.json"))
 	if err != nil {
 		log.Fatal(err)
@@ -143,21 +1092,136 @@ func main() {
 		DB:       0,
 	})
 
-	islandData = "{}"
-	entityData = "{}"
-	tribeData = "{}"
+	if flag.Arg(0) == "export" {
+		if err := exportGeoJSON(flag.Args()[1:], gridConfig, generatorConfig, dbTribeClient, dbTerritoryClient); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var history *generator.History
+	if len(generatorConfig.ArchiveDir) > 0 {
+		history, err = generator.OpenHistory(generatorConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store := generator.NewSnapshotStore()
+	feed := generator.NewFeed(generatorConfig.StreamHistorySize)
+	events := generator.NewEventLog(generatorConfig.EventLogSize)
+	var territory *generator.TerritoryRenderer
+	if !generatorConfig.DisableTerritory {
+		territory = generator.NewTerritoryRenderer()
+		http.HandleFunc("/territoryTiles/", func(w http.ResponseWriter, r *http.Request){ getTerritoryTile(w, r, territory) })
+	}
+	rankers := generator.NewRankers(generatorConfig)
+	ranker, err := generator.LookupRanker(rankers, generatorConfig.RankingStrategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	colors, err := generator.OpenTribeColors(generatorConfig.TribeColorsFile, generatorConfig.TribeColorDistance)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flags, err := generator.NewFlagStore(generatorConfig.FlagDir, generatorConfig.FlagSize, generatorConfig.FlagCacheSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tribes *generator.TribeFlags
+	if generatorConfig.EnableTribes {
+		tribes = generator.NewTribeFlags(dbTribeClient, gridConfig, generatorConfig, flags, store)
+	}
 	if generatorConfig.ColonyFetchRateInSeconds > 0 {
-		go generator.ProcessColony(dbTribeClient, dbTerritoryClient, gridConfig, generatorConfig, &islandData, &islandDataLock)
+		go generator.ProcessColony(dbTribeClient, dbTerritoryClient, gridConfig, generatorConfig, store, feed, history, events, territory, colors, tribes, ranker)
+	}
+	index := generator.NewSpatialIndex(gridConfig)
+	var tracks *generator.TrackStore
+	if generatorConfig.TrackLength > 0 {
+		tracks = generator.NewTrackStore(generatorConfig.TrackLength, generatorConfig.TrackMaxAgeInSeconds)
 	}
 	if generatorConfig.EntityFetchRateInSeconds > 0 {
-		go generator.ProcessEntities(dbTribeClient, generatorConfig, &entityData, &entityDataLock, &tribeData, &tribeDataLock)
+		go generator.ProcessEntities(dbTribeClient, gridConfig, generatorConfig, store, feed, history, tracks, index)
 	}
 
-	http.HandleFunc("/gettribes", getTribes)
-	http.HandleFunc("/getdata", getEntities)
-	http.HandleFunc("/getislands", getIslands);
-	http.HandleFunc("/command", func(w http.ResponseWriter, r *http.Request){ sendCommand(w, r, dbTribeClient, generatorConfig) } )
-	http.HandleFunc("/territoryURL", func(w http.ResponseWriter, r *http.Request){ getTerritoryURL(w, r, generatorConfig) } )
+	mapInfo, err := store.Static("mapinfo", generator.NewMapInfo(coords.New(gridConfig)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	gridData := generator.NewGridData(gridConfig)
+	gridSnapshots := make(map[string]generator.Snapshot)
+	for path, v := range map[string]interface{}{
+		"/grid":            gridData.Layout,
+		"/grid/islands":    gridData.Islands,
+		"/grid/discozones": gridData.DiscoZones,
+		"/grid/shippaths":  gridData.ShipPaths,
+	} {
+		if gridSnapshots[path], err = store.Static(strings.TrimPrefix(path, "/"), v); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	http.HandleFunc("/gettribes", func(w http.ResponseWriter, r *http.Request){ getTribes(w, r, store) })
+	http.HandleFunc("/getdata", func(w http.ResponseWriter, r *http.Request){ getEntities(w, r, store, index, generatorConfig) })
+	http.HandleFunc("/nearestisland", func(w http.ResponseWriter, r *http.Request){ getNearestIsland(w, r, index) })
+	http.HandleFunc("/getorphans", func(w http.ResponseWriter, r *http.Request){ getOrphans(w, r, store) })
+	http.HandleFunc("/getislands", func(w http.ResponseWriter, r *http.Request){ getIslands(w, r, store, history) })
+	http.HandleFunc("/history/island/", func(w http.ResponseWriter, r *http.Request){ getIslandHistory(w, r, history) })
+	http.HandleFunc("/entity/", func(w http.ResponseWriter, r *http.Request){ getEntityTrack(w, r, tracks) })
+	http.HandleFunc("/flags/", func(w http.ResponseWriter, r *http.Request){ getFlag(w, r, flags, dbTribeClient) })
+	http.HandleFunc(path.Join("/", generatorConfig.ClusterPrefix, "tribes", "tribes.json"), func(w http.ResponseWriter, r *http.Request){ getTopTribes(w, r, store) })
+	http.HandleFunc("/leaderboard", func(w http.ResponseWriter, r *http.Request){ getLeaderboard(w, r, store, events, rankers, generatorConfig) })
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request){ getEvents(w, r, events) })
+	http.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request){ streamChanges(w, r, feed) })
+	auth, err := generator.NewAuth(generatorConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	commands, err := generator.NewCommandRegistry(gridConfig, append(generator.DefaultCommands(), generatorConfig.Commands...))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var audit *generator.AuditLog
+	if len(generatorConfig.AuditLog) > 0 && !generatorConfig.DisableCommands {
+		if audit, err = generator.OpenAuditLog(generatorConfig.AuditLog, generatorConfig.AuditMaxBytes, generatorConfig.AuditKeep); err != nil {
+			log.Fatal(err)
+		}
+	}
+	limiter := generator.NewRateLimiter(generatorConfig.CommandRatePerMinute, generatorConfig.CommandBurst, generatorConfig.GlobalCommandRatePerMinute, generatorConfig.GlobalCommandBurst)
+	commander := generator.NewCommander(dbTribeClient, auth, audit, limiter, generatorConfig.DangerousCommands, time.Duration(generatorConfig.ConfirmTimeoutInSeconds) * time.Second)
+	http.HandleFunc("/command", func(w http.ResponseWriter, r *http.Request){ sendCommand(w, r, auth, commander, commands, generatorConfig) } )
+	http.HandleFunc("/commands", func(w http.ResponseWriter, r *http.Request){ getCommands(w, r, commands) })
+	http.HandleFunc("/commands/", func(w http.ResponseWriter, r *http.Request){ postCommand(w, r, auth, commander, commands, generatorConfig) })
+	var scheduler *generator.Scheduler
+	if !generatorConfig.DisableCommands {
+		if scheduler, err = generator.OpenScheduler(generatorConfig.ScheduleFile, auth, commands, commander); err != nil {
+			log.Fatal(err)
+		}
+		go scheduler.Run()
+	}
+	http.HandleFunc("/schedule", func(w http.ResponseWriter, r *http.Request){ getJobs(w, r, auth, commander, commands, scheduler, generatorConfig) })
+	http.HandleFunc("/schedule/", func(w http.ResponseWriter, r *http.Request){ getJob(w, r, auth, commander, commands, scheduler, generatorConfig) })
+	http.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request){ getAudit(w, r, auth, audit, generatorConfig) })
+	loginFailures := generator.NewRateLimiter(generatorConfig.LoginFailuresPerMinute, generatorConfig.LoginFailureBurst, 0, 0)
+	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request){ login(w, r, auth, loginFailures, generatorConfig) })
+	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request){ logout(w, r, auth) })
+	http.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request){ getSession(w, r, auth, generatorConfig) })
+	for path, snapshot := range gridSnapshots {
+		snapshot := snapshot
+		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request){ writeSnapshot(w, r, snapshot) })
+	}
+	grid := coords.New(gridConfig)
+	splines := newShipPathSplines(gridConfig)
+	shipPaths, err := store.Static("shippaths", generator.ShipPathsGeoJSON(splines, grid, time.Now(), 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.HandleFunc("/shippaths", func(w http.ResponseWriter, r *http.Request){ getShipPaths(w, r, shipPaths, splines, grid, generatorConfig) })
+	vectorTiles := generator.NewVectorTiles(gridData, store, index, generatorConfig.ClusterZoom)
+	http.HandleFunc("/vt/", func(w http.ResponseWriter, r *http.Request){ getVectorTile(w, r, vectorTiles, store, index) })
+	http.HandleFunc("/export/geojson", func(w http.ResponseWriter, r *http.Request){ getExport(w, r, gridData, splines, grid, store, index) })
+	http.HandleFunc("/mapinfo", func(w http.ResponseWriter, r *http.Request){ writeSnapshot(w, r, mapInfo) })
+	http.HandleFunc("/territoryURL", func(w http.ResponseWriter, r *http.Request){ getTerritoryURL(w, r, generatorConfig.TerritoryURL, territory) } )
 	http.Handle("/", http.FileServer(http.Dir(generatorConfig.StaticDir)))
 
 	endpoint := fmt.Sprintf("%s:%d", generatorConfig.Host, generatorConfig.Port)
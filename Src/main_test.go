@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"AtlasMapViewer/atlas"
+	"AtlasMapViewer/atlas/coords"
+	"AtlasMapViewer/generator"
+)
+
+func TestETagMatches(t *testing.T) {
+	etag := `"abc-islands-3"`
+	for _, c := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc-islands-3"`, true},
+		{`W/"abc-islands-3"`, true},
+		{`"abc-islands-2", "abc-islands-3"`, true},
+		{`"x",W/"abc-islands-3"`, true},
+		{`*`, true},
+		{`"abc-islands-2"`, false},
+		{`abc-islands-3`, false},
+		{`"abc-islands-3`, false},
+		{``, false},
+	} {
+		if got := etagMatches(c.header, etag); got != c.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", c.header, got, c.want)
+		}
+	}
+}
+
+// getTagged requests a handler, optionally with If-None-Match.
+func getTagged(handler http.HandlerFunc, ifNoneMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	if len(ifNoneMatch) > 0 {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	store := generator.NewSnapshotStore()
+	if err := store.SetTribes(map[string]string{"1": "Tribe"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		writeSnapshot(w, r, store.Get("tribes"))
+	}
+
+	w := getTagged(handler, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != `{"1":"Tribe"}` || len(etag) == 0 {
+		t.Fatalf("writeSnapshot() = %d %q, ETag %q", w.Code, w.Body.String(), etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "ETag" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want ETag", got)
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if w := getTagged(handler, header); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+			t.Errorf("If-None-Match %s = %d %q, want 304", header, w.Code, w.Body.String())
+		}
+	}
+
+	// an update changes the tag
+	if err := store.SetTribes(map[string]string{"1": "Renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	w = getTagged(handler, etag)
+	if w.Code != http.StatusOK || w.Body.String() != `{"1":"Renamed"}` || w.Header().Get("ETag") == etag {
+		t.Errorf("after an update = %d %q, ETag %q", w.Code, w.Body.String(), w.Header().Get("ETag"))
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	value := map[string]int{"a": 1}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, value)
+	}
+
+	w := getTagged(handler, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != `{"a":1}` || len(etag) == 0 {
+		t.Fatalf("writeJSON() = %d %q, ETag %q", w.Code, w.Body.String(), etag)
+	}
+	if w := getTagged(handler, "W/"+etag); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+		t.Errorf("If-None-Match W/%s = %d %q, want 304", etag, w.Code, w.Body.String())
+	}
+
+	// the tag follows the body
+	value["a"] = 2
+	w = getTagged(handler, etag)
+	if w.Code != http.StatusOK || w.Body.String() != `{"a":2}` || w.Header().Get("ETag") == etag {
+		t.Errorf("changed value = %d %q, ETag %q", w.Code, w.Body.String(), w.Header().Get("ETag"))
+	}
+
+	// a handler's own Cache-Control is kept
+	cached := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		writeJSON(w, r, value)
+	}
+	if got := getTagged(cached, "").Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Cache-Control = %q, want the handler's", got)
+	}
+}
+
+// testEntities places ships at random on a 4 by 3 grid, each with a bed at an
+// offset relative to it.
+func testEntities(r *rand.Rand, grid coords.Grid) map[string]generator.EntityInfo {
+	entities := make(map[string]generator.EntityInfo)
+	for i := 0; i < 300; i++ {
+		ship := generator.EntityInfo{
+			EntityID:                fmt.Sprint(2*i + 1),
+			ParentEntityID:          "0",
+			EntityType:              "Ship",
+			ServerXRelativeLocation: r.Float64(),
+			ServerYRelativeLocation: r.Float64(),
+			ServerID:                [2]uint16{uint16(r.Intn(grid.CellsY)), uint16(r.Intn(grid.CellsX))},
+		}
+		bed := ship
+		bed.EntityID = fmt.Sprint(2*i + 2)
+		bed.ParentEntityID = ship.EntityID
+		bed.EntityType = "Bed"
+		bed.ServerXRelativeLocation = r.Float64()*0.02 - 0.01
+		bed.ServerYRelativeLocation = r.Float64()*0.02 - 0.01
+		entities[ship.EntityID] = ship
+		entities[bed.EntityID] = bed
+	}
+	return entities
+}
+
+// mapLocation places an entity the way the viewer draws it, beds relative to
+// their ship.
+func mapLocation(grid coords.Grid, entities map[string]generator.EntityInfo, info generator.EntityInfo) (float64, float64) {
+	if parent, found := entities[info.ParentEntityID]; found {
+		info.ServerXRelativeLocation += parent.ServerXRelativeLocation
+		info.ServerYRelativeLocation += parent.ServerYRelativeLocation
+	}
+	return grid.WorldToMap(grid.ServerToWorld(int(info.ServerID[1]), int(info.ServerID[0]), info.ServerXRelativeLocation, info.ServerYRelativeLocation))
+}
+
+func TestGetEntitiesSpatialQueries(t *testing.T) {
+	gridConfig := &atlas.GridConfig{GridSize: 1000000, TotalGridsX: 4, TotalGridsY: 3}
+	grid := coords.New(gridConfig)
+	entities := testEntities(rand.New(rand.NewSource(1)), grid)
+	index := generator.NewSpatialIndex(gridConfig)
+	index.UpdateEntities(entities)
+	store := generator.NewSnapshotStore()
+	config := &generator.Config{ClusterZoom: 4}
+
+	// bruteForce returns the IDs inside, and the ships of the beds inside
+	bruteForce := func(inside func(x, y float64) bool) []string {
+		found := make(map[string]bool)
+		for id, info := range entities {
+			if x, y := mapLocation(grid, entities, info); inside(x, y) {
+				found[id] = true
+				if info.ParentEntityID != "0" {
+					found[info.ParentEntityID] = true
+				}
+			}
+		}
+		ids := make([]string, 0, len(found))
+		for id := range found {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	get := func(query string) []string {
+		w := httptest.NewRecorder()
+		getEntities(w, httptest.NewRequest("GET", "/getdata?"+query, nil), store, index, config)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", query, w.Code)
+		}
+		var found map[string]generator.EntityInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &found); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		ids := make([]string, 0, len(found))
+		for id, info := range found {
+			if !reflect.DeepEqual(info, entities[id]) {
+				t.Errorf("%s: entity %s = %+v, want %+v", query, id, info, entities[id])
+			}
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	for _, b := range [][4]float64{
+		{0, 0, 1, 1},
+		{0, 0, 0.5, 0.375},
+		{0.25, 0.25, 0.5, 0.5},
+		{0.6, 0.1, 0.3, 0.4},
+		{0.7, 0.7, 1, 1},
+		{-1, -1, 0.01, 0.01},
+		{0.123, 0.456, 0.124, 0.457},
+	} {
+		query := fmt.Sprintf("bbox=%v,%v,%v,%v", b[0], b[1], b[2], b[3])
+		want := bruteForce(func(x, y float64) bool {
+			return x >= math.Min(b[0], b[2]) && x <= math.Max(b[0], b[2]) && y >= math.Min(b[1], b[3]) && y <= math.Max(b[1], b[3])
+		})
+		if got := get(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s found %d entities, want %d", query, len(got), len(want))
+		}
+	}
+
+	for _, c := range [][3]float64{
+		{0.5, 0.375, 0.1},
+		{0, 0, 0.2},
+		{1, 0.75, 0.05},
+		{0.3, 0.6, 0.01},
+		{0.5, 0.375, 2},
+	} {
+		query := fmt.Sprintf("x=%v&y=%v&radius=%v", c[0], c[1], c[2])
+		want := bruteForce(func(x, y float64) bool {
+			return math.Hypot(x-c[0], y-c[1]) <= c[2]
+		})
+		if got := get(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s found %d entities, want %d", query, len(got), len(want))
+		}
+	}
+
+	for _, query := range []string{"bbox=1,2,3", "bbox=a,b,c,d", "radius=0.1&x=0.5", "radius=x&x=0&y=0"} {
+		w := httptest.NewRecorder()
+		getEntities(w, httptest.NewRequest("GET", "/getdata?"+query, nil), store, index, config)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetEntitiesZoom(t *testing.T) {
+	gridConfig := &atlas.GridConfig{GridSize: 1000000, TotalGridsX: 4, TotalGridsY: 3}
+	grid := coords.New(gridConfig)
+	entities := testEntities(rand.New(rand.NewSource(2)), grid)
+	index := generator.NewSpatialIndex(gridConfig)
+	index.UpdateEntities(entities)
+	config := &generator.Config{ClusterZoom: 4}
+
+	for _, c := range []struct {
+		zoom     int
+		clusters bool
+	}{{0, true}, {3, true}, {4, false}, {6, false}} {
+		w := httptest.NewRecorder()
+		getEntities(w, httptest.NewRequest("GET", fmt.Sprintf("/getdata?zoom=%d&bbox=0,0,1,1", c.zoom), nil), nil, index, config)
+		var view generator.EntityView
+		if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+			t.Fatalf("zoom %d: %v", c.zoom, err)
+		}
+		if view.Zoom != c.zoom {
+			t.Errorf("zoom %d: view zoom %d", c.zoom, view.Zoom)
+		}
+		if c.clusters {
+			count := 0
+			for _, cluster := range view.Clusters {
+				count += cluster.Count
+			}
+			if len(view.Clusters) != 12 || count != len(entities) || view.Entities != nil {
+				t.Errorf("zoom %d: %d clusters of %d entities and %d entities, want 12 clusters of %d", c.zoom, len(view.Clusters), count, len(view.Entities), len(entities))
+			}
+		} else if len(view.Entities) != len(entities) || view.Clusters != nil {
+			t.Errorf("zoom %d: %d entities and %d clusters, want %d entities", c.zoom, len(view.Entities), len(view.Clusters), len(entities))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	getEntities(w, httptest.NewRequest("GET", "/getdata?zoom=x", nil), nil, index, config)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("zoom=x: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExportGeoJSON(t *testing.T) {
+	gridConfig := &atlas.GridConfig{GridSize: 1000, TotalGridsX: 2, TotalGridsY: 1}
+	for x := 0; x < 2; x++ {
+		gridConfig.Servers = append(gridConfig.Servers, atlas.ServerGridConfig{GridX: x, GridY: 0})
+	}
+	grid := coords.New(gridConfig)
+
+	// the units are checked before the databases are read
+	if err := exportGeoJSON([]string{"-units", "feet"}, gridConfig, &generator.Config{}, nil, nil); err == nil {
+		t.Errorf("exportGeoJSON() accepted unknown units")
+	}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "world.geojson")
+
+	project, err := generator.NewProjection(grid, "gps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := generator.NewSpatialIndex(gridConfig)
+	index.UpdateEntities(map[string]generator.EntityInfo{
+		"7": {EntityID: "7", ParentEntityID: "0", EntityType: "Ship", ServerID: [2]uint16{0, 1}, ServerXRelativeLocation: 0.5, ServerYRelativeLocation: 0.5},
+	})
+	islands := &generator.IslandOutput{Islands: []generator.IslandInfoOutput{}, Companies: []generator.CompanyInfoOutput{}}
+	collection := generator.ExportGeoJSON(generator.NewGridData(gridConfig), newShipPathSplines(gridConfig), grid, islands, index, project)
+	if err := writeExport(path, collection); err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string      `json:"type"`
+				Coordinates interface{} `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(js, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != "FeatureCollection" || len(got.Features) != 3 {
+		t.Fatalf("export = %s, want a collection of 2 servers and a ship", js)
+	}
+	for _, f := range got.Features {
+		if f.Properties["kind"] != "entity" {
+			continue
+		}
+		// the middle of B1 is in the east half of the map, on the equator
+		want := []interface{}{50.0, 0.0}
+		if f.Geometry.Type != "Point" || !reflect.DeepEqual(f.Geometry.Coordinates, want) {
+			t.Errorf("ship at %s %v, want a Point at %v", f.Geometry.Type, f.Geometry.Coordinates, want)
+		}
+	}
+}
+
+// newTestAuth returns an Auth with an admin "alice" with password "secret"
+// and an API key "key".
+func newTestAuth(t *testing.T) *generator.Auth {
+	hash, err := generator.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := generator.NewAuth(&generator.Config{
+		Accounts:                []generator.Account{{Name: "alice", PasswordHash: hash, Role: generator.RoleAdmin}},
+		APIKeys:                 []generator.APIKey{{Name: "script", KeyHash: generator.HashAPIKey("key"), Role: generator.RoleAdmin}},
+		RoleCommands:            map[string][]string{generator.RoleAdmin: {"*"}},
+		SessionTimeoutInSeconds: 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := newTestAuth(t)
+	token, session, err := auth.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredSession, err := auth.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredSession.Expires = time.Now().Add(-time.Second)
+
+	for _, c := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		cookie  string
+		user    string
+		status  int
+	}{
+		{"nothing", "GET", nil, "", "", http.StatusUnauthorized},
+		{"bearer", "POST", map[string]string{"Authorization": "Bearer key"}, "", "script", http.StatusOK},
+		{"api key header", "POST", map[string]string{"X-API-Key": "key"}, "", "script", http.StatusOK},
+		{"bad bearer", "GET", map[string]string{"Authorization": "Bearer nope"}, "", "", http.StatusUnauthorized},
+		{"bad api key", "GET", map[string]string{"X-API-Key": "nope"}, "", "", http.StatusUnauthorized},
+		// a wrong key is not made up for by a valid cookie
+		{"bad key and cookie", "GET", map[string]string{"X-API-Key": "nope"}, token, "", http.StatusUnauthorized},
+		{"basic", "GET", map[string]string{"Authorization": "Basic a2V5"}, "", "", http.StatusUnauthorized},
+		{"cookie get", "GET", nil, token, "alice", http.StatusOK},
+		{"cookie post without csrf", "POST", nil, token, "", http.StatusForbidden},
+		{"cookie post bad csrf", "POST", map[string]string{"X-CSRF-Token": "nope"}, token, "", http.StatusForbidden},
+		{"cookie post", "POST", map[string]string{"X-CSRF-Token": session.CSRFToken}, token, "alice", http.StatusOK},
+		{"cookie delete without csrf", "DELETE", nil, token, "", http.StatusForbidden},
+		{"unknown cookie", "GET", nil, "nope", "", http.StatusUnauthorized},
+		{"expired cookie", "GET", nil, expired, "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(c.method, "/command", nil)
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		if len(c.cookie) > 0 {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: c.cookie})
+		}
+		user, status := authenticate(r, auth)
+		name := ""
+		if user != nil {
+			name = user.Name
+		}
+		if name != c.user || status != c.status {
+			t.Errorf("%s: authenticate() = %q, %d, want %q, %d", c.name, name, status, c.user, c.status)
+		}
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	auth := newTestAuth(t)
+	config := &generator.Config{}
+	failures := generator.NewRateLimiter(1, 2, 0, 0)
+	post := func(addr, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(`{"Name": "alice", "Password": "`+password+`"}`))
+		r.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		login(w, r, auth, failures, config)
+		return w
+	}
+
+	// successful logins do not count
+	for i := 0; i < 3; i++ {
+		if w := post("10.0.0.1", "secret"); w.Code != http.StatusOK {
+			t.Fatalf("login %d: status %d", i, w.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if w := post("10.0.0.1", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("failed login %d: status %d, want %d", i, w.Code, http.StatusUnauthorized)
+		}
+	}
+	// then even the right password is refused until a token is earned back
+	w := post("10.0.0.1", "secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("throttled login: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 60 {
+		t.Errorf("throttled login Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+	if len(w.Header().Get("Set-Cookie")) > 0 {
+		t.Errorf("throttled login set a cookie")
+	}
+	// other addresses are not affected
+	if w := post("10.0.0.2", "secret"); w.Code != http.StatusOK {
+		t.Errorf("login from another address: status %d", w.Code)
+	}
+}
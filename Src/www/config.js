@@ -1,11 +1,4 @@
 const config = {
     EnableTerritory: false,
     EnableColonies: true,
-    ServersX: 15,
-    ServersY: 15,
-    Suggestions: [
-        "spawnshipfast name",
-        "spawnbed name",
-        "destroyall",
-    ]
 }
\ No newline at end of file
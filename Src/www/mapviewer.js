@@ -182,9 +182,9 @@ function updateIsland() {
 
 // https://gis.stackexchange.com/questions/238762/rollover-leaflet-popup-on-mouseover
 // https://jsfiddle.net/eL8bvre7/
-class IslandCircle extends L.Circle {
-  constructor(latlng, options) {
-    super(latlng, options)
+class IslandShape extends L.Polygon {
+  constructor(latlngs, options) {
+    super(latlngs, options)
 
     this.Island = null
 
@@ -279,8 +279,20 @@ function escapeHTML(unsafe_str) {
     .replace(/\'/g, '&#39;'); // '&apos;' is not valid HTML 4
 }
 
-// possibilities are a list of all known commands and their parameters
-const possibilities = config.Suggestions
+// possibilities are a list of all known commands and their parameters, loaded
+// from the server for the logged in user
+let possibilities = []
+
+function loadPossibilities(session) {
+  return fetch("commands")
+    .then(res => res.json())
+    .then(specs => {
+      const allowed = session.Commands.map(cmd => cmd.toLowerCase())
+      possibilities = specs
+        .filter(spec => allowed.includes("*") || allowed.includes(spec.Name.toLowerCase()))
+        .map(spec => [spec.Name, ...spec.Params.map(p => p.Optional ? `[${p.Name}]` : p.Name)].join(" "))
+    })
+}
 
 const icon = (type, subtype, color) => L.icon({
   iconUrl: `${type}/${subtype}/${color}.png`,
@@ -387,6 +399,56 @@ class CommandMarker extends React.Component {
   render() { return null }
 }
 
+class ClusterMarker extends React.Component {
+  componentDidMount() {
+    this.add()
+  }
+
+  componentDidUpdate() {
+    this.del()
+    this.add()
+  }
+
+  componentWillUnmount() {
+    this.del()
+  }
+
+  render() { return null }
+
+  add() {
+    const { cluster, map } = this.props
+
+    let infoPanel = `<strong>${cluster.Cell}</strong> - ${cluster.Count}<br>`
+    cluster.Counts.forEach(count => {
+      const name = count.EntitySubType && count.EntitySubType != "None"
+        ? `${count.EntityType} - ${count.EntitySubType}` : count.EntityType
+      infoPanel +=
+        `<span class="clusterswatch" style="background: ${getTribeColor(count.TribeID)}"></span>
+        ${escapeHTML(name)}: ${count.Count}<br>`
+    })
+
+    this.marker =
+      L.marker([-256 * cluster.Y, 256 * cluster.X], {
+        icon: L.divIcon({
+          className: "clusterlabel",
+          html: `<div>${cluster.Count}</div>`,
+          iconSize: [32, 32],
+        }),
+        title: cluster.Cell,
+      })
+        .bindPopup(infoPanel)
+        .addTo(map.entities.Clusters)
+  }
+
+  del() {
+    if (!this.marker)
+      return
+
+    this.props.map.entities.Clusters.removeLayer(this.marker)
+    delete this.marker
+  }
+}
+
 class ShipPath extends React.Component {
   constructor(props) {
     super(props)
@@ -441,7 +503,7 @@ class WorldMap extends React.Component {
     const baseLayer = L.tileLayer("tiles/{z}/{x}/{y}.png", {
       maxZoom: 6,
       minZoom: 1,
-      bounds: L.latLngBounds([0,0],[-256,256]),
+      bounds: mapBounds(),
       noWrap: true,
     })
 
@@ -474,6 +536,8 @@ class WorldMap extends React.Component {
     map.entities.Ship = L.layerGroup().addTo(map)
     map.entities.IslandTerritories = L.layerGroup().addTo(map);
     map.entities.IslandNames = L.layerGroup().addTo(map);
+    map.entities.ShipPaths = L.layerGroup();
+    map.entities.Clusters = L.layerGroup().addTo(map);
 
     var createIslandLabel = function (island) {
       var label = "";
@@ -500,8 +564,42 @@ class WorldMap extends React.Component {
     L.control.layers({}, {
       Beds: map.entities.Bed,
       Ships: map.entities.Ship,
+      Clusters: map.entities.Clusters,
+      "Ship Paths": map.entities.ShipPaths,
     }, {position: 'topright'}).addTo(map)
 
+    fetch("shippaths?npc=1")
+      .then(res => res.json())
+      .then(paths => {
+        L.geoJSON(paths, {
+          coordsToLatLng: (coords) => L.latLng(-256 * coords[1], 256 * coords[0]),
+          style: { color: "white", weight: 1, dashArray: "4 6", opacity: 0.7 },
+          pointToLayer: (feature, latlng) => L.circleMarker(latlng, { radius: 4, color: "red" }),
+          onEachFeature: (feature, layer) => {
+            const props = feature.properties
+            if (props.kind === "npcship")
+              layer.bindPopup(`<strong>${escapeHTML(props.ShipClass)}</strong><br>${props.GPS}`)
+            else
+              layer.bindPopup(`<strong>${escapeHTML(props.PathName)}</strong>`)
+          },
+        }).addTo(map.entities.ShipPaths)
+      })
+      .catch(err => console.error(err))
+
+    if (this.props.onViewChange) {
+      map.on("moveend", () => {
+        // map coordinates of the visible area
+        const bounds = map.getBounds()
+        this.props.onViewChange({
+          zoom: map.getZoom(),
+          bbox: [
+            bounds.getWest() / 256, -bounds.getNorth() / 256,
+            bounds.getEast() / 256, -bounds.getSouth() / 256,
+          ],
+        })
+      })
+    }
+
     if (this.props.onContextMenu)
       map.on("contextmenu.show", this.props.onContextMenu)
     if (this.props.onContextMenuClose)
@@ -539,6 +637,8 @@ class WorldMap extends React.Component {
           var IslandEntries = IslandDataJson.Islands;
           var CompanyHashMap = IslandDataJson.Companies.reduce(function (map, obj) {
             map[obj.TribeId] = obj;
+            if (obj.Color)
+              tribeColors[obj.TribeId] = obj.Color;
             return map;
           }, {});
 
@@ -559,8 +659,7 @@ class WorldMap extends React.Component {
 
             var OwningTribe = CompanyHashMap[Island.TribeId];
             if (OwningTribe) {
-              var circle = new IslandCircle([-256 * Island.Y, 256 * Island.X], {
-                radius: Island.Size * 256,
+              var shape = new IslandShape(Island.Footprint.map(p => [-256 * p[1], 256 * p[0]]), {
                 //color: Island.Color,
                 color: getTribeColor(Island.TribeId),
                 opacity: 0,
@@ -569,7 +668,7 @@ class WorldMap extends React.Component {
                 fillOpacity: 0.5
               });
               var PopupHTML = '';
-              circle.Island = Island;
+              shape.Island = Island;
               if (OwningTribe.FlagURL) {
                 PopupHTML = '<p><img border="0" alt="CompanyFlag" src="' + OwningTribe.FlagURL + '" width="100" height="100"></p>';
               }
@@ -581,8 +680,8 @@ class WorldMap extends React.Component {
                 PopupHTML += '<br>Settlers: ' + Island.NumSettlers;
               }
               PopupHTML += '<br>Taxation: ' + Island.TaxRate.toFixed(1) + '%';
-              circle.bindPopup(PopupHTML, { showOnMouseOver: true });
-              map.entities.IslandTerritories.addLayer(circle);
+              shape.bindPopup(PopupHTML, { showOnMouseOver: true });
+              map.entities.IslandTerritories.addLayer(shape);
             }
           }
         });
@@ -598,17 +697,24 @@ class WorldMap extends React.Component {
         .then(res => res.json())
         .then(config => {
           if (config.url) {
+            // tiles rendered by this service are only reloaded once the claims
+            // change; others at most every refresh
+            var version = config.version || Math.floor(Date.now() / 15000)
+            var url = config.url + "{z}/{x}/{y}.png?v=" + encodeURIComponent(version)
+            if (this.territoryLayer && this.territoryLayerURL === url)
+              return
+
             if (this.territoryLayer) {
               this.worldMap.removeLayer(this.territoryLayer)
               delete this.territoryLayer
             }
 
-            this.territoryLayer = L.tileLayer(config.url + "{z}/{x}/{y}.png?t={cachebuster}", {
+            this.territoryLayerURL = url
+            this.territoryLayer = L.tileLayer(url, {
               maxZoom: 6,
               minZoom: 1,
-              bounds: L.latLngBounds([0,0],[-256,256]),
-              noWrap: true,
-              cachebuster: function() { return Math.random(); }
+              bounds: mapBounds(),
+              noWrap: true
             })
 
             this.territoryLayer.addTo(this.worldMap)
@@ -639,7 +745,7 @@ class WorldMap extends React.Component {
   }
 
   render() {
-    const { entities, commandMarker, shipPath, color, onCancelCommand } = this.props
+    const { entities, clusters, commandMarker, shipPath, color, onCancelCommand } = this.props
 
     return (
       <div id="worldmap">
@@ -662,6 +768,13 @@ class WorldMap extends React.Component {
           )
         })
         }
+        {clusters.map(cluster =>
+          <ClusterMarker
+            key={cluster.ServerId}
+            cluster={cluster}
+            map={this.worldMap}
+          />
+        )}
         {commandMarker &&
           <CommandMarker map={this.worldMap} latlng={commandMarker} onClose={onCancelCommand} />
         }
@@ -685,9 +798,20 @@ function serverIDparts(serverID) {
   ]
 }
 
+// cellSize returns the size of one server cell in map units. The longest side
+// of the world spans 256 units so cells stay square on rectangular grids.
+function cellSize() {
+  return 256 / Math.max(config.ServersX, config.ServersY)
+}
+
+function mapBounds() {
+  const cell = cellSize()
+  return L.latLngBounds([0,0],[-cell * config.ServersY, cell * config.ServersX])
+}
+
 function calcLatLng(info) {
-  const serverX = 256 / config.ServersX
-  const serverY = 256 / config.ServersY
+  const serverX = cellSize()
+  const serverY = cellSize()
   const offset = {
     x: info.ServerID[1] * serverX,
     y: info.ServerID[0] * serverY,
@@ -713,8 +837,10 @@ function calcServerLocation(latlng) {
   if (latlng.lat > 0 || latlng.lng < 0)
     return
 
-  const ServerX = 256 / config.ServersX
-  const ServerY = 256 / config.ServersY
+  const ServerX = cellSize()
+  const ServerY = cellSize()
+  if (latlng.lng >= ServerX * config.ServersX || -latlng.lat >= ServerY * config.ServersY)
+    return
 
   const serverID = {
     x: Math.floor(latlng.lng / ServerX),
@@ -752,14 +878,18 @@ function isTribeID(tribeID) {
   return tribeID > 1000000000 + 50000
 }
 
+// tribeColors are the colors the server assigned to the tribes owning islands
+const tribeColors = {}
+
+// getTribeColor returns the server's color for a tribe. Tribes without one,
+// e.g. without islands, get the reserved grey so they never look like a tribe
+// the server colored.
 function getTribeColor(tribeID) {
   if (!tribeID)
     return "black"
-  if (!isTribeID(tribeID))
-    return "grey"
-
-  var idx = tribeID % colors.length
-  return colors[idx]
+  if (isTribeID(tribeID) && tribeColors[tribeID])
+    return tribeColors[tribeID]
+  return "grey"
 }
 
 function createEntityMarker(info, map) {
@@ -1110,6 +1240,48 @@ class CommandConsole extends React.Component {
   }
 }
 
+class LoginForm extends React.Component {
+  constructor(props) {
+    super(props)
+
+    this.state = {
+      name: "",
+      password: "",
+    }
+
+    this.handleSubmit = this.handleSubmit.bind(this)
+  }
+
+  render() {
+    return (
+      <form className="CommandConsole LoginForm" onSubmit={this.handleSubmit}>
+        <input
+          className="CommandBar"
+          placeholder="User"
+          autoComplete="username"
+          value={this.state.name}
+          onChange={evt => this.setState({ name: evt.target.value })}
+        />
+        <input
+          className="CommandBar"
+          type="password"
+          placeholder="Password"
+          autoComplete="current-password"
+          value={this.state.password}
+          onChange={evt => this.setState({ password: evt.target.value })}
+        />
+        <button type="submit">Log in to send commands</button>
+      </form>
+    )
+  }
+
+  handleSubmit(evt) {
+    evt.preventDefault()
+    this.props.onLogin(this.state.name, this.state.password)
+      .then(() => this.setState({ password: "" }))
+  }
+}
+
 class Legend extends React.Component {
 
   constructor(props) {
@@ -1152,6 +1324,7 @@ class App extends React.Component {
     this.state = {
       notification: {},
       entities: {},
+      clusters: [],
       tribes: {},
       command: "",
       commandMarker: null,
@@ -1159,11 +1332,14 @@ class App extends React.Component {
       activeTribeColor: "",
       consoleFocused: false,
       sending: false,
-      commandConsoleEnabled: false
+      commandConsoleEnabled: false,
+      session: null,
     }
 
     this.getData = this.getData.bind(this)
+    this.getEntities = this.getEntities.bind(this)
     this.checkCommandConsoleEnabled = this.checkCommandConsoleEnabled.bind(this);
+    this.handleLogin = this.handleLogin.bind(this)
     this.poll = this.poll.bind(this)
 
     this.handleWorldMapCancelCommand = this.handleWorldMapCancelCommand.bind(this)
@@ -1173,6 +1349,7 @@ class App extends React.Component {
 
     this.handleWorldMapPopupClose = this.handleWorldMapPopupClose.bind(this)
     this.handleWorldMapPopupOpen = this.handleWorldMapPopupOpen.bind(this)
+    this.handleWorldMapViewChange = this.handleWorldMapViewChange.bind(this)
 
     this.handleCommandConsoleChange = this.handleCommandConsoleChange.bind(this)
     this.handleCommandConsoleSubmit = this.handleCommandConsoleSubmit.bind(this)
@@ -1207,12 +1384,14 @@ class App extends React.Component {
   render() {
     const {
       activeTribeColor, shipPath,
-      command, commandMarker, consoleFocused, entities,
-      notification, tribes,  commandConsoleEnabled,
+      command, commandMarker, consoleFocused, entities, clusters,
+      notification, tribes,  commandConsoleEnabled, session,
     } = this.state
 
     let CommandConsoleComponent;
-    if (commandConsoleEnabled) {
+    if (commandConsoleEnabled && !session) {
+      CommandConsoleComponent = <LoginForm onLogin={this.handleLogin} />
+    } else if (commandConsoleEnabled) {
       CommandConsoleComponent = <CommandConsole
           text={command}
           focused={consoleFocused}
@@ -1230,6 +1409,7 @@ class App extends React.Component {
         <TitleBar />
         <WorldMap
           entities={entities}
+          clusters={clusters}
           commandMarker={commandMarker}
           shipPath={shipPath}
           color={activeTribeColor}
@@ -1239,6 +1419,7 @@ class App extends React.Component {
           onCancelCommand={this.handleWorldMapCancelCommand}
           onPopupOpen={this.handleWorldMapPopupOpen}
           onPopupClose={this.handleWorldMapPopupClose}
+          onViewChange={this.handleWorldMapViewChange}
         />
         <div className={"notification " + (notification.type || "hidden")}>
           {notification.msg}
@@ -1266,11 +1447,21 @@ class App extends React.Component {
         })
       })
 
-    var pData = fetch("getdata")
+    var pData = this.getEntities()
+
+      return Promise.all([pTribes,pData])
+  }
+
+  getEntities() {
+    // only ask for the visible area; zoomed out views come back as clusters
+    const view = this.view || { zoom: 0, bbox: [0, 0, 1, 1] }
+    return fetch(`getdata?zoom=${view.zoom}&bbox=${view.bbox.join(",")}`)
       .then(res => res.json())
-      .then(entities => {
-        // console.log({ entities })
-        this.setState({ entities })
+      .then(result => {
+        this.setState({
+          entities: result.Entities || {},
+          clusters: result.Clusters || [],
+        })
       })
       .catch((err) => {
         console.error(err)
@@ -1281,22 +1472,54 @@ class App extends React.Component {
           }
         })
       })
+  }
 
-      return Promise.all([pTribes,pData])
+  handleWorldMapViewChange(view) {
+    this.view = view
+    this.getEntities()
   }
 
+  // commands are disabled on 405, need a login on 401
   checkCommandConsoleEnabled() {
-    fetch("command", { method: "POST", body: ""})
-      .then(res => { 
-        console.log(res);
+    fetch("session", { credentials: "same-origin" })
+      .then(res => {
         if (res.status == 405) {
-          this.setState({commandConsoleEnabled: false});
+          this.setState({commandConsoleEnabled: false, session: null});
+        } else if (!res.ok) {
+          this.setState({commandConsoleEnabled: true, session: null});
         } else {
-          this.setState({commandConsoleEnabled: true});
+          return res.json().then(session => {
+            this.setState({commandConsoleEnabled: true, session});
+            return loadPossibilities(session)
+          })
         }
       });
   }
 
+  handleLogin(name, password) {
+    return fetch("login", {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ Name: name, Password: password }),
+    })
+      .then(res => {
+        if (!res.ok) {
+          this.setState({
+            notification: {
+              type: "error",
+              msg: "Login failed",
+            },
+          })
+          return
+        }
+        return res.json().then(session => {
+          this.setState({ session, notification: {} })
+          return loadPossibilities(session)
+        })
+      })
+  }
+
   poll() {
     clearTimeout(this.pollHandle)
 
@@ -1326,7 +1549,7 @@ class App extends React.Component {
     this.setState({ consoleFocused: true })
   }
 
-  handleCommandConsoleSubmit(cmd) {
+  handleCommandConsoleSubmit(cmd, confirmToken) {
     this.setState({
       sending: true,
       notification: {
@@ -1335,19 +1558,48 @@ class App extends React.Component {
       }
     })
 
+    const { session } = this.state
+    const headers = { "X-CSRF-Token": session ? session.CSRFToken : "" }
+    if (confirmToken)
+      headers["X-Confirm-Token"] = confirmToken
     return fetch("command", {
       method: "POST",
+      credentials: "same-origin",
+      headers,
       body: cmd,
     })
       .then(res => {
+        // dangerous commands are sent again with the token once confirmed
+        if (res.status == 202) {
+          return res.json().then(preview => {
+            this.setState({ sending: false, notification: {} })
+            if (window.confirm("Really send " + preview.Command + "?"))
+              return this.handleCommandConsoleSubmit(cmd, preview.ConfirmToken)
+          })
+        }
+        if (res.status == 429) {
+          this.setState({
+            sending: false,
+            notification: {
+              type: "error",
+              msg: "Too many commands, try again in " + res.headers.get("Retry-After") + "s",
+            },
+          })
+          throw res
+        }
         if (!res.ok) {
           this.setState({
             sending: false,
+            // an expired session asks for a login again
+            session: res.status == 401 ? null : session,
             notification: {
               type: "error",
-              msg: "Failed to execute command",
+              msg: res.status == 403 ? "Not allowed to send this command" : "Failed to execute command",
             },
           })
+          // invalid commands and stale confirmations come back with the reason
+          if (res.status == 400 || res.status == 409)
+            res.text().then(msg => this.setState({ notification: { type: "error", msg } }))
           throw res
         }
 
@@ -1438,7 +1690,20 @@ class App extends React.Component {
   }
 }
 
-ReactDOM.render(
-  <App refresh={5 * 1000 /* 5 seconds */} />,
-  document.getElementById("app")
-)
+// The cluster layout comes from the server's ServerGrid.json
+fetch("grid")
+  .then(res => res.json())
+  .then(grid => {
+    config.ServersX = grid.ServersX
+    config.ServersY = grid.ServersY
+    config.Servers = grid.Servers
+  })
+  .catch(err => {
+    console.error(err)
+    config.ServersX = config.ServersX || 15
+    config.ServersY = config.ServersY || 15
+  })
+  .then(() => ReactDOM.render(
+    <App refresh={5 * 1000 /* 5 seconds */} />,
+    document.getElementById("app")
+  ))